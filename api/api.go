@@ -0,0 +1,154 @@
+// Package api serves the resources computed by kube eagle as JSON, for consumers which don't want to parse the
+// Prometheus exposition format.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Prefix is the path prefix of all API endpoints
+const Prefix = "/api/v1/"
+
+// ReportsFunc returns the reports of all clusters matching the filter, see collector.KubeEagleCollector.Reports
+type ReportsFunc func(ctx context.Context, filter collector.ReportFilter) ([]*collector.Report, map[string]error)
+
+// Response is the body of all successful API responses. Errors contains the clusters whose resources couldn't be
+// fetched, so that the items of the other clusters can still be returned.
+type Response struct {
+	Items  interface{}    `json:"items"`
+	Errors []ClusterError `json:"errors,omitempty"`
+}
+
+// ClusterError names a cluster whose resources couldn't be fetched. The error itself is only logged, as it may contain
+// details like the API server's address, Error is always clusterErrorMessage.
+type ClusterError struct {
+	Cluster string `json:"cluster"`
+	Error   string `json:"error"`
+}
+
+// clusterErrorMessage is the error of all clusters whose resources couldn't be fetched
+const clusterErrorMessage = "failed to fetch cluster data"
+
+// ErrorResponse is the body of failed API responses
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler returns the handler of the API endpoints below Prefix (nodes, namespaces, pods and containers). All
+// endpoints support the query parameters cluster, namespace, node (each repeatable or comma separated) and
+// labelSelector (pod labels, Kubernetes label selector syntax). Namespaces and nodes are aggregated from the
+// matching pods only.
+func NewHandler(reports ReportsFunc) http.Handler {
+	itemsByEndpoint := map[string]func(reports []*collector.Report) interface{}{
+		"nodes": func(reports []*collector.Report) interface{} {
+			items := []collector.NodeResources{}
+			for _, report := range reports {
+				items = append(items, report.Nodes...)
+			}
+			return items
+		},
+		"namespaces": func(reports []*collector.Report) interface{} {
+			items := []collector.NamespaceResources{}
+			for _, report := range reports {
+				items = append(items, report.Namespaces...)
+			}
+			return items
+		},
+		"pods": func(reports []*collector.Report) interface{} {
+			items := []collector.PodResources{}
+			for _, report := range reports {
+				items = append(items, report.Pods...)
+			}
+			return items
+		},
+		"containers": func(reports []*collector.Report) interface{} {
+			items := []collector.ContainerResources{}
+			for _, report := range reports {
+				items = append(items, report.Containers...)
+			}
+			return items
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items, exists := itemsByEndpoint[strings.TrimPrefix(r.URL.Path, Prefix)]
+		if !exists {
+			writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "unknown endpoint, must be one of nodes, namespaces, pods or containers"})
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "only GET requests are supported"})
+			return
+		}
+		filter, err := parseFilter(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		clusterReports, errorsByCluster := reports(r.Context(), filter)
+		response := Response{Items: items(clusterReports)}
+		for cluster, err := range errorsByCluster {
+			log.Warnf("Failed to fetch resources of cluster '%s' for API request: %v", cluster, err)
+			response.Errors = append(response.Errors, ClusterError{Cluster: cluster, Error: clusterErrorMessage})
+		}
+		sort.Slice(response.Errors, func(i, j int) bool {
+			return response.Errors[i].Cluster < response.Errors[j].Cluster
+		})
+
+		statusCode := http.StatusOK
+		if len(clusterReports) == 0 && len(errorsByCluster) > 0 {
+			statusCode = http.StatusBadGateway
+		}
+		writeJSON(w, statusCode, response)
+	})
+}
+
+// parseFilter builds the report filter from the request's query parameters
+func parseFilter(r *http.Request) (collector.ReportFilter, error) {
+	query := r.URL.Query()
+	filter := collector.ReportFilter{
+		Clusters:   splitValues(query["cluster"]),
+		Namespaces: splitValues(query["namespace"]),
+		Nodes:      splitValues(query["node"]),
+	}
+	if selector := query.Get("labelSelector"); selector != "" {
+		labelSelector, err := labels.Parse(selector)
+		if err != nil {
+			return filter, err
+		}
+		filter.LabelSelector = labelSelector
+	}
+
+	return filter, nil
+}
+
+// splitValues returns all values of a repeatable query parameter, whose values may be comma separated as well
+func splitValues(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			if v != "" {
+				result = append(result, v)
+			}
+		}
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Warnf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/internal/kubetest"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	corev1 "k8s.io/api/core/v1"
+	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+// fixtureReports returns the reports of the clusters a and b, which both consist of the fixture objects, and fails
+// for the cluster broken
+func fixtureReports(ctx context.Context, filter collector.ReportFilter) ([]*collector.Report, map[string]error) {
+	var reports []*collector.Report
+	errorsByCluster := make(map[string]error)
+	for _, cluster := range []string{"a", "b", "broken"} {
+		if len(filter.Clusters) > 0 && !containsString(filter.Clusters, cluster) {
+			continue
+		}
+		if cluster == "broken" {
+			errorsByCluster[cluster] = fmt.Errorf("connection refused")
+			continue
+		}
+		objects := kubetest.Fixture()
+		snapshot := &kubernetes.Snapshot{
+			Cluster:       cluster,
+			FetchedAt:     time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+			Pods:          &corev1.PodList{Items: objects.Pods},
+			PodMetricses:  &v1beta1.PodMetricsList{Items: objects.PodMetricses},
+			Nodes:         &corev1.NodeList{Items: objects.Nodes},
+			NodeMetricses: &v1beta1.NodeMetricsList{Items: objects.NodeMetricses},
+		}
+		reports = append(reports, collector.BuildReport(snapshot, filter))
+	}
+	return reports, errorsByCluster
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// get requests the given path from the handler and decodes the response's items into items
+func get(t *testing.T, handler http.Handler, path string, items interface{}) (int, []ClusterError) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, expected application/json", contentType)
+	}
+	response := Response{Items: items}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("could not decode response %q: %v", recorder.Body.String(), err)
+	}
+	return recorder.Code, response.Errors
+}
+
+func TestPodsFilter(t *testing.T) {
+	tests := []struct {
+		query        string
+		expectedPods []string
+	}{
+		{
+			query: "cluster=a",
+			expectedPods: []string{"a/default/job-1", "a/default/pending-1", "a/default/web-1", "a/default/web-2",
+				"a/kube-system/dns"},
+		},
+		{
+			query:        "cluster=a&cluster=b&namespace=kube-system",
+			expectedPods: []string{"a/kube-system/dns", "b/kube-system/dns"},
+		},
+		{
+			query:        "cluster=a,b&node=node-b",
+			expectedPods: []string{"a/default/web-2", "a/kube-system/dns", "b/default/web-2", "b/kube-system/dns"},
+		},
+		{
+			query:        "cluster=b&namespace=default&labelSelector=app%3Dweb",
+			expectedPods: []string{"b/default/pending-1", "b/default/web-1", "b/default/web-2"},
+		},
+		{
+			query:        "cluster=a&labelSelector=app+in+(job,dns)&node=node-a",
+			expectedPods: []string{"a/default/job-1"},
+		},
+		{
+			query:        "cluster=a&namespace=missing",
+			expectedPods: nil,
+		},
+	}
+	handler := NewHandler(fixtureReports)
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			var items []collector.PodResources
+			statusCode, errors := get(t, handler, Prefix+"pods?"+test.query, &items)
+			if statusCode != http.StatusOK || len(errors) != 0 {
+				t.Errorf("response status = %d with errors %v, expected 200 without errors", statusCode, errors)
+			}
+			var pods []string
+			for _, pod := range items {
+				pods = append(pods, pod.Cluster+"/"+pod.Namespace+"/"+pod.Pod)
+			}
+			sort.Strings(pods)
+			if !reflect.DeepEqual(pods, test.expectedPods) {
+				t.Errorf("pods = %v, expected %v", pods, test.expectedPods)
+			}
+		})
+	}
+}
+
+func TestNodesAndNamespaces(t *testing.T) {
+	handler := NewHandler(fixtureReports)
+
+	// Nodes only contain the resources of the matching pods, but their allocatable resources in any case
+	var nodes []collector.NodeResources
+	get(t, handler, Prefix+"nodes?cluster=a&node=node-a&labelSelector=app%3Dweb", &nodes)
+	if len(nodes) != 1 {
+		t.Fatalf("returned %d nodes, expected 1", len(nodes))
+	}
+	node := nodes[0]
+	if node.Node != "node-a" || node.PodCount != 1 || node.ContainerCount != 2 || node.RequestCPUCores != 0.6 {
+		t.Errorf("node = %+v, expected node-a with one pod, two containers and 0.6 requested CPU cores", node)
+	}
+	if node.AllocatableCPUCores == nil || *node.AllocatableCPUCores != 3.92 {
+		t.Errorf("allocatable CPU cores = %v, expected 3.92", node.AllocatableCPUCores)
+	}
+
+	// Terminated pods aren't summed up
+	var namespaces []collector.NamespaceResources
+	get(t, handler, Prefix+"namespaces?cluster=b&namespace=default", &namespaces)
+	if len(namespaces) != 1 {
+		t.Fatalf("returned %d namespaces, expected 1", len(namespaces))
+	}
+	namespace := namespaces[0]
+	if namespace.Cluster != "b" || namespace.PodCount != 3 || namespace.ContainerCount != 4 || namespace.RequestCPUCores != 1.6 {
+		t.Errorf("namespace = %+v, expected 3 pods, 4 containers and 1.6 requested CPU cores", namespace)
+	}
+}
+
+func TestClusterErrors(t *testing.T) {
+	handler := NewHandler(fixtureReports)
+
+	var containers []collector.ContainerResources
+	statusCode, errors := get(t, handler, Prefix+"containers?namespace=kube-system", &containers)
+	if statusCode != http.StatusOK || len(containers) != 2 {
+		t.Errorf("response status = %d with %d containers, expected 200 with 2 containers", statusCode, len(containers))
+	}
+	// The error itself is only logged
+	if expected := []ClusterError{{Cluster: "broken", Error: "failed to fetch cluster data"}}; !reflect.DeepEqual(errors, expected) {
+		t.Errorf("errors = %v, expected %v", errors, expected)
+	}
+
+	statusCode, _ = get(t, handler, Prefix+"containers?cluster=broken", &containers)
+	if statusCode != http.StatusBadGateway {
+		t.Errorf("response status = %d, expected 502 if all clusters failed", statusCode)
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	tests := []struct {
+		method             string
+		path               string
+		expectedStatusCode int
+	}{
+		{method: http.MethodGet, path: Prefix + "deployments", expectedStatusCode: http.StatusNotFound},
+		{method: http.MethodPost, path: Prefix + "pods", expectedStatusCode: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, path: Prefix + "pods?labelSelector=app%3D%3D%3D", expectedStatusCode: http.StatusBadRequest},
+	}
+	handler := NewHandler(fixtureReports)
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, nil))
+		response := ErrorResponse{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Error == "" {
+			t.Errorf("%s %s: response %q isn't an error response", test.method, test.path, recorder.Body.String())
+		}
+		if recorder.Code != test.expectedStatusCode {
+			t.Errorf("%s %s: response status = %d, expected %d", test.method, test.path, recorder.Code, test.expectedStatusCode)
+		}
+	}
+}
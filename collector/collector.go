@@ -1,111 +1,480 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"github.com/google-cloud-tools/kube-eagle/kubernetes"
 	"github.com/google-cloud-tools/kube-eagle/options"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
+	"runtime/debug"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type collectorFactoryFunc = func(opts *options.Options) (Collector, error)
-
-var (
-	kubernetesClient         *kubernetes.Client
-	scrapeDurationDesc       *prometheus.Desc
-	scrapeSuccessDesc        *prometheus.Desc
-	factoriesByCollectorName = make(map[string]collectorFactoryFunc)
+// Reasons of failed collector scrapes
+const (
+	errorReasonSnapshot  = "snapshot"
+	errorReasonError     = "error"
+	errorReasonTimeout   = "timeout"
+	errorReasonCancelled = "cancelled"
+	errorReasonPanic     = "panic"
+	errorReasonAbandoned = "abandoned"
 )
 
-// registerCollector adds a collector to the registry so that it's Update() method will be called every time
-// the metrics endpoint is triggered
-func registerCollector(collectorName string, collectorFactory collectorFactoryFunc) {
-	log.Debugf("Registering collector '%s'", collectorName)
-	factoriesByCollectorName[collectorName] = collectorFactory
+// Collector is an interface which has to be implemented for each collector which wants to expose metrics. Collectors
+// can be added to a KubeEagleCollector using RegisterCollector.
+type Collector interface {
+	// Describe sends the descriptors of all metrics the collector exposes to the given channel
+	Describe(ch chan<- *prometheus.Desc)
+	// Update is called for each cluster every time the metrics endpoint is triggered. It computes the metrics from the
+	// given snapshot, which is shared by all collectors, and sends them to the given channel.
+	Update(ctx context.Context, snapshot *kubernetes.Snapshot, ch chan<- prometheus.Metric) error
+}
+
+// OpenMetricsTyper is implemented by collectors which expose info metrics or statesets. Prometheus metric families
+// lack these types, so they are exposed as gauges in OpenMetrics unless their collector provides their types.
+type OpenMetricsTyper interface {
+	// OpenMetricsTypes returns the OpenMetrics types (openmetrics.TypeInfo or openmetrics.TypeStateSet) of the
+	// collector's gauges by metric family name
+	OpenMetricsTypes() map[string]string
+}
+
+// Factory creates a collector using kube eagle's options (e. g. the metrics namespace)
+type Factory func(opts *options.Options) (Collector, error)
+
+// defaultCollectorFactories returns the factories of all built-in collectors by collector name
+func defaultCollectorFactories() map[string]Factory {
+	return map[string]Factory{
+		"container_resources": newContainerResourcesCollector,
+		"node_resource":       newNodeResourcesCollector,
+		"pod_status":          newPodStatusCollector,
+	}
 }
 
 // KubeEagleCollector implements the prometheus collector interface
 type KubeEagleCollector struct {
 	CollectorByName map[string]Collector
+
+	opts               *options.Options
+	kubernetesClients  []*kubernetes.Client
+	scrapeDurationDesc *prometheus.Desc
+	scrapeSuccessDesc  *prometheus.Desc
+	clusterSuccessDesc *prometheus.Desc
+	listDurationDesc   *prometheus.Desc
+	listObjectsDesc    *prometheus.Desc
+	errorsTotal        *prometheus.CounterVec
+	collectorTimeout   time.Duration
+
+	// abandonedRuns contains the collector runs which timed out or have been cancelled, but haven't returned yet
+	abandonedMutex sync.Mutex
+	abandonedRuns  map[collectorRun]bool
+	abandoned      *prometheus.GaugeVec
+
+	maxSeries              int
+	seriesLimitReachedDesc *prometheus.Desc
+	droppedSeriesTotal     *prometheus.CounterVec
+
+	scrapeStatus       *scrapeStatus
+	maxScrapeAge       time.Duration
+	requireAllClusters bool
 }
 
-// NewKubeEagleCollector creates a new KubeEagle collector which can be considered as manager of multiple collectors
-func NewKubeEagleCollector(opts *options.Options) (*KubeEagleCollector, error) {
-	// Create registered collectors by executing it's collector factory function
-	collectorByName := make(map[string]Collector)
-	for collectorName, factory := range factoriesByCollectorName {
-		log.Debugf("Creating collector '%s'", collectorName)
-		collector, err := factory(opts)
+// New creates a new KubeEagle collector which can be considered as manager of multiple collectors. All collectors
+// collect metrics from each of the given clients. The returned collector can be registered with any prometheus
+// registry, so that kube eagle can be embedded into other exporters.
+func New(clients []*kubernetes.Client, opts *options.Options) (*KubeEagleCollector, error) {
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("at least one kubernetes client is required")
+	}
+
+	k := &KubeEagleCollector{
+		CollectorByName:   make(map[string]Collector),
+		opts:              opts,
+		kubernetesClients: clients,
+		scrapeDurationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "scrape", "collector_duration_seconds"),
+			"Kube Eagle: Duration of a collector scrape.",
+			[]string{"collector", "cluster"},
+			nil,
+		),
+		scrapeSuccessDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "scrape", "collector_success"),
+			"Kube Eagle: Whether a collector succeeded.",
+			[]string{"collector", "cluster"},
+			nil,
+		),
+		clusterSuccessDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "scrape", "cluster_success"),
+			"Kube Eagle: Whether all collectors succeeded for a cluster.",
+			[]string{"cluster"},
+			nil,
+		),
+		listDurationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "kube_api", "list_duration_seconds"),
+			"Kube Eagle: Duration of the most recent LIST request (including all pages) against the Kubernetes API.",
+			[]string{"resource", "cluster"},
+			nil,
+		),
+		listObjectsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "kube_api", "list_objects"),
+			"Kube Eagle: Number of objects returned by the most recent LIST request against the Kubernetes API.",
+			[]string{"resource", "cluster"},
+			nil,
+		),
+		errorsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: opts.Namespace,
+				Subsystem: "scrape",
+				Name:      "collector_errors_total",
+				Help:      "Kube Eagle: Number of failed collector scrapes by reason (snapshot, error, timeout, cancelled, panic or abandoned).",
+			},
+			[]string{"collector", "cluster", "reason"},
+		),
+		collectorTimeout: opts.CollectorTimeout,
+		abandonedRuns:    make(map[collectorRun]bool),
+		abandoned: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: opts.Namespace,
+				Subsystem: "scrape",
+				Name:      "collector_abandoned",
+				Help:      "Kube Eagle: Whether a timed out or cancelled run of a collector is still in flight, so that the collector is skipped.",
+			},
+			[]string{"collector", "cluster"},
+		),
+		maxSeries: opts.CollectorMaxSeries,
+		seriesLimitReachedDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, "scrape", "collector_series_limit_reached"),
+			"Kube Eagle: Whether a collector exceeded the maximum number of series and some of its series have been dropped.",
+			[]string{"collector", "cluster"},
+			nil,
+		),
+		droppedSeriesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: opts.Namespace,
+				Subsystem: "scrape",
+				Name:      "collector_dropped_series_total",
+				Help:      "Kube Eagle: Number of series which have been dropped, as a collector exceeded the maximum number of series.",
+			},
+			[]string{"collector", "cluster"},
+		),
+		scrapeStatus:       newScrapeStatus(),
+		maxScrapeAge:       opts.ReadinessMaxScrapeAge,
+		requireAllClusters: opts.ReadinessRequireAllClusters,
+	}
+
+	for collectorName, factory := range defaultCollectorFactories() {
+		err := k.RegisterCollector(collectorName, factory)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create collector '%s': '%s'", collectorName, err)
+			return nil, err
 		}
-		collectorByName[collectorName] = collector
 	}
 
-	var err error
-	kubernetesClient, err = kubernetes.NewClient(opts)
-	if err != nil {
-		return nil, fmt.Errorf("failed to initialize kubernetes client: '%v'", err)
+	return k, nil
+}
+
+// RegisterCollector creates a collector using the given factory and adds it, so that its Update() method will be
+// called every time the metrics endpoint is triggered. Collectors must be registered before the KubeEagleCollector
+// is registered with a prometheus registry. Registrations aren't carried over to other KubeEagleCollectors, e. g. the
+// ones kube eagle builds when its configuration is reloaded.
+func (k *KubeEagleCollector) RegisterCollector(collectorName string, factory Factory) error {
+	if _, exists := k.CollectorByName[collectorName]; exists {
+		return fmt.Errorf("collector '%s' is already registered", collectorName)
 	}
 
-	scrapeDurationDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(opts.Namespace, "scrape", "collector_duration_seconds"),
-		"Kube Eagle: Duration of a collector scrape.",
-		[]string{"collector"},
-		nil,
-	)
-	scrapeSuccessDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(opts.Namespace, "scrape", "collector_success"),
-		"Kube Eagle: Whether a collector succeeded.",
-		[]string{"collector"},
-		nil,
-	)
+	log.Debugf("Creating collector '%s'", collectorName)
+	collector, err := factory(k.opts)
+	if err != nil {
+		return fmt.Errorf("failed to create collector '%s': '%s'", collectorName, err)
+	}
+	k.CollectorByName[collectorName] = collector
 
-	return &KubeEagleCollector{CollectorByName: collectorByName}, nil
+	return nil
 }
 
 // Describe implements the prometheus.Collector interface
-func (k KubeEagleCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- scrapeDurationDesc
-	ch <- scrapeSuccessDesc
+func (k *KubeEagleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- k.scrapeDurationDesc
+	ch <- k.scrapeSuccessDesc
+	ch <- k.clusterSuccessDesc
+	ch <- k.listDurationDesc
+	ch <- k.listObjectsDesc
+	ch <- k.seriesLimitReachedDesc
+	k.errorsTotal.Describe(ch)
+	k.droppedSeriesTotal.Describe(ch)
+	k.abandoned.Describe(ch)
+	for _, collector := range k.CollectorByName {
+		collector.Describe(ch)
+	}
+}
+
+// OpenMetricsTypes returns the OpenMetrics types of all collectors implementing OpenMetricsTyper, see
+// openmetrics.HandlerFor
+func (k *KubeEagleCollector) OpenMetricsTypes() map[string]string {
+	types := make(map[string]string)
+	for _, collector := range k.CollectorByName {
+		if typer, ok := collector.(OpenMetricsTyper); ok {
+			for name, metricType := range typer.OpenMetricsTypes() {
+				types[name] = metricType
+			}
+		}
+	}
+	return types
 }
 
 // Collect implements the prometheus.Collector interface
-func (k KubeEagleCollector) Collect(ch chan<- prometheus.Metric) {
+func (k *KubeEagleCollector) Collect(ch chan<- prometheus.Metric) {
+	k.collect(context.Background(), ch)
+}
+
+// WithContext returns a prometheus collector whose Kubernetes API calls are bound to the given context, so that
+// they are cancelled along with it (e. g. when the scraping HTTP request is cancelled)
+func (k *KubeEagleCollector) WithContext(ctx context.Context) prometheus.Collector {
+	return scrapeCollector{KubeEagleCollector: k, ctx: ctx}
+}
+
+// collect scrapes all clusters and sends the metrics to the given channel
+func (k *KubeEagleCollector) collect(ctx context.Context, ch chan<- prometheus.Metric) {
 	wg := sync.WaitGroup{}
 
+	// Scrape all clusters concurrently, so that a slow or broken cluster does not affect the others
+	for _, client := range k.kubernetesClients {
+		wg.Add(1)
+		go func(wg *sync.WaitGroup, client *kubernetes.Client) {
+			defer wg.Done()
+			k.collectCluster(ctx, client, ch)
+		}(&wg, client)
+	}
+	wg.Wait()
+
+	k.errorsTotal.Collect(ch)
+	k.droppedSeriesTotal.Collect(ch)
+	k.abandoned.Collect(ch)
+}
+
+// collectCluster fetches a snapshot of a single cluster and runs all collectors against it
+func (k *KubeEagleCollector) collectCluster(ctx context.Context, client *kubernetes.Client, ch chan<- prometheus.Metric) {
+	wg := sync.WaitGroup{}
+	clusterName := client.Name()
+	var failedCount int32
+
+	// All collectors fail if the snapshot can't be fetched
+	snapshot, snapshotErr := client.Snapshot(ctx)
+	if snapshotErr != nil {
+		log.Errorf("Failed to fetch snapshot of cluster '%s': %s", clusterName, snapshotErr)
+	}
+
 	// Run all collectors concurrently and add meta information about that (such as request duration and error/success count)
 	for name, collector := range k.CollectorByName {
 		wg.Add(1)
 		go func(wg *sync.WaitGroup, collectorName string, c Collector) {
 			defer wg.Done()
 			begin := time.Now()
-			err := c.updateMetrics(ch)
+			err, reason := snapshotErr, errorReasonSnapshot
+			var isLimitReached float64
+			if err == nil {
+				var metrics []prometheus.Metric
+				metrics, reason, err = k.runCollector(ctx, collectorRun{collector: collectorName, cluster: clusterName}, c, snapshot)
+				if k.maxSeries > 0 && len(metrics) > k.maxSeries {
+					var droppedCount int
+					metrics, droppedCount = limitSeries(metrics, k.maxSeries)
+					log.Warnf("Collector '%s' exceeded the maximum of %d series for cluster '%s', dropped %d series", collectorName, k.maxSeries, clusterName, droppedCount)
+					isLimitReached = 1
+					k.droppedSeriesTotal.WithLabelValues(collectorName, clusterName).Add(float64(droppedCount))
+				}
+				for _, metric := range metrics {
+					ch <- metric
+				}
+			}
 			duration := time.Since(begin)
 
 			var isSuccess float64
 			if err != nil {
-				log.Errorf("Collector '%s' failed after %fs: %s", collectorName, duration.Seconds(), err)
+				log.Errorf("Collector '%s' failed for cluster '%s' after %fs: %s", collectorName, clusterName, duration.Seconds(), err)
 				isSuccess = 0
+				atomic.AddInt32(&failedCount, 1)
+				k.errorsTotal.WithLabelValues(collectorName, clusterName, reason).Inc()
 			} else {
-				log.Debugf("Collector '%s' succeeded after  %fs.", collectorName, duration.Seconds())
+				log.Debugf("Collector '%s' succeeded for cluster '%s' after  %fs.", collectorName, clusterName, duration.Seconds())
 				isSuccess = 1
 			}
-			ch <- prometheus.MustNewConstMetric(scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), collectorName)
-			ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, isSuccess, collectorName)
+			ch <- prometheus.MustNewConstMetric(k.scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds(), collectorName, clusterName)
+			ch <- prometheus.MustNewConstMetric(k.scrapeSuccessDesc, prometheus.GaugeValue, isSuccess, collectorName, clusterName)
+			ch <- prometheus.MustNewConstMetric(k.seriesLimitReachedDesc, prometheus.GaugeValue, isLimitReached, collectorName, clusterName)
 		}(&wg, name, collector)
 	}
 	wg.Wait()
+
+	var isClusterSuccess float64
+	if failedCount == 0 {
+		isClusterSuccess = 1
+	}
+	k.scrapeStatus.record(clusterName, failedCount == 0)
+	ch <- prometheus.MustNewConstMetric(k.clusterSuccessDesc, prometheus.GaugeValue, isClusterSuccess, clusterName)
+
+	for resource, stats := range client.ListStats() {
+		ch <- prometheus.MustNewConstMetric(k.listDurationDesc, prometheus.GaugeValue, stats.Duration.Seconds(), resource, clusterName)
+		ch <- prometheus.MustNewConstMetric(k.listObjectsDesc, prometheus.GaugeValue, float64(stats.ObjectCount), resource, clusterName)
+	}
 }
 
-// IsHealthy returns a bool which indicates whether the collector is working properly or not
-func (k KubeEagleCollector) IsHealthy() bool {
-	return kubernetesClient.IsHealthy()
+// collectorRun identifies the runs of a collector for a cluster
+type collectorRun struct {
+	collector string
+	cluster   string
 }
 
-// Collector is an interface which has to be implemented for each collector which wants to expose metrics
-type Collector interface {
-	updateMetrics(ch chan<- prometheus.Metric) error
+// runCollector runs a single collector with the configured timeout. The collector's metrics are buffered and only
+// returned if it succeeded in time, so that a stuck collector can be abandoned without blocking the scrape. Go can't
+// stop the abandoned goroutine, thus the collector is skipped for the cluster until the abandoned run returns, so that
+// stuck collectors don't pile up goroutines. Panics are recovered and returned as errors. The returned reason
+// describes the kind of error.
+func (k *KubeEagleCollector) runCollector(ctx context.Context, run collectorRun, c Collector, snapshot *kubernetes.Snapshot) ([]prometheus.Metric, string, error) {
+	k.abandonedMutex.Lock()
+	if k.abandonedRuns[run] {
+		k.abandonedMutex.Unlock()
+		return nil, errorReasonAbandoned, fmt.Errorf("the previous run timed out or has been cancelled and is still in flight")
+	}
+	k.abandonedMutex.Unlock()
+	// isReturned is guarded by abandonedMutex, so that a run can't be marked as abandoned after it returned
+	isReturned := false
+
+	ctx, cancel := context.WithTimeout(ctx, k.collectorTimeout)
+	defer cancel()
+
+	type result struct {
+		metrics []prometheus.Metric
+		reason  string
+		err     error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		defer func() {
+			k.abandonedMutex.Lock()
+			defer k.abandonedMutex.Unlock()
+			isReturned = true
+			if k.abandonedRuns[run] {
+				delete(k.abandonedRuns, run)
+				k.abandoned.WithLabelValues(run.collector, run.cluster).Set(0)
+				log.Infof("Abandoned run of collector '%s' for cluster '%s' has returned", run.collector, run.cluster)
+			}
+		}()
+		metricCh := make(chan prometheus.Metric)
+		metricsCh := make(chan []prometheus.Metric)
+		go func() {
+			var metrics []prometheus.Metric
+			for metric := range metricCh {
+				metrics = append(metrics, metric)
+			}
+			metricsCh <- metrics
+		}()
+
+		reason := errorReasonError
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("Recovered collector panic: %v\n%s", r, debug.Stack())
+					reason = errorReasonPanic
+					err = fmt.Errorf("collector panicked: %v", r)
+				}
+			}()
+			return c.Update(ctx, snapshot, metricCh)
+		}()
+		close(metricCh)
+		resultCh <- result{metrics: <-metricsCh, reason: reason, err: err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		if r.err != nil {
+			// Partial metrics of a failed collector would be indistinguishable from complete ones
+			return nil, r.reason, r.err
+		}
+		return r.metrics, r.reason, nil
+	case <-ctx.Done():
+		k.abandonedMutex.Lock()
+		if !isReturned {
+			k.abandonedRuns[run] = true
+			k.abandoned.WithLabelValues(run.collector, run.cluster).Set(1)
+		}
+		k.abandonedMutex.Unlock()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errorReasonTimeout, fmt.Errorf("collector timed out after %s", k.collectorTimeout)
+		}
+		return nil, errorReasonCancelled, ctx.Err()
+	}
+}
+
+// objectLabels are the labels identifying the Kubernetes object a series belongs to, in order of precedence: series
+// with namespace and pod labels belong to that pod (including all of its containers), other series with a node label
+// belong to that node
+var objectLabels = [][]string{{"namespace", "pod"}, {"node"}}
+
+// limitSeries returns at most max of the given metrics and the number of dropped ones. Whole objects (e. g. a pod with
+// all series of all its containers) are dropped rather than single series, so that the metrics of an object remain
+// consistent. The objects are sorted by their labels and kept in that order, thus the same objects are kept in every
+// scrape.
+func limitSeries(metrics []prometheus.Metric, max int) ([]prometheus.Metric, int) {
+	metricsByObject := make(map[string][]prometheus.Metric)
+	for _, metric := range metrics {
+		key := objectKey(metric)
+		metricsByObject[key] = append(metricsByObject[key], metric)
+	}
+	keys := make([]string, 0, len(metricsByObject))
+	for key := range metricsByObject {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	limited := make([]prometheus.Metric, 0, max)
+	for _, key := range keys {
+		if len(limited)+len(metricsByObject[key]) > max {
+			break
+		}
+		limited = append(limited, metricsByObject[key]...)
+	}
+	return limited, len(metrics) - len(limited)
+}
+
+// objectKey returns the values of the metric's object labels. Series without object labels (e. g. aggregated
+// container resources) are identified by all of their label values, thus all families of a label set form an object.
+func objectKey(metric prometheus.Metric) string {
+	m := &dto.Metric{}
+	if err := metric.Write(m); err != nil {
+		return ""
+	}
+	labels := make(map[string]string, len(m.Label))
+	var values []string
+	for _, l := range m.Label {
+		labels[l.GetName()] = l.GetValue()
+		values = append(values, l.GetName()+"="+l.GetValue())
+	}
+
+	for _, names := range objectLabels {
+		var key []string
+		for _, name := range names {
+			if value, exists := labels[name]; exists {
+				key = append(key, name+"="+value)
+			}
+		}
+		if len(key) == len(names) {
+			return strings.Join(key, "\xff")
+		}
+	}
+	return strings.Join(values, "\xff")
+}
+
+// scrapeCollector is a KubeEagleCollector bound to the context of a single scrape
+type scrapeCollector struct {
+	*KubeEagleCollector
+	ctx context.Context
+}
+
+// Collect implements the prometheus.Collector interface
+func (s scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	s.collect(s.ctx, ch)
 }
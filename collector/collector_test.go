@@ -0,0 +1,707 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/internal/kubetest"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/openmetrics"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// newTestCollector creates a collector for the clusters served by the given fake API servers (by cluster name). The
+// options are loaded from the given flags.
+func newTestCollector(t *testing.T, servers map[string]*kubetest.Server, flags ...string) *KubeEagleCollector {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "kubeconfigs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(directory)
+	})
+	for cluster, server := range servers {
+		err = server.WriteKubeconfig(filepath.Join(directory, cluster+".yaml"), cluster)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts, err := options.Load(append([]string{"--kubeconfig-dir", directory, "--kube-api-timeout", "5s", "--version", "test"}, flags...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := kubernetes.NewClients(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := New(clients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// newFixtureServer starts a fake API server serving the fixture cluster, which is closed when the test finishes
+func newFixtureServer(t *testing.T) *kubetest.Server {
+	server := kubetest.NewServer(kubetest.Fixture())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// gather registers the collectors with a pedantic registry (which checks the metrics against the descriptors) and
+// returns all gathered series by name and labels, see seriesKey
+func gather(t *testing.T, collectors ...prometheus.Collector) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewPedanticRegistry()
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			t.Fatalf("could not register collector: %v", err)
+		}
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("could not gather metrics: %v", err)
+	}
+
+	series := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.Metric {
+			value := m.GetGauge().GetValue()
+			if family.GetType() == dto.MetricType_COUNTER {
+				value = m.GetCounter().GetValue()
+			}
+			series[seriesKey(family.GetName(), m.Label)] = value
+		}
+	}
+	return series
+}
+
+// seriesKey returns the series' name followed by its labels sorted by name, e. g. eagle_pod_info{cluster="a",pod="b"}.
+// Labels with empty values are omitted.
+func seriesKey(name string, labelPairs []*dto.LabelPair) string {
+	var labels []string
+	for _, l := range labelPairs {
+		if l.GetValue() != "" {
+			labels = append(labels, l.GetName()+`="`+l.GetValue()+`"`)
+		}
+	}
+	sort.Strings(labels)
+	return name + "{" + strings.Join(labels, ",") + "}"
+}
+
+// withPrefix returns the series whose keys start with the given prefix
+func withPrefix(series map[string]float64, prefix string) map[string]float64 {
+	filtered := make(map[string]float64)
+	for key, value := range series {
+		if strings.HasPrefix(key, prefix) {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+func TestCollectorPedanticRegistry(t *testing.T) {
+	tests := map[string][]string{
+		"defaults":            nil,
+		"terminated pods":     {"--include-terminated-pods"},
+		"dropped labels":      {"--container-resource-drop-labels", "pod,container"},
+		"series limit":        {"--collector-max-series", "10"},
+		"completed pods":      {"--exclude-completed-pods"},
+		"namespaces":          {"--include-namespaces", "default"},
+		"node label selector": {"--node-label-selector", "node.kubernetes.io/instance-type=n1-standard-4"},
+	}
+	for name, flags := range tests {
+		t.Run(name, func(t *testing.T) {
+			k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)}, flags...)
+			series := gather(t, k)
+			if series[`eagle_scrape_cluster_success{cluster="fixture"}`] != 1 {
+				t.Errorf("cluster scrape failed: %v", withPrefix(series, "eagle_scrape_collector_success"))
+			}
+			if len(withPrefix(series, "eagle_pod_container_resource_requests_cpu_cores")) == 0 {
+				t.Errorf("no container resource series have been gathered")
+			}
+		})
+	}
+}
+
+func TestMultipleCollectors(t *testing.T) {
+	// Embedding exporters may register several instances with one registry, as long as their prefixes differ
+	server := newFixtureServer(t)
+	servers := map[string]*kubetest.Server{"fixture": server}
+	web := newTestCollector(t, servers, "--metrics-namespace", "web", "--include-namespaces", "default")
+	system := newTestCollector(t, servers, "--metrics-namespace", "system", "--include-namespaces", "kube-system")
+	series := gather(t, web, system)
+
+	expected := map[string]float64{
+		`web_pod_container_resource_requests_cpu_cores{cluster="fixture",container="app",namespace="default",node="node-b",pod="web-2"}`:      0.5,
+		`system_pod_container_resource_requests_cpu_cores{cluster="fixture",container="dns",namespace="kube-system",node="node-b",pod="dns"}`: 0.1,
+		`web_scrape_cluster_success{cluster="fixture"}`:    1,
+		`system_scrape_cluster_success{cluster="fixture"}`: 1,
+	}
+	for key, value := range expected {
+		if actual, exists := series[key]; !exists || actual != value {
+			t.Errorf("%s = %v (exists %v), expected %v", key, actual, exists, value)
+		}
+	}
+	for prefix, namespace := range map[string]string{"web_": "kube-system", "system_": "default"} {
+		for key := range withPrefix(series, prefix) {
+			if strings.Contains(key, `namespace="`+namespace+`"`) {
+				t.Errorf("%s is exposed, expected only the series of the collector's namespaces", key)
+			}
+		}
+	}
+	if len(withPrefix(series, "eagle_")) != 0 {
+		t.Errorf("series with the default prefix are exposed")
+	}
+}
+
+func TestCollectorFailingCluster(t *testing.T) {
+	broken := newFixtureServer(t)
+	broken.SetUnavailable(true)
+	k := newTestCollector(t, map[string]*kubetest.Server{"healthy": newFixtureServer(t), "other": newFixtureServer(t), "broken": broken})
+	series := gather(t, k)
+
+	for cluster, expected := range map[string]float64{"healthy": 1, "other": 1, "broken": 0} {
+		if actual := series[`eagle_scrape_cluster_success{cluster="`+cluster+`"}`]; actual != expected {
+			t.Errorf("cluster_success of cluster %s = %v, expected %v", cluster, actual, expected)
+		}
+	}
+	for _, cluster := range []string{"healthy", "other"} {
+		key := `eagle_pod_container_resource_requests_cpu_cores{cluster="` + cluster + `",container="app",namespace="default",node="node-a",pod="web-1"}`
+		if series[key] != 0.5 {
+			t.Errorf("%s = %v, expected 0.5", key, series[key])
+		}
+		key = `eagle_node_resource_allocatable_memory_bytes{cluster="` + cluster + `",node="node-b"}`
+		if series[key] != 7*1024*1024*1024 {
+			t.Errorf("%s = %v, expected 7Gi", key, series[key])
+		}
+	}
+
+	for key := range series {
+		if strings.Contains(key, `cluster="broken"`) && !strings.HasPrefix(key, "eagle_scrape_") {
+			t.Errorf("unexpected series of the broken cluster: %s", key)
+		}
+	}
+	for name := range k.CollectorByName {
+		key := `eagle_scrape_collector_errors_total{cluster="broken",collector="` + name + `",reason="snapshot"}`
+		if series[key] != 1 {
+			t.Errorf("%s = %v, expected 1", key, series[key])
+		}
+	}
+}
+
+func TestCheckReadiness(t *testing.T) {
+	broken := newFixtureServer(t)
+	broken.SetUnavailable(true)
+	servers := map[string]*kubetest.Server{"healthy": newFixtureServer(t), "broken": broken}
+	tests := []struct {
+		name            string
+		flags           []string
+		brokenAvailable bool
+		expectedReady   bool
+	}{
+		{name: "one cluster required", expectedReady: true},
+		{name: "all clusters required", flags: []string{"--readiness-require-all-clusters=true"}, expectedReady: false},
+		{name: "all clusters ready", brokenAvailable: true, expectedReady: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broken.SetUnavailable(!test.brokenAvailable)
+			k := newTestCollector(t, servers, test.flags...)
+			isReady, clusters := k.CheckReadiness(context.Background())
+			if isReady != test.expectedReady {
+				t.Errorf("ready = %v, expected %v", isReady, test.expectedReady)
+			}
+
+			sort.Slice(clusters, func(i, j int) bool { return clusters[i].Cluster < clusters[j].Cluster })
+			if len(clusters) != 2 || clusters[0].Cluster != "broken" || clusters[1].Cluster != "healthy" {
+				t.Fatalf("clusters = %+v, expected broken and healthy", clusters)
+			}
+			expectedStatus := map[string]string{"broken": CheckStatusFailed, "healthy": CheckStatusOk}
+			if test.brokenAvailable {
+				expectedStatus["broken"] = CheckStatusOk
+			}
+			for _, cluster := range clusters {
+				if cluster.Status != expectedStatus[cluster.Cluster] {
+					t.Errorf("status of cluster %s = %s, expected %s", cluster.Cluster, cluster.Status, expectedStatus[cluster.Cluster])
+				}
+				for _, check := range cluster.Checks {
+					// The last scrape passes, as there hasn't been one yet
+					isFailing := expectedStatus[cluster.Cluster] == CheckStatusFailed && check.Name != "last_scrape"
+					if (check.Status == CheckStatusFailed) != isFailing || (check.Error != "") != isFailing {
+						t.Errorf("check %s of cluster %s = %+v, expected failing %v", check.Name, cluster.Cluster, check, isFailing)
+					}
+				}
+			}
+		})
+	}
+}
+
+// fakeCollector exposes a single gauge, unless its update function fails
+type fakeCollector struct {
+	desc   *prometheus.Desc
+	update func(ctx context.Context) error
+}
+
+func newFakeCollector(name string, update func(ctx context.Context) error) Factory {
+	return func(opts *options.Options) (Collector, error) {
+		return &fakeCollector{
+			desc:   prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, name, "value"), "Fake collector", []string{"cluster"}, nil),
+			update: update,
+		}, nil
+	}
+}
+
+func (c *fakeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *fakeCollector) Update(ctx context.Context, snapshot *kubernetes.Snapshot, ch chan<- prometheus.Metric) error {
+	// The metric is sent before failing, to verify that metrics of failed collectors are discarded
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1, snapshot.Cluster)
+	return c.update(ctx)
+}
+
+// snapshotCollector records the snapshots it receives and exposes their number of pods
+type snapshotCollector struct {
+	desc      *prometheus.Desc
+	mutex     sync.Mutex
+	snapshots []*kubernetes.Snapshot
+}
+
+func (c *snapshotCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *snapshotCollector) Update(ctx context.Context, snapshot *kubernetes.Snapshot, ch chan<- prometheus.Metric) error {
+	c.mutex.Lock()
+	c.snapshots = append(c.snapshots, snapshot)
+	c.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(len(snapshot.Pods.Items)), snapshot.Cluster)
+	return nil
+}
+
+func TestRegisterCollector(t *testing.T) {
+	k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)}, "--metrics-namespace", "custom")
+	custom := &snapshotCollector{}
+	err := k.RegisterCollector("snapshot", func(opts *options.Options) (Collector, error) {
+		custom.desc = prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "snapshot", "pods"), "Pods of the snapshot", []string{"cluster"}, nil)
+		return custom, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names must be unique, including the ones of the built-in collectors
+	for _, name := range []string{"snapshot", "pod_status"} {
+		if err = k.RegisterCollector(name, newFakeCollector("duplicate", nil)); err == nil {
+			t.Errorf("registered collector %s twice, expected an error", name)
+		}
+	}
+	if err = k.RegisterCollector("broken", func(opts *options.Options) (Collector, error) {
+		return nil, fmt.Errorf("failed")
+	}); err == nil {
+		t.Errorf("registered a collector whose factory failed, expected an error")
+	}
+	if _, exists := k.CollectorByName["broken"]; exists {
+		t.Errorf("the collector whose factory failed has been added")
+	}
+
+	descs := make(chan *prometheus.Desc, 100)
+	k.Describe(descs)
+	close(descs)
+	isDescribed := false
+	for desc := range descs {
+		isDescribed = isDescribed || desc == custom.desc
+	}
+	if !isDescribed {
+		t.Errorf("the custom collector's metric isn't described")
+	}
+
+	series := gather(t, k)
+	if actual := series[`custom_snapshot_pods{cluster="fixture"}`]; actual != 5 {
+		t.Errorf("custom collector exposed %v pods, expected 5", actual)
+	}
+	if actual := series[`custom_scrape_collector_success{cluster="fixture",collector="snapshot"}`]; actual != 1 {
+		t.Errorf("custom collector success = %v, expected 1", actual)
+	}
+	// The custom collector gets the same snapshot as the built-in ones
+	if len(custom.snapshots) != 1 || custom.snapshots[0].Cluster != "fixture" || custom.snapshots[0].Nodes == nil {
+		t.Errorf("custom collector received snapshots %+v, expected one of cluster fixture", custom.snapshots)
+	}
+}
+
+func TestCollectorErrorIsolation(t *testing.T) {
+	k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)}, "--collector-timeout", "100ms")
+	unblock := make(chan struct{})
+	defer close(unblock)
+	collectors := map[string]Factory{
+		"ok": newFakeCollector("ok", func(ctx context.Context) error {
+			return nil
+		}),
+		"failing": newFakeCollector("failing", func(ctx context.Context) error {
+			return fmt.Errorf("failed")
+		}),
+		"panicking": newFakeCollector("panicking", func(ctx context.Context) error {
+			var snapshot *kubernetes.Snapshot
+			return fmt.Errorf("unreachable %s", snapshot.Cluster)
+		}),
+		// Ignores the cancellation of its context, thus must be abandoned
+		"blocking": newFakeCollector("blocking", func(ctx context.Context) error {
+			<-unblock
+			return nil
+		}),
+	}
+	for name, factory := range collectors {
+		if err := k.RegisterCollector(name, factory); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	begin := time.Now()
+	series := gather(t, k)
+	if duration := time.Since(begin); duration > 5*time.Second {
+		t.Errorf("scrape took %v although the blocking collector should have timed out", duration)
+	}
+
+	expected := map[string]float64{
+		`eagle_ok_value{cluster="fixture"}`:                                                                                                1,
+		`eagle_scrape_collector_success{cluster="fixture",collector="ok"}`:                                                                 1,
+		`eagle_scrape_collector_success{cluster="fixture",collector="container_resources"}`:                                                1,
+		`eagle_scrape_collector_success{cluster="fixture",collector="failing"}`:                                                            0,
+		`eagle_scrape_collector_success{cluster="fixture",collector="panicking"}`:                                                          0,
+		`eagle_scrape_collector_success{cluster="fixture",collector="blocking"}`:                                                           0,
+		`eagle_scrape_collector_errors_total{cluster="fixture",collector="failing",reason="error"}`:                                        1,
+		`eagle_scrape_collector_errors_total{cluster="fixture",collector="panicking",reason="panic"}`:                                      1,
+		`eagle_scrape_collector_errors_total{cluster="fixture",collector="blocking",reason="timeout"}`:                                     1,
+		`eagle_scrape_cluster_success{cluster="fixture"}`:                                                                                  0,
+		`eagle_pod_container_resource_requests_cpu_cores{cluster="fixture",container="app",namespace="default",node="node-a",pod="web-1"}`: 0.5,
+	}
+	for key, value := range expected {
+		if actual, exists := series[key]; !exists || actual != value {
+			t.Errorf("%s = %v (exists %v), expected %v", key, actual, exists, value)
+		}
+	}
+	for _, name := range []string{"failing", "panicking", "blocking"} {
+		if _, exists := series[`eagle_`+name+`_value{cluster="fixture"}`]; exists {
+			t.Errorf("metrics of the failed collector %s have been exposed", name)
+		}
+	}
+}
+
+func TestAbandonedCollector(t *testing.T) {
+	k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)}, "--collector-timeout", "100ms")
+	unblock := make(chan struct{})
+	var runs int32
+	err := k.RegisterCollector("blocking", newFakeCollector("blocking", func(ctx context.Context) error {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			// Ignores the cancellation of its context, thus must be abandoned
+			<-unblock
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	series := withPrefix(gather(t, k), "eagle_scrape_collector_")
+	if key := `eagle_scrape_collector_abandoned{cluster="fixture",collector="blocking"}`; series[key] != 1 {
+		t.Errorf("%s = %v after the timeout, expected 1", key, series[key])
+	}
+
+	// The collector isn't started again while the abandoned run is in flight
+	series = withPrefix(gather(t, k), "eagle_scrape_collector_")
+	if key := `eagle_scrape_collector_errors_total{cluster="fixture",collector="blocking",reason="abandoned"}`; series[key] != 1 {
+		t.Errorf("%s = %v, expected 1", key, series[key])
+	}
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("collector has been run %d times while abandoned, expected 1", n)
+	}
+
+	// Once the abandoned run returned, the collector runs again
+	close(unblock)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		k.abandonedMutex.Lock()
+		isAbandoned := k.abandonedRuns[collectorRun{collector: "blocking", cluster: "fixture"}]
+		k.abandonedMutex.Unlock()
+		if !isAbandoned {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the abandoned run hasn't returned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	series = withPrefix(gather(t, k), "eagle_scrape_collector_")
+	expected := map[string]float64{
+		`eagle_scrape_collector_abandoned{cluster="fixture",collector="blocking"}`: 0,
+		`eagle_scrape_collector_success{cluster="fixture",collector="blocking"}`:   1,
+	}
+	for key, value := range expected {
+		if actual, exists := series[key]; !exists || actual != value {
+			t.Errorf("%s = %v (exists %v), expected %v", key, actual, exists, value)
+		}
+	}
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("collector has been run %d times, expected 2", n)
+	}
+}
+
+func TestContainerResourceDropLabels(t *testing.T) {
+	k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)}, "--container-resource-drop-labels", "pod,container")
+	series := gather(t, k)
+
+	// Terminated pods (default/job-1 on node-a) aren't summed up, unscheduled pods have an empty node label
+	expected := map[string]float64{
+		`eagle_pod_container_resource_requests_cpu_cores{cluster="fixture",namespace="default",node="node-a"}`:     0.6,
+		`eagle_pod_container_resource_requests_cpu_cores{cluster="fixture",namespace="default",node="node-b"}`:     0.5,
+		`eagle_pod_container_resource_requests_cpu_cores{cluster="fixture",namespace="default"}`:                   0.5,
+		`eagle_pod_container_resource_requests_cpu_cores{cluster="fixture",namespace="kube-system",node="node-b"}`: 0.1,
+		`eagle_pod_container_resource_usage_cpu_cores{cluster="fixture",namespace="default",node="node-a"}`:        0.3,
+		`eagle_pod_container_resource_usage_memory_bytes{cluster="fixture",namespace="default",node="node-a"}`:     230 * 1024 * 1024,
+		`eagle_pod_container_resource_limits_memory_bytes{cluster="fixture",namespace="default",node="node-a"}`:    512 * 1024 * 1024,
+	}
+	for key, value := range expected {
+		if actual, exists := series[key]; !exists || actual != value {
+			t.Errorf("%s = %v (exists %v), expected %v", key, actual, exists, value)
+		}
+	}
+	if actual := len(withPrefix(series, "eagle_pod_container_resource_requests_cpu_cores")); actual != 4 {
+		t.Errorf("exposed %d series of requested CPU cores, expected 4", actual)
+	}
+}
+
+func TestContainerResourcesOfSameNamedPods(t *testing.T) {
+	// Pods of stateful sets in different namespaces commonly share their names
+	objects := kubetest.Fixture()
+	objects.Namespaces = append(objects.Namespaces, kubetest.Namespace("other", nil))
+	objects.Pods = append(objects.Pods,
+		kubetest.Pod("default", "db-0", "node-a", corev1.PodRunning, map[string]string{"app": "db"}, kubetest.Container("db", "100m", "64Mi", "", "")),
+		kubetest.Pod("other", "db-0", "node-b", corev1.PodRunning, map[string]string{"app": "db"}, kubetest.Container("db", "100m", "64Mi", "", "")))
+	objects.PodMetricses = append(objects.PodMetricses,
+		kubetest.PodMetrics("default", "db-0", map[string]string{"app": "db"}, kubetest.ContainerMetrics("db", "10m", "10Mi")),
+		kubetest.PodMetrics("other", "db-0", map[string]string{"app": "db"}, kubetest.ContainerMetrics("db", "30m", "30Mi")))
+	server := kubetest.NewServer(objects)
+	t.Cleanup(server.Close)
+	series := gather(t, newTestCollector(t, map[string]*kubetest.Server{"fixture": server}))
+
+	expected := map[string]float64{
+		`eagle_pod_container_resource_usage_cpu_cores{cluster="fixture",container="db",namespace="default",node="node-a",pod="db-0"}`:    0.01,
+		`eagle_pod_container_resource_usage_cpu_cores{cluster="fixture",container="db",namespace="other",node="node-b",pod="db-0"}`:      0.03,
+		`eagle_pod_container_resource_usage_memory_bytes{cluster="fixture",container="db",namespace="default",node="node-a",pod="db-0"}`: 10 * 1024 * 1024,
+		`eagle_pod_container_resource_usage_memory_bytes{cluster="fixture",container="db",namespace="other",node="node-b",pod="db-0"}`:   30 * 1024 * 1024,
+	}
+	for key, value := range expected {
+		if actual, exists := series[key]; !exists || actual != value {
+			t.Errorf("%s = %v (exists %v), expected %v", key, actual, exists, value)
+		}
+	}
+}
+
+func TestCollectorMaxSeries(t *testing.T) {
+	server := newFixtureServer(t)
+	k := newTestCollector(t, map[string]*kubetest.Server{"fixture": server}, "--collector-max-series", "20")
+
+	// The pods are kept in the order of their namespace and name: default/pending-1 (6 series) and default/web-1
+	// (12 series for two containers) fit, default/web-2 and kube-system/dns are dropped
+	expectedPods := map[string]bool{"pending-1": true, "web-1": true}
+	for scrape := 1; scrape <= 3; scrape++ {
+		series := gather(t, k)
+		containerSeries := withPrefix(series, "eagle_pod_container_resource_")
+		if len(containerSeries) != 18 {
+			t.Errorf("scrape %d exposed %d container resource series, expected 18", scrape, len(containerSeries))
+		}
+		for key := range containerSeries {
+			pod := key[strings.Index(key, `pod="`)+5:]
+			pod = pod[:strings.Index(pod, `"`)]
+			if !expectedPods[pod] {
+				t.Errorf("scrape %d exposed the series %s of a dropped pod", scrape, key)
+			}
+		}
+
+		labels := `{cluster="fixture",collector="container_resources"}`
+		if actual := series["eagle_scrape_collector_series_limit_reached"+labels]; actual != 1 {
+			t.Errorf("scrape %d: series_limit_reached = %v, expected 1", scrape, actual)
+		}
+		if actual := series["eagle_scrape_collector_dropped_series_total"+labels]; actual != float64(12*scrape) {
+			t.Errorf("scrape %d: dropped_series_total = %v, expected %v", scrape, actual, 12*scrape)
+		}
+		if actual := series["eagle_scrape_collector_success"+labels]; actual != 1 {
+			t.Errorf("scrape %d: collector_success = %v, expected 1", scrape, actual)
+		}
+	}
+}
+
+func TestLimitSeries(t *testing.T) {
+	desc := prometheus.NewDesc("test", "Test", []string{"namespace", "pod", "node", "other"}, nil)
+	metric := func(namespace, pod, node, other string) prometheus.Metric {
+		return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, namespace, pod, node, other)
+	}
+	metrics := []prometheus.Metric{
+		metric("b", "pod", "", "1"),
+		metric("a", "pod-2", "", "1"),
+		metric("a", "pod-1", "", "1"),
+		metric("a", "pod-2", "", "2"),
+		metric("", "", "node", "1"),
+	}
+
+	tests := []struct {
+		max             int
+		expectedIndices []int
+	}{
+		{max: 5, expectedIndices: []int{2, 1, 3, 0, 4}},
+		{max: 4, expectedIndices: []int{2, 1, 3, 0}},
+		{max: 3, expectedIndices: []int{2, 1, 3}},
+		{max: 2, expectedIndices: []int{2}},
+		{max: 0, expectedIndices: []int{}},
+	}
+	for _, test := range tests {
+		limited, dropped := limitSeries(metrics, test.max)
+		if dropped != len(metrics)-len(test.expectedIndices) || len(limited) != len(test.expectedIndices) {
+			t.Errorf("limitSeries(%d) kept %d and dropped %d series, expected to keep %v", test.max, len(limited), dropped, test.expectedIndices)
+			continue
+		}
+		for i, index := range test.expectedIndices {
+			if limited[i] != metrics[index] {
+				t.Errorf("limitSeries(%d) kept %v at %d, expected %v", test.max, limited[i].Desc(), i, index)
+			}
+		}
+	}
+}
+
+func TestTerminatedPods(t *testing.T) {
+	tests := []struct {
+		name      string
+		flags     []string
+		isExposed bool
+	}{
+		{name: "defaults"},
+		{name: "included", flags: []string{"--include-terminated-pods"}, isExposed: true},
+		{name: "completed pods excluded", flags: []string{"--exclude-completed-pods"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)}, test.flags...)
+			series := gather(t, k)
+
+			job := `{cluster="fixture",container="job",namespace="default",node="node-a",pod="job-1"}`
+			if _, exists := series["eagle_pod_container_resource_requests_cpu_cores"+job]; exists {
+				t.Errorf("the terminated pod's resources are exposed as container resources")
+			}
+			if actual, exists := series["eagle_pod_container_terminated_resource_requests_cpu_cores"+job]; exists != test.isExposed || (exists && actual != 0.2) {
+				t.Errorf("terminated resource requests = %v (exists %v), expected to exist %v with 0.2", actual, exists, test.isExposed)
+			}
+			if _, exists := series["eagle_pod_container_terminated_resource_usage_cpu_cores"+job]; exists {
+				t.Errorf("the terminated pod's usage is exposed")
+			}
+
+			// The pod status metrics skip terminated pods like the container resource metrics
+			phase := `eagle_pod_phase{cluster="fixture",eagle_pod_phase="Succeeded",namespace="default",pod="job-1"}`
+			if actual, exists := series[phase]; exists != test.isExposed || (exists && actual != 1) {
+				t.Errorf("%s = %v (exists %v), expected to exist %v with 1", phase, actual, exists, test.isExposed)
+			}
+			if actual := len(withPrefix(series, `eagle_pod_info{cluster="fixture",created_by_kind="Job"`)); actual != boolToInt(test.isExposed) {
+				t.Errorf("exposed %d pod info series of jobs, expected %d", actual, boolToInt(test.isExposed))
+			}
+
+			// Pods in other phases are exposed in any case
+			for _, pod := range []string{"pending-1", "web-1"} {
+				key := `eagle_pod_qos_class{cluster="fixture",eagle_pod_qos_class="Burstable",namespace="default",pod="` + pod + `"}`
+				if series[key] != 1 {
+					t.Errorf("%s = %v, expected 1", key, series[key])
+				}
+			}
+		})
+	}
+}
+
+func TestPodPhases(t *testing.T) {
+	k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)}, "--include-terminated-pods")
+	series := gather(t, k)
+
+	expectedPhases := map[string]string{"web-1": "Running", "web-2": "Running", "job-1": "Succeeded", "pending-1": "Pending"}
+	for pod, expectedPhase := range expectedPhases {
+		for _, phase := range podPhases {
+			key := `eagle_pod_phase{cluster="fixture",eagle_pod_phase="` + string(phase) + `",namespace="default",pod="` + pod + `"}`
+			expected := boolToFloat(string(phase) == expectedPhase)
+			if actual, exists := series[key]; !exists || actual != expected {
+				t.Errorf("%s = %v (exists %v), expected %v", key, actual, exists, expected)
+			}
+		}
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestNodeResources(t *testing.T) {
+	k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)})
+	series := gather(t, k)
+
+	// Milli CPU cores aren't rounded, like in the reports, and terminated pods aren't summed up
+	expected := map[string]float64{
+		`eagle_node_resource_allocatable_cpu_cores{cluster="fixture",node="node-a"}`:    3.92,
+		`eagle_node_resource_allocatable_cpu_cores{cluster="fixture",node="node-b"}`:    2,
+		`eagle_node_resource_allocatable_memory_bytes{cluster="fixture",node="node-a"}`: 15 * 1024 * 1024 * 1024,
+		`eagle_node_resource_requests_cpu_cores{cluster="fixture",node="node-a"}`:       0.6,
+		`eagle_node_resource_requests_memory_bytes{cluster="fixture",node="node-a"}`:    320 * 1024 * 1024,
+		`eagle_node_resource_limits_memory_bytes{cluster="fixture",node="node-b"}`:      682 * 1024 * 1024,
+		`eagle_node_resource_usage_cpu_cores{cluster="fixture",node="node-b"}`:          0.5,
+	}
+	for key, value := range expected {
+		if actual, exists := series[key]; !exists || actual != value {
+			t.Errorf("%s = %v (exists %v), expected %v", key, actual, exists, value)
+		}
+	}
+}
+
+func TestOpenMetricsTypes(t *testing.T) {
+	k := newTestCollector(t, map[string]*kubetest.Server{"fixture": newFixtureServer(t)})
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(k)
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Accept", "application/openmetrics-text")
+	recorder := httptest.NewRecorder()
+	openmetrics.HandlerFor(registry, k.OpenMetricsTypes()).ServeHTTP(recorder, request)
+
+	// The types are declared by the collectors, all other gauges remain gauges
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"# TYPE eagle_node info\n",
+		"# TYPE eagle_pod info\n",
+		"# TYPE eagle_pod_phase stateset\n",
+		"# TYPE eagle_pod_qos_class stateset\n",
+		"# TYPE eagle_scrape_collector_success gauge\n",
+		"# TYPE eagle_kube_api_list_objects gauge\n",
+		"# TYPE eagle_pod_container_resource_requests_cpu_cores gauge\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("OpenMetrics output lacks %q", expected)
+		}
+	}
+}
@@ -1,14 +1,21 @@
 package collector
 
 import (
+	"context"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
 	"github.com/google-cloud-tools/kube-eagle/options"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
 	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
-	"sync"
+	"strings"
 )
 
+// containerResourceLabels are the labels of the container resource metrics, unless they are dropped
+var containerResourceLabels = []string{"pod", "container", "namespace", "node", "cluster"}
+
 type containerResourcesCollector struct {
 	// Resource limits
 	limitCPUCoresDesc    *prometheus.Desc
@@ -21,17 +28,31 @@ type containerResourcesCollector struct {
 	// Resource usage
 	usageCPUCoresDesc    *prometheus.Desc
 	usageMemoryBytesDesc *prometheus.Desc
-}
 
-func init() {
-	registerCollector("container_resources", newContainerResourcesCollector)
+	// Resources of terminated pods, nil unless they shall be included
+	terminatedLimitCPUCoresDesc      *prometheus.Desc
+	terminatedLimitMemoryBytesDesc   *prometheus.Desc
+	terminatedRequestCPUCoresDesc    *prometheus.Desc
+	terminatedRequestMemoryBytesDesc *prometheus.Desc
+
+	// droppedLabels are the labels which are dropped, series which only differ in these labels are summed up
+	droppedLabels map[string]bool
 }
 
 func newContainerResourcesCollector(opts *options.Options) (Collector, error) {
 	subsystem := "pod_container_resource"
-	labels := []string{"pod", "container", "qos", "phase", "namespace", "node"}
+	droppedLabels := make(map[string]bool)
+	for _, label := range opts.ContainerResourceDropLabels {
+		droppedLabels[label] = true
+	}
+	var labels []string
+	for _, label := range containerResourceLabels {
+		if !droppedLabels[label] {
+			labels = append(labels, label)
+		}
+	}
 
-	return &containerResourcesCollector{
+	c := &containerResourcesCollector{
 		// Prometheus metrics
 		// Resource limits
 		limitCPUCoresDesc: prometheus.NewDesc(
@@ -72,57 +93,141 @@ func newContainerResourcesCollector(opts *options.Options) (Collector, error) {
 			labels,
 			prometheus.Labels{},
 		),
-	}, nil
+		droppedLabels: droppedLabels,
+	}
+
+	// Terminated pods don't hold their requested resources anymore, thus they are exposed separately for auditing.
+	// They don't use any resources either.
+	if opts.IncludeTerminatedPods {
+		terminatedSubsystem := "pod_container_terminated_resource"
+		c.terminatedLimitCPUCoresDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, terminatedSubsystem, "limits_cpu_cores"),
+			"The CPU limit of a terminated (succeeded or failed) pod's container in Kubernetes",
+			labels,
+			prometheus.Labels{},
+		)
+		c.terminatedLimitMemoryBytesDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, terminatedSubsystem, "limits_memory_bytes"),
+			"The RAM limit of a terminated (succeeded or failed) pod's container in Kubernetes",
+			labels,
+			prometheus.Labels{},
+		)
+		c.terminatedRequestCPUCoresDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, terminatedSubsystem, "requests_cpu_cores"),
+			"The requested CPU resources of a terminated (succeeded or failed) pod's container in Kubernetes",
+			labels,
+			prometheus.Labels{},
+		)
+		c.terminatedRequestMemoryBytesDesc = prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, terminatedSubsystem, "requests_memory_bytes"),
+			"The requested RAM resources of a terminated (succeeded or failed) pod's container in Kubernetes",
+			labels,
+			prometheus.Labels{},
+		)
+	}
+
+	return c, nil
+}
+
+// Describe implements the Collector interface
+func (c *containerResourcesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.limitCPUCoresDesc
+	ch <- c.limitMemoryBytesDesc
+	ch <- c.requestCPUCoresDesc
+	ch <- c.requestMemoryBytesDesc
+	ch <- c.usageCPUCoresDesc
+	ch <- c.usageMemoryBytesDesc
+	if c.terminatedLimitCPUCoresDesc != nil {
+		ch <- c.terminatedLimitCPUCoresDesc
+		ch <- c.terminatedLimitMemoryBytesDesc
+		ch <- c.terminatedRequestCPUCoresDesc
+		ch <- c.terminatedRequestMemoryBytesDesc
+	}
 }
 
-func (c *containerResourcesCollector) updateMetrics(ch chan<- prometheus.Metric) error {
+// Update implements the Collector interface
+func (c *containerResourcesCollector) Update(ctx context.Context, snapshot *kubernetes.Snapshot, ch chan<- prometheus.Metric) error {
 	log.Debug("Collecting container metrics")
+	var containerMetricses, terminatedContainerMetricses []*enrichedContainerMetricses
+	for _, cm := range buildEnrichedContainerMetricses(snapshot.Pods, snapshot.PodMetricses) {
+		if isTerminated(corev1.PodPhase(cm.Phase)) {
+			terminatedContainerMetricses = append(terminatedContainerMetricses, cm)
+		} else {
+			containerMetricses = append(containerMetricses, cm)
+		}
+	}
 
-	var wg sync.WaitGroup
-	var podList *corev1.PodList
-	var podListError error
-	var podMetricses *v1beta1.PodMetricsList
-	var podMetricsesError error
-
-	// Get pod list
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		podList, podListError = kubernetesClient.PodList()
-	}()
-
-	// Get node resource usage metrics
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		podMetricses, podMetricsesError = kubernetesClient.PodMetricses()
-	}()
-
-	wg.Wait()
-	if podListError != nil {
-		log.Warn("Failed to get podList from Kubernetes", podListError)
-		return podListError
+	for _, s := range c.aggregate(containerMetricses, snapshot.Cluster) {
+		ch <- prometheus.MustNewConstMetric(c.requestCPUCoresDesc, prometheus.GaugeValue, s.requestCPUCores, s.labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.requestMemoryBytesDesc, prometheus.GaugeValue, s.requestMemoryBytes, s.labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.limitCPUCoresDesc, prometheus.GaugeValue, s.limitCPUCores, s.labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.limitMemoryBytesDesc, prometheus.GaugeValue, s.limitMemoryBytes, s.labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.usageCPUCoresDesc, prometheus.GaugeValue, s.usageCPUCores, s.labelValues...)
+		ch <- prometheus.MustNewConstMetric(c.usageMemoryBytesDesc, prometheus.GaugeValue, s.usageMemoryBytes, s.labelValues...)
 	}
-	if podMetricsesError != nil {
-		log.Warn("Failed to get podMetricses from Kubernetes", podMetricsesError)
-		return podMetricsesError
+
+	if c.terminatedLimitCPUCoresDesc != nil {
+		for _, s := range c.aggregate(terminatedContainerMetricses, snapshot.Cluster) {
+			ch <- prometheus.MustNewConstMetric(c.terminatedRequestCPUCoresDesc, prometheus.GaugeValue, s.requestCPUCores, s.labelValues...)
+			ch <- prometheus.MustNewConstMetric(c.terminatedRequestMemoryBytesDesc, prometheus.GaugeValue, s.requestMemoryBytes, s.labelValues...)
+			ch <- prometheus.MustNewConstMetric(c.terminatedLimitCPUCoresDesc, prometheus.GaugeValue, s.limitCPUCores, s.labelValues...)
+			ch <- prometheus.MustNewConstMetric(c.terminatedLimitMemoryBytesDesc, prometheus.GaugeValue, s.limitMemoryBytes, s.labelValues...)
+		}
 	}
 
-	containerMetricses := buildEnrichedContainerMetricses(podList, podMetricses)
+	return nil
+}
 
+// aggregate sums up the containers which only differ in dropped labels, keeping the order in which they were listed
+func (c *containerResourcesCollector) aggregate(containerMetricses []*enrichedContainerMetricses, cluster string) []*containerResourceSeries {
+	var series []*containerResourceSeries
+	seriesByKey := make(map[string]*containerResourceSeries)
 	for _, containerMetrics := range containerMetricses {
 		cm := *containerMetrics
-		log.Debugf("Test")
-		labelValues := []string{cm.Pod, cm.Container, cm.Qos, cm.Phase, cm.Namespace, cm.Node}
-		ch <- prometheus.MustNewConstMetric(c.requestCPUCoresDesc, prometheus.GaugeValue, cm.RequestCPUCores, labelValues...)
-		ch <- prometheus.MustNewConstMetric(c.requestMemoryBytesDesc, prometheus.GaugeValue, cm.RequestMemoryBytes, labelValues...)
-		ch <- prometheus.MustNewConstMetric(c.limitCPUCoresDesc, prometheus.GaugeValue, cm.LimitCPUCores, labelValues...)
-		ch <- prometheus.MustNewConstMetric(c.limitMemoryBytesDesc, prometheus.GaugeValue, cm.LimitMemoryBytes, labelValues...)
-		ch <- prometheus.MustNewConstMetric(c.usageCPUCoresDesc, prometheus.GaugeValue, cm.UsageCPUCores, labelValues...)
-		ch <- prometheus.MustNewConstMetric(c.usageMemoryBytesDesc, prometheus.GaugeValue, cm.UsageMemoryBytes, labelValues...)
+		labelValues := c.labelValues(cm.Pod, cm.Container, cm.Namespace, cm.Node, cluster)
+		key := strings.Join(labelValues, "\xff")
+		s, exists := seriesByKey[key]
+		if !exists {
+			s = &containerResourceSeries{labelValues: labelValues}
+			seriesByKey[key] = s
+			series = append(series, s)
+		}
+		s.requestCPUCores += cm.RequestCPUCores
+		s.requestMemoryBytes += cm.RequestMemoryBytes
+		s.limitCPUCores += cm.LimitCPUCores
+		s.limitMemoryBytes += cm.LimitMemoryBytes
+		s.usageCPUCores += cm.UsageCPUCores
+		s.usageMemoryBytes += cm.UsageMemoryBytes
 	}
+	return series
+}
 
-	return nil
+// isTerminated returns whether a pod in the given phase has terminated (e. g. a finished job or an evicted pod), thus
+// doesn't hold its requested resources anymore
+func isTerminated(phase corev1.PodPhase) bool {
+	return phase == corev1.PodFailed || phase == corev1.PodSucceeded
+}
+
+// labelValues returns the values of the labels which aren't dropped, given the values of all containerResourceLabels
+func (c *containerResourcesCollector) labelValues(allValues ...string) []string {
+	var values []string
+	for i, label := range containerResourceLabels {
+		if !c.droppedLabels[label] {
+			values = append(values, allValues[i])
+		}
+	}
+	return values
+}
+
+// containerResourceSeries are the resources of one or more containers which share the same label values
+type containerResourceSeries struct {
+	labelValues        []string
+	requestCPUCores    float64
+	requestMemoryBytes float64
+	limitCPUCores      float64
+	limitMemoryBytes   float64
+	usageCPUCores      float64
+	usageMemoryBytes   float64
 }
 
 type enrichedContainerMetricses struct {
@@ -132,6 +237,8 @@ type enrichedContainerMetricses struct {
 	Qos                string
 	Phase              string
 	Namespace          string
+	PodLabels          map[string]string
+	IsInitContainer    bool
 	RequestCPUCores    float64
 	RequestMemoryBytes float64
 	LimitCPUCores      float64
@@ -144,35 +251,38 @@ type enrichedContainerMetricses struct {
 // one, so that we can expose valuable metadata (such as a nodename) as prometheus labels which is just present
 // in one of the both responses.
 func buildEnrichedContainerMetricses(podList *corev1.PodList, podMetricses *v1beta1.PodMetricsList) []*enrichedContainerMetricses {
-	// Group container metricses by pod name
-	containerMetricsesByPod := make(map[string]map[string]v1beta1.ContainerMetrics)
+	// Group container metricses by pod, pod names are only unique within their namespace
+	containerMetricsesByPod := make(map[types.NamespacedName]map[string]v1beta1.ContainerMetrics)
 	for _, pm := range podMetricses.Items {
 		containerMetricses := make(map[string]v1beta1.ContainerMetrics)
 		for _, c := range pm.Containers {
 			containerMetricses[c.Name] = c
 		}
-		containerMetricsesByPod[pm.Name] = containerMetricses
+		containerMetricsesByPod[types.NamespacedName{Namespace: pm.Namespace, Name: pm.Name}] = containerMetricses
 	}
 
 	var containerMetricses []*enrichedContainerMetricses
 	for _, podInfo := range podList.Items {
-		containers := append(podInfo.Spec.Containers, podInfo.Spec.InitContainers...)
+		// Copy the containers, as the pod list is shared and must not be modified by appending to it
+		containers := make([]corev1.Container, 0, len(podInfo.Spec.Containers)+len(podInfo.Spec.InitContainers))
+		containers = append(containers, podInfo.Spec.Containers...)
+		containers = append(containers, podInfo.Spec.InitContainers...)
 
-		for _, containerInfo := range containers {
+		for i, containerInfo := range containers {
 			qos := string(podInfo.Status.QOSClass)
 
 			// Resources requested
-			requestCPUCores := float64(containerInfo.Resources.Requests.Cpu().MilliValue()) / 1000
-			requestMemoryBytes := float64(containerInfo.Resources.Requests.Memory().MilliValue()) / 1000
+			requestCPUCores := quantityValue(containerInfo.Resources.Requests.Cpu())
+			requestMemoryBytes := quantityValue(containerInfo.Resources.Requests.Memory())
 
 			// Resources limit
-			limitCPUCores := float64(containerInfo.Resources.Limits.Cpu().MilliValue()) / 1000
-			limitMemoryBytes := float64(containerInfo.Resources.Limits.Memory().MilliValue()) / 1000
+			limitCPUCores := quantityValue(containerInfo.Resources.Limits.Cpu())
+			limitMemoryBytes := quantityValue(containerInfo.Resources.Limits.Memory())
 
 			// Resources usage
-			containerUsageMetrics := containerMetricsesByPod[podInfo.Name][containerInfo.Name]
-			usageCPUCores := float64(containerUsageMetrics.Usage.Cpu().MilliValue()) / 1000
-			usageMemoryBytes := float64(containerUsageMetrics.Usage.Memory().MilliValue()) / 1000
+			containerUsageMetrics := containerMetricsesByPod[types.NamespacedName{Namespace: podInfo.Namespace, Name: podInfo.Name}][containerInfo.Name]
+			usageCPUCores := quantityValue(containerUsageMetrics.Usage.Cpu())
+			usageMemoryBytes := quantityValue(containerUsageMetrics.Usage.Memory())
 
 			nodeName := podInfo.Spec.NodeName
 			metric := &enrichedContainerMetricses{
@@ -182,6 +292,8 @@ func buildEnrichedContainerMetricses(podList *corev1.PodList, podMetricses *v1be
 				Qos:                qos,
 				Phase:              string(podInfo.Status.Phase),
 				Namespace:          podInfo.Namespace,
+				PodLabels:          podInfo.Labels,
+				IsInitContainer:    i >= len(podInfo.Spec.Containers),
 				RequestCPUCores:    requestCPUCores,
 				RequestMemoryBytes: requestMemoryBytes,
 				LimitCPUCores:      limitCPUCores,
@@ -195,3 +307,9 @@ func buildEnrichedContainerMetricses(podList *corev1.PodList, podMetricses *v1be
 
 	return containerMetricses
 }
+
+// quantityValue returns the quantity in its base unit (e. g. CPU cores or bytes). Milli units are retained, so that
+// e. g. 3920m CPU cores aren't rounded up to 4 cores.
+func quantityValue(q *resource.Quantity) float64 {
+	return float64(q.MilliValue()) / 1000
+}
@@ -0,0 +1,132 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+)
+
+const (
+	// CheckStatusOk indicates a passed readiness check
+	CheckStatusOk = "ok"
+	// CheckStatusFailed indicates a failed readiness check
+	CheckStatusFailed = "failed"
+)
+
+// Check is the result of a single readiness check. The error isn't exposed, as it may reveal internals of the cluster
+// (e. g. the API server's address), but it's logged.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"-"`
+}
+
+// ClusterReadiness is the result of all readiness checks of a cluster
+type ClusterReadiness struct {
+	Cluster string  `json:"cluster"`
+	Status  string  `json:"status"`
+	Checks  []Check `json:"checks"`
+}
+
+// scrapeStatus keeps track of the scrape results of all clusters
+type scrapeStatus struct {
+	mutex             sync.Mutex
+	startedAt         time.Time
+	lastAttemptByName map[string]time.Time
+	lastSuccessByName map[string]time.Time
+}
+
+func newScrapeStatus() *scrapeStatus {
+	return &scrapeStatus{
+		startedAt:         time.Now(),
+		lastAttemptByName: make(map[string]time.Time),
+		lastSuccessByName: make(map[string]time.Time),
+	}
+}
+
+// record stores the result of a cluster's scrape
+func (s *scrapeStatus) record(clusterName string, isSuccess bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.lastAttemptByName[clusterName] = now
+	if isSuccess {
+		s.lastSuccessByName[clusterName] = now
+	}
+}
+
+// check returns an error if the most recent scrape of a cluster failed and the last successful scrape (or the start,
+// if there hasn't been one yet) is older than maxAge. Clusters which haven't been scraped at all (e. g. because this
+// replica is a follower) pass.
+func (s *scrapeStatus) check(clusterName string, maxAge time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lastAttempt := s.lastAttemptByName[clusterName]
+	lastSuccess, hasSucceeded := s.lastSuccessByName[clusterName]
+	if lastAttempt.IsZero() || lastSuccess.Equal(lastAttempt) {
+		return nil
+	}
+
+	if !hasSucceeded {
+		lastSuccess = s.startedAt
+	}
+	if age := time.Since(lastSuccess); age > maxAge {
+		return fmt.Errorf("last successful scrape is %s old", age.Round(time.Second))
+	}
+
+	return nil
+}
+
+// CheckReadiness runs all readiness checks for all clusters and returns whether kube eagle is ready. It's considered
+// ready if all checks of at least one cluster passed, so that one broken cluster doesn't affect the others, or only if
+// those of all clusters passed if READINESS_REQUIRE_ALL_CLUSTERS is set.
+func (k *KubeEagleCollector) CheckReadiness(ctx context.Context) (bool, []ClusterReadiness) {
+	wg := sync.WaitGroup{}
+	clusters := make([]ClusterReadiness, len(k.kubernetesClients))
+	for i, client := range k.kubernetesClients {
+		wg.Add(1)
+		go func(i int, client *kubernetes.Client) {
+			defer wg.Done()
+			clusters[i] = ClusterReadiness{
+				Cluster: client.Name(),
+				Status:  CheckStatusOk,
+				Checks: []Check{
+					newCheck("api_server", client.CheckAPIServer(ctx)),
+					newCheck("metrics_api", client.CheckMetricsAPI(ctx)),
+					newCheck("last_scrape", k.scrapeStatus.check(client.Name(), k.maxScrapeAge)),
+				},
+			}
+		}(i, client)
+	}
+	wg.Wait()
+
+	readyCount := 0
+	for i, cluster := range clusters {
+		for _, check := range cluster.Checks {
+			if check.Status != CheckStatusOk {
+				clusters[i].Status = CheckStatusFailed
+			}
+		}
+		if clusters[i].Status == CheckStatusOk {
+			readyCount++
+		}
+	}
+
+	if k.requireAllClusters {
+		return readyCount == len(clusters), clusters
+	}
+	return readyCount > 0, clusters
+}
+
+func newCheck(name string, err error) Check {
+	if err != nil {
+		return Check{Name: name, Status: CheckStatusFailed, Error: err.Error()}
+	}
+
+	return Check{Name: name, Status: CheckStatusOk}
+}
@@ -1,17 +1,20 @@
 package collector
 
 import (
+	"context"
 	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/openmetrics"
 	"github.com/google-cloud-tools/kube-eagle/options"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
-	"sync"
 )
 
 type nodeResourcesCollector struct {
-	kubernetesClient *kubernetes.Client
+	// Metadata
+	infoName string
+	infoDesc *prometheus.Desc
 
 	// Allocatable
 	allocatableCPUCoresDesc    *prometheus.Desc
@@ -31,16 +34,22 @@ type nodeResourcesCollector struct {
 	usagePodCount        *prometheus.Desc
 }
 
-func init() {
-	registerCollector("node_resource", newNodeResourcesCollector)
-}
-
 func newNodeResourcesCollector(opts *options.Options) (Collector, error) {
 	subsystem := "node_resource"
-	labels := []string{"node"}
+	labels := []string{"node", "cluster"}
+	infoName := prometheus.BuildFQName(opts.Namespace, "node", "info")
 
 	return &nodeResourcesCollector{
 		// Prometheus metrics
+		// Metadata
+		infoName: infoName,
+		infoDesc: prometheus.NewDesc(
+			infoName,
+			"Information about a node in Kubernetes",
+			append(labels, "kubelet_version", "container_runtime_version", "kernel_version", "os_image", "architecture",
+				"instance_type", "zone"),
+			prometheus.Labels{},
+		),
 		// Allocatable
 		allocatableCPUCoresDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(opts.Namespace, subsystem, "allocatable_cpu_cores"),
@@ -102,80 +111,96 @@ func newNodeResourcesCollector(opts *options.Options) (Collector, error) {
 	}, nil
 }
 
-func (c *nodeResourcesCollector) updateMetrics(ch chan<- prometheus.Metric) error {
-	log.Debug("Collecting node metrics")
+// Describe implements the Collector interface
+func (c *nodeResourcesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.infoDesc
+	ch <- c.allocatableCPUCoresDesc
+	ch <- c.allocatableMemoryBytesDesc
+	ch <- c.limitCPUCoresDesc
+	ch <- c.limitMemoryBytesDesc
+	ch <- c.requestCPUCoresDesc
+	ch <- c.requestMemoryBytesDesc
+	ch <- c.usageCPUCoresDesc
+	ch <- c.usageMemoryBytesDesc
+	ch <- c.usagePodCount
+}
 
-	var wg sync.WaitGroup
-	var nodeList *corev1.NodeList
-	var nodeListError error
-	var podList *corev1.PodList
-	var podListError error
-	var nodeMetricsList *v1beta1.NodeMetricsList
-	var nodeMetricsListError error
-
-	// Get pod list
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		podList, podListError = kubernetesClient.PodList()
-	}()
-
-	// Get node list
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		nodeList, nodeListError = kubernetesClient.NodeList()
-	}()
-
-	// Get node resource usage metrics
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		nodeMetricsList, nodeMetricsListError = kubernetesClient.NodeMetricses()
-	}()
-
-	wg.Wait()
-	if podListError != nil {
-		log.Warn("Failed to get podList from Kubernetes", podListError)
-		return podListError
-	}
-	if nodeListError != nil {
-		log.Warn("Failed to get nodeList from Kubernetes", nodeListError)
-		return nodeListError
+// OpenMetricsTypes implements the OpenMetricsTyper interface
+func (c *nodeResourcesCollector) OpenMetricsTypes() map[string]string {
+	return map[string]string{c.infoName: openmetrics.TypeInfo}
+}
+
+// Update implements the Collector interface
+func (c *nodeResourcesCollector) Update(ctx context.Context, snapshot *kubernetes.Snapshot, ch chan<- prometheus.Metric) error {
+	log.Debug("Collecting node metrics")
+	podMetricsByNodeName := getAggregatedPodMetricsByNodeName(snapshot.Pods)
+	var nodeMetricsByNodeName map[string]v1beta1.NodeMetrics
+	if snapshot.NodeMetricses != nil {
+		nodeMetricsByNodeName = getNodeMetricsByNodeName(snapshot.NodeMetricses)
 	}
-	if nodeMetricsListError != nil {
-		log.Warn("Failed to get podList from Kubernetes", nodeMetricsListError)
-		return nodeMetricsListError
+
+	// Without permissions to list nodes, the node names are taken from the scheduled pods
+	var nodeNames []string
+	nodesByName := make(map[string]corev1.Node)
+	if snapshot.Nodes != nil {
+		for _, n := range snapshot.Nodes.Items {
+			nodeNames = append(nodeNames, n.Name)
+			nodesByName[n.Name] = n
+		}
+	} else {
+		for nodeName := range podMetricsByNodeName {
+			if nodeName != "" {
+				nodeNames = append(nodeNames, nodeName)
+			}
+		}
 	}
-	nodeMetricsByNodeName := getNodeMetricsByNodeName(nodeMetricsList)
-	podMetricsByNodeName := getAggregatedPodMetricsByNodeName(podList)
 
-	for _, n := range nodeList.Items {
-		// allocatable
-		allocatableCPU := n.Status.Allocatable.Cpu().Value()
-		allocatableMemoryBytes := float64(n.Status.Allocatable.Memory().MilliValue()) / 1000
-		ch <- prometheus.MustNewConstMetric(c.allocatableCPUCoresDesc, prometheus.GaugeValue, float64(allocatableCPU), n.Name)
-		ch <- prometheus.MustNewConstMetric(c.allocatableMemoryBytesDesc, prometheus.GaugeValue, float64(allocatableMemoryBytes), n.Name)
+	for _, nodeName := range nodeNames {
+		// metadata and allocatable
+		if n, exists := nodesByName[nodeName]; exists {
+			info := n.Status.NodeInfo
+			ch <- prometheus.MustNewConstMetric(c.infoDesc, prometheus.GaugeValue, 1, nodeName, snapshot.Cluster,
+				info.KubeletVersion, info.ContainerRuntimeVersion, info.KernelVersion, info.OSImage, info.Architecture,
+				nodeLabel(n, "node.kubernetes.io/instance-type", corev1.LabelInstanceType),
+				nodeLabel(n, "topology.kubernetes.io/zone", corev1.LabelZoneFailureDomain))
+			allocatableCPU := quantityValue(n.Status.Allocatable.Cpu())
+			allocatableMemoryBytes := quantityValue(n.Status.Allocatable.Memory())
+			ch <- prometheus.MustNewConstMetric(c.allocatableCPUCoresDesc, prometheus.GaugeValue, allocatableCPU, nodeName, snapshot.Cluster)
+			ch <- prometheus.MustNewConstMetric(c.allocatableMemoryBytesDesc, prometheus.GaugeValue, allocatableMemoryBytes, nodeName, snapshot.Cluster)
+		}
 
 		// resource usage
-		usageMetrics := nodeMetricsByNodeName[n.Name]
-		usageCPU := float64(usageMetrics.Usage.Cpu().MilliValue()) / 1000
-		usageMemoryBytes := float64(usageMetrics.Usage.Memory().MilliValue()) / 1000
-		ch <- prometheus.MustNewConstMetric(c.usageCPUCoresDesc, prometheus.GaugeValue, float64(usageCPU), n.Name)
-		ch <- prometheus.MustNewConstMetric(c.usageMemoryBytesDesc, prometheus.GaugeValue, float64(usageMemoryBytes), n.Name)
+		if nodeMetricsByNodeName != nil {
+			usageMetrics := nodeMetricsByNodeName[nodeName]
+			usageCPU := quantityValue(usageMetrics.Usage.Cpu())
+			usageMemoryBytes := quantityValue(usageMetrics.Usage.Memory())
+			ch <- prometheus.MustNewConstMetric(c.usageCPUCoresDesc, prometheus.GaugeValue, usageCPU, nodeName, snapshot.Cluster)
+			ch <- prometheus.MustNewConstMetric(c.usageMemoryBytesDesc, prometheus.GaugeValue, usageMemoryBytes, nodeName, snapshot.Cluster)
+		}
 
 		// aggregated pod metrics (e. g. resource requests by node)
-		podMetrics := podMetricsByNodeName[n.Name]
-		ch <- prometheus.MustNewConstMetric(c.requestCPUCoresDesc, prometheus.GaugeValue, podMetrics.requestedCPUCores, n.Name)
-		ch <- prometheus.MustNewConstMetric(c.requestMemoryBytesDesc, prometheus.GaugeValue, float64(podMetrics.requestedMemoryBytes), n.Name)
-		ch <- prometheus.MustNewConstMetric(c.limitCPUCoresDesc, prometheus.GaugeValue, podMetrics.limitCPUCores, n.Name)
-		ch <- prometheus.MustNewConstMetric(c.limitMemoryBytesDesc, prometheus.GaugeValue, float64(podMetrics.limitMemoryBytes), n.Name)
-		ch <- prometheus.MustNewConstMetric(c.usagePodCount, prometheus.GaugeValue, float64(podMetrics.podCount), n.Name)
+		podMetrics := podMetricsByNodeName[nodeName]
+		ch <- prometheus.MustNewConstMetric(c.requestCPUCoresDesc, prometheus.GaugeValue, podMetrics.requestedCPUCores, nodeName, snapshot.Cluster)
+		ch <- prometheus.MustNewConstMetric(c.requestMemoryBytesDesc, prometheus.GaugeValue, podMetrics.requestedMemoryBytes, nodeName, snapshot.Cluster)
+		ch <- prometheus.MustNewConstMetric(c.limitCPUCoresDesc, prometheus.GaugeValue, podMetrics.limitCPUCores, nodeName, snapshot.Cluster)
+		ch <- prometheus.MustNewConstMetric(c.limitMemoryBytesDesc, prometheus.GaugeValue, podMetrics.limitMemoryBytes, nodeName, snapshot.Cluster)
+		ch <- prometheus.MustNewConstMetric(c.usagePodCount, prometheus.GaugeValue, float64(podMetrics.podCount), nodeName, snapshot.Cluster)
 	}
 
 	return nil
 }
 
+// nodeLabel returns the value of the first of the given labels which is set on the node, so that deprecated labels
+// are used as fallback
+func nodeLabel(node corev1.Node, names ...string) string {
+	for _, name := range names {
+		if value, exists := node.Labels[name]; exists {
+			return value
+		}
+	}
+	return ""
+}
+
 // getNodeMetricsByNodeName returns a map of node metrics where the keys are the particular node names
 func getNodeMetricsByNodeName(nodeMetricsList *v1beta1.NodeMetricsList) map[string]v1beta1.NodeMetrics {
 	nodeMetricsByName := make(map[string]v1beta1.NodeMetrics)
@@ -189,9 +214,9 @@ func getNodeMetricsByNodeName(nodeMetricsList *v1beta1.NodeMetricsList) map[stri
 type aggregatedPodMetrics struct {
 	podCount             uint16
 	containerCount       uint16
-	requestedMemoryBytes int64
+	requestedMemoryBytes float64
 	requestedCPUCores    float64
-	limitMemoryBytes     int64
+	limitMemoryBytes     float64
 	limitCPUCores        float64
 }
 
@@ -204,8 +229,7 @@ func getAggregatedPodMetricsByNodeName(pods *corev1.PodList) map[string]aggregat
 		nodeName := podInfo.Spec.NodeName
 
 		// skip not running pods (e. g. failed/succeeded jobs, evicted pods etc.)
-		podPhase := podInfo.Status.Phase
-		if podPhase == corev1.PodFailed || podPhase == corev1.PodSucceeded {
+		if isTerminated(podInfo.Status.Phase) {
 			continue
 		}
 
@@ -213,10 +237,10 @@ func getAggregatedPodMetricsByNodeName(pods *corev1.PodList) map[string]aggregat
 		podCount := podMetrics[nodeName].podCount + 1
 
 		for _, c := range podInfo.Spec.Containers {
-			requestedCPUCores := float64(c.Resources.Requests.Cpu().MilliValue()) / 1000
-			requestedMemoryBytes := c.Resources.Requests.Memory().MilliValue() / 1000
-			limitCPUCores := float64(c.Resources.Limits.Cpu().MilliValue()) / 1000
-			limitMemoryBytes := c.Resources.Limits.Memory().MilliValue() / 1000
+			requestedCPUCores := quantityValue(c.Resources.Requests.Cpu())
+			requestedMemoryBytes := quantityValue(c.Resources.Requests.Memory())
+			limitCPUCores := quantityValue(c.Resources.Limits.Cpu())
+			limitMemoryBytes := quantityValue(c.Resources.Limits.Memory())
 
 			podMetrics[nodeName] = aggregatedPodMetrics{
 				podCount:             podCount,
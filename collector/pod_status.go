@@ -0,0 +1,116 @@
+package collector
+
+import (
+	"context"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/openmetrics"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podPhases and podQOSClasses are the states of the pod phase and QoS class statesets
+var (
+	podPhases     = []corev1.PodPhase{corev1.PodPending, corev1.PodRunning, corev1.PodSucceeded, corev1.PodFailed, corev1.PodUnknown}
+	podQOSClasses = []corev1.PodQOSClass{corev1.PodQOSGuaranteed, corev1.PodQOSBurstable, corev1.PodQOSBestEffort}
+)
+
+// podStatusCollector exposes the pod metadata as info metric and the pod's phase and QoS class as statesets, so that
+// they can be joined with the container resource metrics instead of being labels of every container resource gauge.
+// Like the container resource metrics, terminated pods are skipped unless they are included for auditing.
+type podStatusCollector struct {
+	types                 map[string]string
+	infoDesc              *prometheus.Desc
+	phaseDesc             *prometheus.Desc
+	qosClassDesc          *prometheus.Desc
+	includeTerminatedPods bool
+}
+
+func newPodStatusCollector(opts *options.Options) (Collector, error) {
+	subsystem := "pod"
+	labels := []string{"pod", "namespace", "cluster"}
+	infoName := prometheus.BuildFQName(opts.Namespace, subsystem, "info")
+	phaseName := prometheus.BuildFQName(opts.Namespace, subsystem, "phase")
+	qosClassName := prometheus.BuildFQName(opts.Namespace, subsystem, "qos_class")
+
+	return &podStatusCollector{
+		types: map[string]string{
+			infoName:     openmetrics.TypeInfo,
+			phaseName:    openmetrics.TypeStateSet,
+			qosClassName: openmetrics.TypeStateSet,
+		},
+		infoDesc: prometheus.NewDesc(
+			infoName,
+			"Information about a pod in Kubernetes",
+			append(labels, "node", "host_ip", "pod_ip", "created_by_kind", "created_by_name", "priority_class"),
+			prometheus.Labels{},
+		),
+		// Like OpenMetrics statesets, the state label is named after the metric
+		phaseDesc: prometheus.NewDesc(
+			phaseName,
+			"The pod's current phase in Kubernetes",
+			append(labels, phaseName),
+			prometheus.Labels{},
+		),
+		qosClassDesc: prometheus.NewDesc(
+			qosClassName,
+			"The pod's QoS class in Kubernetes",
+			append(labels, qosClassName),
+			prometheus.Labels{},
+		),
+		includeTerminatedPods: opts.IncludeTerminatedPods,
+	}, nil
+}
+
+// Describe implements the Collector interface
+func (c *podStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.infoDesc
+	ch <- c.phaseDesc
+	ch <- c.qosClassDesc
+}
+
+// OpenMetricsTypes implements the OpenMetricsTyper interface
+func (c *podStatusCollector) OpenMetricsTypes() map[string]string {
+	return c.types
+}
+
+// Update implements the Collector interface
+func (c *podStatusCollector) Update(ctx context.Context, snapshot *kubernetes.Snapshot, ch chan<- prometheus.Metric) error {
+	log.Debug("Collecting pod status metrics")
+	for _, pod := range snapshot.Pods.Items {
+		if isTerminated(pod.Status.Phase) && !c.includeTerminatedPods {
+			continue
+		}
+		var createdByKind, createdByName string
+		for _, owner := range pod.OwnerReferences {
+			if owner.Controller != nil && *owner.Controller {
+				createdByKind = owner.Kind
+				createdByName = owner.Name
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.infoDesc, prometheus.GaugeValue, 1, pod.Name, pod.Namespace, snapshot.Cluster,
+			pod.Spec.NodeName, pod.Status.HostIP, pod.Status.PodIP, createdByKind, createdByName, pod.Spec.PriorityClassName)
+
+		for _, phase := range podPhases {
+			ch <- prometheus.MustNewConstMetric(c.phaseDesc, prometheus.GaugeValue, boolToFloat(pod.Status.Phase == phase),
+				pod.Name, pod.Namespace, snapshot.Cluster, string(phase))
+		}
+		// The QoS class is unset until the pod has been admitted
+		if pod.Status.QOSClass != "" {
+			for _, qosClass := range podQOSClasses {
+				ch <- prometheus.MustNewConstMetric(c.qosClassDesc, prometheus.GaugeValue, boolToFloat(pod.Status.QOSClass == qosClass),
+					pod.Name, pod.Namespace, snapshot.Cluster, string(qosClass))
+			}
+		}
+	}
+
+	return nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,341 @@
+package collector
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Resources are the resource requests, limits and usage of a container or the sum of multiple containers
+type Resources struct {
+	RequestCPUCores    float64 `json:"request_cpu_cores"`
+	RequestMemoryBytes float64 `json:"request_memory_bytes"`
+	LimitCPUCores      float64 `json:"limit_cpu_cores"`
+	LimitMemoryBytes   float64 `json:"limit_memory_bytes"`
+	UsageCPUCores      float64 `json:"usage_cpu_cores"`
+	UsageMemoryBytes   float64 `json:"usage_memory_bytes"`
+}
+
+func (r *Resources) add(other Resources) {
+	r.RequestCPUCores += other.RequestCPUCores
+	r.RequestMemoryBytes += other.RequestMemoryBytes
+	r.LimitCPUCores += other.LimitCPUCores
+	r.LimitMemoryBytes += other.LimitMemoryBytes
+	r.UsageCPUCores += other.UsageCPUCores
+	r.UsageMemoryBytes += other.UsageMemoryBytes
+}
+
+// ContainerResources are the resources of a single (init) container
+type ContainerResources struct {
+	Cluster   string            `json:"cluster"`
+	Namespace string            `json:"namespace"`
+	Pod       string            `json:"pod"`
+	Container string            `json:"container"`
+	Node      string            `json:"node"`
+	Qos       string            `json:"qos"`
+	Phase     string            `json:"phase"`
+	Init      bool              `json:"init"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Resources
+}
+
+// PodResources are the summed resources of a pod's containers (without init containers)
+type PodResources struct {
+	Cluster        string            `json:"cluster"`
+	Namespace      string            `json:"namespace"`
+	Pod            string            `json:"pod"`
+	Node           string            `json:"node"`
+	Qos            string            `json:"qos"`
+	Phase          string            `json:"phase"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	ContainerCount int               `json:"container_count"`
+	Resources
+}
+
+// NamespaceResources are the summed resources of a namespace's pods which are not terminated
+type NamespaceResources struct {
+	Cluster        string `json:"cluster"`
+	Namespace      string `json:"namespace"`
+	PodCount       int    `json:"pod_count"`
+	ContainerCount int    `json:"container_count"`
+	Resources
+}
+
+// NodeResources are the node's allocatable resources, the summed requests and limits of its pods which are not
+// terminated, and the node's total usage. Fields which are unknown (e. g. without permissions to list nodes) are nil.
+type NodeResources struct {
+	Cluster                string            `json:"cluster"`
+	Node                   string            `json:"node"`
+	Labels                 map[string]string `json:"labels,omitempty"`
+	PodCount               int               `json:"pod_count"`
+	ContainerCount         int               `json:"container_count"`
+	AllocatableCPUCores    *float64          `json:"allocatable_cpu_cores"`
+	AllocatableMemoryBytes *float64          `json:"allocatable_memory_bytes"`
+	RequestCPUCores        float64           `json:"request_cpu_cores"`
+	RequestMemoryBytes     float64           `json:"request_memory_bytes"`
+	LimitCPUCores          float64           `json:"limit_cpu_cores"`
+	LimitMemoryBytes       float64           `json:"limit_memory_bytes"`
+	UsageCPUCores          *float64          `json:"usage_cpu_cores"`
+	UsageMemoryBytes       *float64          `json:"usage_memory_bytes"`
+}
+
+// Report contains the resources of a cluster's nodes, namespaces, pods and containers
+type Report struct {
+	Cluster    string               `json:"cluster"`
+	FetchedAt  time.Time            `json:"fetched_at"`
+	Nodes      []NodeResources      `json:"nodes"`
+	Namespaces []NamespaceResources `json:"namespaces"`
+	Pods       []PodResources       `json:"pods"`
+	Containers []ContainerResources `json:"containers"`
+}
+
+// ReportFilter selects the clusters and pods a report is built from. Empty fields match everything.
+type ReportFilter struct {
+	Clusters      []string
+	Namespaces    []string
+	Nodes         []string
+	LabelSelector labels.Selector
+}
+
+func (f ReportFilter) matchesCluster(cluster string) bool {
+	return len(f.Clusters) == 0 || contains(f.Clusters, cluster)
+}
+
+func (f ReportFilter) matchesNode(node string) bool {
+	return len(f.Nodes) == 0 || contains(f.Nodes, node)
+}
+
+func (f ReportFilter) matchesPod(pod *corev1.Pod) bool {
+	if len(f.Namespaces) > 0 && !contains(f.Namespaces, pod.Namespace) {
+		return false
+	}
+	if !f.matchesNode(pod.Spec.NodeName) {
+		return false
+	}
+	return f.LabelSelector == nil || f.LabelSelector.Matches(labels.Set(pod.Labels))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports fetches a snapshot of each cluster matching the filter and builds its report. Errors of clusters whose
+// snapshot couldn't be fetched are returned by cluster name.
+func (k *KubeEagleCollector) Reports(ctx context.Context, filter ReportFilter) ([]*Report, map[string]error) {
+	mutex := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	var reports []*Report
+	errorsByCluster := make(map[string]error)
+	for _, client := range k.kubernetesClients {
+		if !filter.matchesCluster(client.Name()) {
+			continue
+		}
+		wg.Add(1)
+		go func(client *kubernetes.Client) {
+			defer wg.Done()
+			snapshot, err := client.Snapshot(ctx)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				errorsByCluster[client.Name()] = err
+				return
+			}
+			reports = append(reports, BuildReport(snapshot, filter))
+		}(client)
+	}
+	wg.Wait()
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Cluster < reports[j].Cluster
+	})
+	return reports, errorsByCluster
+}
+
+// BuildReport computes the resources of all pods, containers, namespaces and nodes of the given snapshot which match
+// the filter. Namespaces and nodes only contain the resources of matching pods.
+func BuildReport(snapshot *kubernetes.Snapshot, filter ReportFilter) *Report {
+	pods := &corev1.PodList{}
+	for _, pod := range snapshot.Pods.Items {
+		if filter.matchesPod(&pod) {
+			pods.Items = append(pods.Items, pod)
+		}
+	}
+
+	report := &Report{
+		Cluster:    snapshot.Cluster,
+		FetchedAt:  snapshot.FetchedAt,
+		Nodes:      []NodeResources{},
+		Namespaces: []NamespaceResources{},
+		Pods:       []PodResources{},
+		Containers: []ContainerResources{},
+	}
+
+	podIndexByKey := make(map[string]int)
+	namespaceIndexByName := make(map[string]int)
+	for _, cm := range buildEnrichedContainerMetricses(pods, snapshot.PodMetricses) {
+		resources := Resources{
+			RequestCPUCores:    cm.RequestCPUCores,
+			RequestMemoryBytes: cm.RequestMemoryBytes,
+			LimitCPUCores:      cm.LimitCPUCores,
+			LimitMemoryBytes:   cm.LimitMemoryBytes,
+			UsageCPUCores:      cm.UsageCPUCores,
+			UsageMemoryBytes:   cm.UsageMemoryBytes,
+		}
+		report.Containers = append(report.Containers, ContainerResources{
+			Cluster:   snapshot.Cluster,
+			Namespace: cm.Namespace,
+			Pod:       cm.Pod,
+			Container: cm.Container,
+			Node:      cm.Node,
+			Qos:       cm.Qos,
+			Phase:     cm.Phase,
+			Init:      cm.IsInitContainer,
+			Labels:    cm.PodLabels,
+			Resources: resources,
+		})
+
+		podKey := cm.Namespace + "/" + cm.Pod
+		podIndex, exists := podIndexByKey[podKey]
+		if !exists {
+			podIndex = len(report.Pods)
+			podIndexByKey[podKey] = podIndex
+			report.Pods = append(report.Pods, PodResources{
+				Cluster:   snapshot.Cluster,
+				Namespace: cm.Namespace,
+				Pod:       cm.Pod,
+				Node:      cm.Node,
+				Qos:       cm.Qos,
+				Phase:     cm.Phase,
+				Labels:    cm.PodLabels,
+			})
+		}
+		if cm.IsInitContainer {
+			continue
+		}
+		report.Pods[podIndex].ContainerCount++
+		report.Pods[podIndex].Resources.add(resources)
+	}
+
+	for _, pod := range report.Pods {
+		// skip not running pods (e. g. failed/succeeded jobs, evicted pods etc.)
+		if pod.Phase == string(corev1.PodFailed) || pod.Phase == string(corev1.PodSucceeded) {
+			continue
+		}
+		namespaceIndex, exists := namespaceIndexByName[pod.Namespace]
+		if !exists {
+			namespaceIndex = len(report.Namespaces)
+			namespaceIndexByName[pod.Namespace] = namespaceIndex
+			report.Namespaces = append(report.Namespaces, NamespaceResources{Cluster: snapshot.Cluster, Namespace: pod.Namespace})
+		}
+		namespace := &report.Namespaces[namespaceIndex]
+		namespace.PodCount++
+		namespace.ContainerCount += pod.ContainerCount
+		namespace.Resources.add(pod.Resources)
+	}
+
+	report.Nodes = buildNodeResources(snapshot, pods, filter)
+
+	sort.Slice(report.Containers, func(i, j int) bool {
+		a, b := report.Containers[i], report.Containers[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Container < b.Container
+	})
+	sort.Slice(report.Pods, func(i, j int) bool {
+		a, b := report.Pods[i], report.Pods[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Pod < b.Pod
+	})
+	sort.Slice(report.Namespaces, func(i, j int) bool {
+		return report.Namespaces[i].Namespace < report.Namespaces[j].Namespace
+	})
+
+	return report
+}
+
+// buildNodeResources computes the resources of all nodes matching the filter. Without permissions to list nodes, the
+// node names are taken from the scheduled pods.
+func buildNodeResources(snapshot *kubernetes.Snapshot, pods *corev1.PodList, filter ReportFilter) []NodeResources {
+	podMetricsByNodeName := getAggregatedPodMetricsByNodeName(pods)
+
+	nodesByName := make(map[string]corev1.Node)
+	if snapshot.Nodes != nil {
+		for _, node := range snapshot.Nodes.Items {
+			nodesByName[node.Name] = node
+		}
+	} else {
+		for nodeName := range podMetricsByNodeName {
+			if nodeName != "" {
+				nodesByName[nodeName] = corev1.Node{}
+			}
+		}
+	}
+
+	var nodeMetricsByNodeName map[string]nodeUsage
+	if snapshot.NodeMetricses != nil {
+		nodeMetricsByNodeName = make(map[string]nodeUsage)
+		for nodeName, metrics := range getNodeMetricsByNodeName(snapshot.NodeMetricses) {
+			nodeMetricsByNodeName[nodeName] = nodeUsage{
+				cpuCores:    quantityValue(metrics.Usage.Cpu()),
+				memoryBytes: quantityValue(metrics.Usage.Memory()),
+			}
+		}
+	}
+
+	nodes := []NodeResources{}
+	for nodeName, node := range nodesByName {
+		if !filter.matchesNode(nodeName) {
+			continue
+		}
+		podMetrics := podMetricsByNodeName[nodeName]
+		nodeResources := NodeResources{
+			Cluster:            snapshot.Cluster,
+			Node:               nodeName,
+			Labels:             node.Labels,
+			PodCount:           int(podMetrics.podCount),
+			ContainerCount:     int(podMetrics.containerCount),
+			RequestCPUCores:    podMetrics.requestedCPUCores,
+			RequestMemoryBytes: podMetrics.requestedMemoryBytes,
+			LimitCPUCores:      podMetrics.limitCPUCores,
+			LimitMemoryBytes:   podMetrics.limitMemoryBytes,
+		}
+		if snapshot.Nodes != nil {
+			allocatableCPUCores := quantityValue(node.Status.Allocatable.Cpu())
+			allocatableMemoryBytes := quantityValue(node.Status.Allocatable.Memory())
+			nodeResources.AllocatableCPUCores = &allocatableCPUCores
+			nodeResources.AllocatableMemoryBytes = &allocatableMemoryBytes
+		}
+		if nodeMetricsByNodeName != nil {
+			usage := nodeMetricsByNodeName[nodeName]
+			nodeResources.UsageCPUCores = &usage.cpuCores
+			nodeResources.UsageMemoryBytes = &usage.memoryBytes
+		}
+		nodes = append(nodes, nodeResources)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Node < nodes[j].Node
+	})
+	return nodes
+}
+
+type nodeUsage struct {
+	cpuCores    float64
+	memoryBytes float64
+}
@@ -0,0 +1,79 @@
+// Package namespacerequests is an example of a custom kube eagle collector, which is maintained outside of kube
+// eagle's collector package. It exposes the total resource requests of all running pods per namespace.
+//
+// Custom collectors are registered with a KubeEagleCollector before it's registered with a prometheus registry:
+//
+//	eagleCollector, err := collector.New(clients, opts)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	err = eagleCollector.RegisterCollector("namespace_requests", namespacerequests.New)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	prometheus.MustRegister(eagleCollector)
+package namespacerequests
+
+import (
+	"context"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+type namespaceRequestsCollector struct {
+	requestCPUCoresDesc    *prometheus.Desc
+	requestMemoryBytesDesc *prometheus.Desc
+}
+
+// New creates the namespace requests collector. It implements the collector.Factory signature.
+func New(opts *options.Options) (collector.Collector, error) {
+	subsystem := "namespace_resource"
+	labels := []string{"namespace", "cluster"}
+
+	return &namespaceRequestsCollector{
+		requestCPUCoresDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, subsystem, "requests_cpu_cores"),
+			"Total request of CPU cores of all running pods in a namespace",
+			labels,
+			prometheus.Labels{},
+		),
+		requestMemoryBytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(opts.Namespace, subsystem, "requests_memory_bytes"),
+			"Total request of RAM bytes of all running pods in a namespace",
+			labels,
+			prometheus.Labels{},
+		),
+	}, nil
+}
+
+// Describe implements the collector.Collector interface
+func (c *namespaceRequestsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.requestCPUCoresDesc
+	ch <- c.requestMemoryBytesDesc
+}
+
+// Update implements the collector.Collector interface
+func (c *namespaceRequestsCollector) Update(ctx context.Context, snapshot *kubernetes.Snapshot, ch chan<- prometheus.Metric) error {
+	requestCPUCoresByNamespace := make(map[string]float64)
+	requestMemoryBytesByNamespace := make(map[string]float64)
+	for _, pod := range snapshot.Pods.Items {
+		if pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			requestCPUCoresByNamespace[pod.Namespace] += float64(container.Resources.Requests.Cpu().MilliValue()) / 1000
+			requestMemoryBytesByNamespace[pod.Namespace] += float64(container.Resources.Requests.Memory().Value())
+		}
+	}
+
+	for namespace, requestCPUCores := range requestCPUCoresByNamespace {
+		ch <- prometheus.MustNewConstMetric(c.requestCPUCoresDesc, prometheus.GaugeValue, requestCPUCores, namespace, snapshot.Cluster)
+		ch <- prometheus.MustNewConstMetric(c.requestMemoryBytesDesc, prometheus.GaugeValue, requestMemoryBytesByNamespace[namespace], namespace, snapshot.Cluster)
+	}
+
+	return nil
+}
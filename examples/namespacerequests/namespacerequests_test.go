@@ -0,0 +1,82 @@
+package namespacerequests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/internal/kubetest"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestNamespaceRequests registers the example as documented in the package comment, so that it keeps compiling and
+// working against the collector API
+func TestNamespaceRequests(t *testing.T) {
+	server := kubetest.NewServer(kubetest.Fixture())
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "kube-eagle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = server.WriteKubeconfig(filepath.Join(dir, "fixture.yaml"), "fixture"); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := options.Load([]string{"--version", "test", "--kubeconfig-dir", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := kubernetes.NewClients(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eagleCollector, err := collector.New(clients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = eagleCollector.RegisterCollector("namespace_requests", New); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewPedanticRegistry()
+	if err = registry.Register(eagleCollector); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only running pods are summed up, thus default/pending-1 and default/job-1 are omitted
+	expected := map[string]map[string]float64{
+		"eagle_namespace_resource_requests_cpu_cores":    {"default": 1.1, "kube-system": 0.1},
+		"eagle_namespace_resource_requests_memory_bytes": {"default": 576 * 1024 * 1024, "kube-system": 70 * 1024 * 1024},
+	}
+	for _, family := range families {
+		expectedByNamespace, exists := expected[family.GetName()]
+		if !exists {
+			continue
+		}
+		delete(expected, family.GetName())
+		if len(family.Metric) != len(expectedByNamespace) {
+			t.Errorf("%s has %d series, expected %d", family.GetName(), len(family.Metric), len(expectedByNamespace))
+		}
+		for _, m := range family.Metric {
+			labels := make(map[string]string)
+			for _, label := range m.Label {
+				labels[label.GetName()] = label.GetValue()
+			}
+			value := expectedByNamespace[labels["namespace"]]
+			if labels["cluster"] != "fixture" || m.GetGauge().GetValue() != value {
+				t.Errorf("%s%v = %v, expected %v", family.GetName(), labels, m.GetGauge().GetValue(), value)
+			}
+		}
+	}
+	for name := range expected {
+		t.Errorf("%s isn't exposed", name)
+	}
+}
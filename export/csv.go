@@ -0,0 +1,52 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"time"
+)
+
+// writeCSV returns the table as CSV with a header row. Timestamps are formatted as RFC 3339, unknown values are empty.
+func writeCSV(t *table) ([]byte, error) {
+	rows := make([][]string, 0, len(t.rows)+1)
+	header := make([]string, len(t.columns))
+	for i, c := range t.columns {
+		header[i] = c.name
+	}
+	rows = append(rows, header)
+	for _, row := range t.rows {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i] = formatValue(value)
+		}
+		rows = append(rows, record)
+	}
+
+	buffer := &bytes.Buffer{}
+	err := csv.NewWriter(buffer).WriteAll(rows)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// formatValue formats a value of a table row, see columnKind
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case *float64:
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,64 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// directoryStorage stores the exported files in a local directory (e. g. a mounted volume)
+type directoryStorage struct {
+	directory string
+}
+
+func newDirectoryStorage(directory string) (*directoryStorage, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create export directory: '%v'", err)
+	}
+	return &directoryStorage{directory: directory}, nil
+}
+
+// Put writes the file to a temporary file first, so that consumers never read partially written files
+func (d *directoryStorage) Put(ctx context.Context, name string, content []byte) error {
+	file, err := ioutil.TempFile(d.directory, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(d.directory, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+func (d *directoryStorage) List(ctx context.Context) ([]string, error) {
+	files, err := ioutil.ReadDir(d.directory)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+func (d *directoryStorage) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(d.directory, name))
+}
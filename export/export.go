@@ -0,0 +1,189 @@
+// Package export periodically writes snapshots of the container and node resources to files, so that they can be
+// ingested into a data warehouse (e. g. for FinOps)
+package export
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// timestampLayout is the layout of the timestamps in the names of the exported files
+const timestampLayout = "20060102T150405Z"
+
+// fileNameRegexp matches the names of exported files, so that retention never deletes foreign files
+var fileNameRegexp = regexp.MustCompile(`^(containers|nodes)-(\d{8}T\d{6}Z)\.(csv|parquet)$`)
+
+// ReportsFunc returns the reports of all clusters matching the filter, see collector.KubeEagleCollector.Reports
+type ReportsFunc func(ctx context.Context, filter collector.ReportFilter) ([]*collector.Report, map[string]error)
+
+// storage stores the exported files in a flat namespace
+type storage interface {
+	// Put creates or replaces the file with the given name
+	Put(ctx context.Context, name string, content []byte) error
+	// List returns the names of all files
+	List(ctx context.Context) ([]string, error)
+	// Delete deletes the file with the given name
+	Delete(ctx context.Context, name string) error
+}
+
+// Exporter writes a snapshot of all clusters in a fixed interval. Each snapshot consists of one CSV or Parquet file
+// with the resources of all containers and one with the resources of all nodes, both named after the snapshot's time
+// and the format (e. g. containers-20200102T150405Z.csv).
+type Exporter struct {
+	storage   storage
+	format    string
+	interval  time.Duration
+	retention time.Duration
+	reports   ReportsFunc
+	isLeader  func() bool
+
+	lastSuccessTimestamp prometheus.Gauge
+	failures             prometheus.Counter
+}
+
+// New creates an exporter writing to the configured directory or S3-compatible object storage. isLeader may be nil
+// if no leader is elected, otherwise only the leader exports snapshots.
+func New(opts *options.Options, reports ReportsFunc, isLeader func() bool) (*Exporter, error) {
+	var s storage
+	var err error
+	if opts.ExportS3Endpoint != "" {
+		s, err = newS3Storage(opts)
+	} else {
+		s, err = newDirectoryStorage(opts.ExportDirectory)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Exporter{
+		storage:   s,
+		format:    opts.ExportFormat,
+		interval:  opts.ExportInterval,
+		retention: opts.ExportRetention,
+		reports:   reports,
+		isLeader:  isLeader,
+		lastSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "export",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Kube Eagle: Timestamp of the last successfully exported snapshot.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "export",
+			Name:      "failures_total",
+			Help:      "Kube Eagle: Number of snapshots which couldn't be exported.",
+		}),
+	}
+	prometheus.MustRegister(e.lastSuccessTimestamp, e.failures)
+
+	return e, nil
+}
+
+// Run exports a snapshot in every interval until the context is cancelled
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if e.isLeader != nil && !e.isLeader() {
+				log.Debug("Skipping export, as this replica is not the leader")
+				continue
+			}
+			// An export must not overlap with the next one
+			exportCtx, cancel := context.WithTimeout(ctx, e.interval)
+			err := e.export(exportCtx, now.UTC())
+			if err != nil {
+				log.Errorf("Failed to export snapshot: %v", err)
+				e.failures.Inc()
+			} else {
+				e.lastSuccessTimestamp.Set(float64(now.Unix()))
+			}
+			if e.retention > 0 {
+				err = e.deleteExpired(exportCtx, now.UTC())
+				if err != nil {
+					log.Warnf("Failed to delete expired snapshots: %v", err)
+				}
+			}
+			cancel()
+		}
+	}
+}
+
+// export writes the snapshot of all clusters whose resources could be fetched. It only fails if no cluster could be
+// fetched or the files couldn't be written.
+func (e *Exporter) export(ctx context.Context, now time.Time) error {
+	reports, errorsByCluster := e.reports(ctx, collector.ReportFilter{})
+	clusters := make([]string, 0, len(errorsByCluster))
+	for cluster := range errorsByCluster {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		log.Warnf("Failed to fetch resources of cluster '%s' for export: %v", cluster, errorsByCluster[cluster])
+	}
+	if len(reports) == 0 {
+		return fmt.Errorf("couldn't fetch the resources of any cluster")
+	}
+
+	write := writeCSV
+	if e.format == options.ExportFormatParquet {
+		write = writeParquet
+	}
+	timestamp := now.Format(timestampLayout)
+	files := []struct {
+		prefix string
+		table  *table
+	}{
+		{prefix: "containers", table: containersTable(reports, now)},
+		{prefix: "nodes", table: nodesTable(reports, now)},
+	}
+	for _, file := range files {
+		content, err := write(file.table)
+		if err != nil {
+			return err
+		}
+		err = e.storage.Put(ctx, fmt.Sprintf("%s-%s.%s", file.prefix, timestamp, e.format), content)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Debugf("Exported snapshot %s", timestamp)
+	return nil
+}
+
+// deleteExpired deletes all exported files which are older than the retention
+func (e *Exporter) deleteExpired(ctx context.Context, now time.Time) error {
+	names, err := e.storage.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		match := fileNameRegexp.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		timestamp, err := time.Parse(timestampLayout, match[2])
+		if err != nil || now.Sub(timestamp) <= e.retention {
+			continue
+		}
+		err = e.storage.Delete(ctx, name)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Deleted expired snapshot file '%s'", name)
+	}
+	return nil
+}
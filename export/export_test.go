@@ -0,0 +1,167 @@
+package export
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/internal/kubetest"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	corev1 "k8s.io/api/core/v1"
+	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+// tempDir creates a temporary directory, which is removed when the test finishes
+func tempDir(t *testing.T) string {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(directory)
+	})
+	return directory
+}
+
+// fixtureReports returns the report of the fixture cluster a and fails for the cluster broken
+func fixtureReports(ctx context.Context, filter collector.ReportFilter) ([]*collector.Report, map[string]error) {
+	objects := kubetest.Fixture()
+	snapshot := &kubernetes.Snapshot{
+		Cluster:       "a",
+		Pods:          &corev1.PodList{Items: objects.Pods},
+		PodMetricses:  &v1beta1.PodMetricsList{Items: objects.PodMetricses},
+		Nodes:         &corev1.NodeList{Items: objects.Nodes},
+		NodeMetricses: &v1beta1.NodeMetricsList{Items: objects.NodeMetricses},
+	}
+	return []*collector.Report{collector.BuildReport(snapshot, filter)}, map[string]error{"broken": fmt.Errorf("connection refused")}
+}
+
+// listFiles returns the names of all files in the storage, sorted
+func listFiles(t *testing.T, s storage) []string {
+	t.Helper()
+	names, err := s.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestExport(t *testing.T) {
+	directory := tempDir(t)
+	s, err := newDirectoryStorage(filepath.Join(directory, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Exporter{storage: s, format: options.ExportFormatCSV, reports: fixtureReports}
+	if err = e.export(context.Background(), time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Temporary files are neither left behind nor listed
+	expected := []string{"containers-20200102T150405Z.csv", "nodes-20200102T150405Z.csv"}
+	if names := listFiles(t, s); !reflect.DeepEqual(names, expected) {
+		t.Errorf("exported %v, expected %v", names, expected)
+	}
+
+	nodes, err := ioutil.ReadFile(filepath.Join(directory, "snapshots", "nodes-20200102T150405Z.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedNodes := "timestamp,cluster,node,pod_count,container_count,allocatable_cpu_cores,request_cpu_cores,limit_cpu_cores,usage_cpu_cores,allocatable_memory_bytes,request_memory_bytes,limit_memory_bytes,usage_memory_bytes\n" +
+		"2020-01-02T15:04:05Z,a,node-a,1,2,3.92,0.6,1,1,16106127360,335544320,536870912,4294967296\n" +
+		"2020-01-02T15:04:05Z,a,node-b,2,2,2,0.6,1,0.5,7516192768,341835776,715128832,2147483648\n"
+	if string(nodes) != expectedNodes {
+		t.Errorf("nodes CSV = %q, expected %q", nodes, expectedNodes)
+	}
+
+	// Terminated pods and pods without usage are exported as well
+	containers, err := ioutil.ReadFile(filepath.Join(directory, "snapshots", "containers-20200102T150405Z.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"2020-01-02T15:04:05Z,a,default,job-1,job,node-a,Burstable,Succeeded,false,0.2,0,0,134217728,0,0\n",
+		"2020-01-02T15:04:05Z,a,default,web-1,sidecar,node-a,Burstable,Running,false,0.1,0,0.05,67108864,0,31457280\n",
+		"2020-01-02T15:04:05Z,a,default,pending-1,app,,Burstable,Pending,false,0.5,1,0,268435456,536870912,0\n",
+	} {
+		if !strings.Contains(string(containers), expected) {
+			t.Errorf("containers CSV lacks the row %q:\n%s", expected, containers)
+		}
+	}
+
+	failing := &Exporter{storage: s, format: options.ExportFormatCSV, reports: func(ctx context.Context, filter collector.ReportFilter) ([]*collector.Report, map[string]error) {
+		return nil, map[string]error{"broken": fmt.Errorf("connection refused")}
+	}}
+	if err = failing.export(context.Background(), time.Now()); err == nil {
+		t.Errorf("export without any cluster succeeded, expected an error")
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	now := time.Date(2020, 1, 8, 0, 0, 0, 0, time.UTC)
+	files := []string{
+		"containers-20200101T000000Z.csv",
+		"nodes-20200101T000000Z.csv",
+		"nodes-20200101T000001Z.csv",
+		"containers-20200107T120000Z.csv",
+		"nodes-20200107T120000Z.csv",
+		// Files of both formats are deleted
+		"containers-20200101T000000Z.parquet",
+		"nodes-20200107T120000Z.parquet",
+		// Foreign files are never deleted, however old they are
+		"pods-20200101T000000Z.csv",
+		"containers-20200101T000000Z.csv.bak",
+		"containers-2020-01-01.csv",
+		"README",
+	}
+	expected := []string{
+		"README",
+		"containers-2020-01-01.csv",
+		"containers-20200101T000000Z.csv.bak",
+		"containers-20200107T120000Z.csv",
+		"nodes-20200101T000001Z.csv",
+		"nodes-20200107T120000Z.csv",
+		"nodes-20200107T120000Z.parquet",
+		"pods-20200101T000000Z.csv",
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		s, err := newDirectoryStorage(tempDir(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testDeleteExpired(t, s, files, now, expected)
+	})
+	t.Run("s3", func(t *testing.T) {
+		server := newFakeS3(t, "finops", 3)
+		testDeleteExpired(t, newTestS3Storage(t, server, "finops", "eagle/", exampleSecretAccessKey), files, now, expected)
+	})
+}
+
+// testDeleteExpired puts the files into the storage, deletes the files older than 7 days and compares the remaining
+// files. Files which are exactly as old as the retention are kept.
+func testDeleteExpired(t *testing.T, s storage, files []string, now time.Time, expected []string) {
+	for _, name := range files {
+		if err := s.Put(context.Background(), name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := &Exporter{storage: s, retention: 7*24*time.Hour - time.Second}
+	if err := e.deleteExpired(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if names := listFiles(t, s); !reflect.DeepEqual(names, expected) {
+		t.Errorf("remaining files = %v, expected %v", names, expected)
+	}
+}
@@ -0,0 +1,282 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// parquetMagic starts and ends every Parquet file
+const parquetMagic = "PAR1"
+
+// Values of the Parquet format's Thrift enums, see https://github.com/apache/parquet-format/blob/master/src/main/thrift/parquet.thrift
+const (
+	parquetTypeBoolean   int32 = 0
+	parquetTypeInt64     int32 = 2
+	parquetTypeDouble    int32 = 5
+	parquetTypeByteArray int32 = 6
+
+	parquetRequired int32 = 0
+	parquetOptional int32 = 1
+
+	parquetConvertedUTF8            int32 = 0
+	parquetConvertedTimestampMillis int32 = 9
+
+	parquetEncodingPlain int32 = 0
+	parquetEncodingRLE   int32 = 3
+
+	parquetCodecUncompressed int32 = 0
+	parquetPageTypeData      int32 = 0
+)
+
+// writeParquet returns the table as Parquet file with a single row group and one uncompressed, PLAIN encoded data page
+// per column. Strings are UTF8 annotated byte arrays, timestamps are TIMESTAMP_MILLIS annotated int64 and floats are
+// doubles. Optional columns store unknown values as nulls.
+func writeParquet(t *table) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(parquetMagic)
+
+	schema := thriftList{thriftStruct{
+		{id: 4, value: "schema"},
+		{id: 5, value: int32(len(t.columns))},
+	}}
+	chunks := make(thriftList, 0, len(t.columns))
+	totalSize := int64(0)
+	for i, c := range t.columns {
+		page, err := parquetPage(t, i)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode column '%s': %v", c.name, err)
+		}
+		header := thriftEncode(thriftStruct{
+			{id: 1, value: parquetPageTypeData},
+			{id: 2, value: int32(len(page))},
+			{id: 3, value: int32(len(page))},
+			{id: 5, value: thriftStruct{
+				{id: 1, value: int32(len(t.rows))},
+				{id: 2, value: parquetEncodingPlain},
+				{id: 3, value: parquetEncodingRLE},
+				{id: 4, value: parquetEncodingRLE},
+			}},
+		})
+		offset := int64(buffer.Len())
+		size := int64(len(header) + len(page))
+		buffer.Write(header)
+		buffer.Write(page)
+		totalSize += size
+
+		physicalType, convertedType := parquetTypes(c.kind)
+		repetition := parquetRequired
+		if c.optional {
+			repetition = parquetOptional
+		}
+		element := thriftStruct{
+			{id: 1, value: physicalType},
+			{id: 3, value: repetition},
+			{id: 4, value: c.name},
+		}
+		if convertedType >= 0 {
+			element = append(element, thriftField{id: 6, value: convertedType})
+		}
+		schema = append(schema, element)
+
+		chunks = append(chunks, thriftStruct{
+			{id: 2, value: offset},
+			{id: 3, value: thriftStruct{
+				{id: 1, value: physicalType},
+				{id: 2, value: thriftList{parquetEncodingPlain, parquetEncodingRLE}},
+				{id: 3, value: thriftList{c.name}},
+				{id: 4, value: parquetCodecUncompressed},
+				{id: 5, value: int64(len(t.rows))},
+				{id: 6, value: size},
+				{id: 7, value: size},
+				{id: 9, value: offset},
+			}},
+		})
+	}
+
+	footer := thriftEncode(thriftStruct{
+		{id: 1, value: int32(1)},
+		{id: 2, value: schema},
+		{id: 3, value: int64(len(t.rows))},
+		{id: 4, value: thriftList{thriftStruct{
+			{id: 1, value: chunks},
+			{id: 2, value: totalSize},
+			{id: 3, value: int64(len(t.rows))},
+		}}},
+		{id: 6, value: "kube-eagle"},
+	})
+	buffer.Write(footer)
+	_ = binary.Write(buffer, binary.LittleEndian, uint32(len(footer)))
+	buffer.WriteString(parquetMagic)
+	return buffer.Bytes(), nil
+}
+
+// parquetTypes returns the physical and the converted type (-1 if none) of a column kind
+func parquetTypes(kind columnKind) (int32, int32) {
+	switch kind {
+	case kindString:
+		return parquetTypeByteArray, parquetConvertedUTF8
+	case kindTimestamp:
+		return parquetTypeInt64, parquetConvertedTimestampMillis
+	case kindBool:
+		return parquetTypeBoolean, -1
+	case kindInt:
+		return parquetTypeInt64, -1
+	}
+	return parquetTypeDouble, -1
+}
+
+// parquetPage returns the data page of the column with the given index, i. e. the definition levels of optional
+// columns followed by the PLAIN encoded values which are not null
+func parquetPage(t *table, index int) ([]byte, error) {
+	c := t.columns[index]
+	page := &bytes.Buffer{}
+	if c.optional {
+		levels := make([]bool, len(t.rows))
+		for i, row := range t.rows {
+			levels[i] = row[index].(*float64) != nil
+		}
+		encoded := rleBooleans(levels)
+		_ = binary.Write(page, binary.LittleEndian, uint32(len(encoded)))
+		page.Write(encoded)
+	}
+
+	var bits []bool
+	for _, row := range t.rows {
+		switch v := row[index].(type) {
+		case string:
+			_ = binary.Write(page, binary.LittleEndian, uint32(len(v)))
+			page.WriteString(v)
+		case time.Time:
+			_ = binary.Write(page, binary.LittleEndian, v.UnixNano()/int64(time.Millisecond))
+		case bool:
+			bits = append(bits, v)
+		case int64:
+			_ = binary.Write(page, binary.LittleEndian, v)
+		case *float64:
+			if v == nil {
+				if !c.optional {
+					return nil, fmt.Errorf("unknown value in required column")
+				}
+				continue
+			}
+			_ = binary.Write(page, binary.LittleEndian, math.Float64bits(*v))
+		default:
+			return nil, fmt.Errorf("unsupported value type %T", v)
+		}
+	}
+	if c.kind == kindBool {
+		packed := make([]byte, (len(bits)+7)/8)
+		for i, bit := range bits {
+			if bit {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		page.Write(packed)
+	}
+	return page.Bytes(), nil
+}
+
+// rleBooleans encodes values with bit width 1 in the RLE runs of Parquet's RLE/bit-packing hybrid encoding
+func rleBooleans(values []bool) []byte {
+	buffer := &bytes.Buffer{}
+	varint := make([]byte, binary.MaxVarintLen64)
+	for start := 0; start < len(values); {
+		end := start + 1
+		for end < len(values) && values[end] == values[start] {
+			end++
+		}
+		buffer.Write(varint[:binary.PutUvarint(varint, uint64(end-start)<<1)])
+		if values[start] {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+		start = end
+	}
+	return buffer.Bytes()
+}
+
+// Types of the Thrift compact protocol, see https://github.com/apache/thrift/blob/master/doc/specs/thrift-compact-protocol.md
+const (
+	thriftTypeI32    byte = 5
+	thriftTypeI64    byte = 6
+	thriftTypeBinary byte = 8
+	thriftTypeList   byte = 9
+	thriftTypeStruct byte = 12
+)
+
+// thriftField is a field of a Thrift struct. Its value is an int32, int64, string, thriftList or thriftStruct.
+type thriftField struct {
+	id    int16
+	value interface{}
+}
+
+// thriftStruct is a Thrift struct whose fields are ordered by their id
+type thriftStruct []thriftField
+
+// thriftList is a non-empty Thrift list whose elements are all of the same type
+type thriftList []interface{}
+
+// thriftEncode returns the struct serialized with the Thrift compact protocol
+func thriftEncode(s thriftStruct) []byte {
+	buffer := &bytes.Buffer{}
+	writeThriftValue(buffer, s)
+	return buffer.Bytes()
+}
+
+// thriftType returns the compact protocol type of a value
+func thriftType(value interface{}) byte {
+	switch value.(type) {
+	case int32:
+		return thriftTypeI32
+	case int64:
+		return thriftTypeI64
+	case string:
+		return thriftTypeBinary
+	case thriftList:
+		return thriftTypeList
+	}
+	return thriftTypeStruct
+}
+
+// writeThriftValue writes a value with the Thrift compact protocol
+func writeThriftValue(buffer *bytes.Buffer, value interface{}) {
+	varint := make([]byte, binary.MaxVarintLen64)
+	switch v := value.(type) {
+	case int32:
+		buffer.Write(varint[:binary.PutVarint(varint, int64(v))])
+	case int64:
+		buffer.Write(varint[:binary.PutVarint(varint, v)])
+	case string:
+		buffer.Write(varint[:binary.PutUvarint(varint, uint64(len(v)))])
+		buffer.WriteString(v)
+	case thriftList:
+		elementType := thriftType(v[0])
+		if len(v) < 15 {
+			buffer.WriteByte(byte(len(v))<<4 | elementType)
+		} else {
+			buffer.WriteByte(0xf0 | elementType)
+			buffer.Write(varint[:binary.PutUvarint(varint, uint64(len(v)))])
+		}
+		for _, element := range v {
+			writeThriftValue(buffer, element)
+		}
+	case thriftStruct:
+		lastID := int16(0)
+		for _, field := range v {
+			delta := field.id - lastID
+			if delta > 0 && delta <= 15 {
+				buffer.WriteByte(byte(delta)<<4 | thriftType(field.value))
+			} else {
+				buffer.WriteByte(thriftType(field.value))
+				buffer.Write(varint[:binary.PutVarint(varint, int64(field.id))])
+			}
+			writeThriftValue(buffer, field.value)
+			lastID = field.id
+		}
+		buffer.WriteByte(0)
+	}
+}
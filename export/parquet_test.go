@@ -0,0 +1,295 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/options"
+)
+
+// thriftReader decodes the Thrift compact protocol into int64, bool, string, []interface{} and map[int16]interface{}
+type thriftReader struct {
+	t    *testing.T
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) varint() int64 {
+	value, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		r.t.Fatalf("invalid varint at %d", r.pos)
+	}
+	r.pos += n
+	return value
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	value, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.t.Fatalf("invalid varint at %d", r.pos)
+	}
+	r.pos += n
+	return value
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 5, 6:
+		return r.varint()
+	case 8:
+		length := int(r.uvarint())
+		value := string(r.data[r.pos : r.pos+length])
+		r.pos += length
+		return value
+	case 9:
+		header := r.data[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case 12:
+		s := make(map[int16]interface{})
+		id := int16(0)
+		for {
+			header := r.data[r.pos]
+			r.pos++
+			if header == 0 {
+				return s
+			}
+			if header>>4 == 0 {
+				id = int16(r.varint())
+			} else {
+				id += int16(header >> 4)
+			}
+			switch header & 0x0f {
+			case 1:
+				s[id] = true
+			case 2:
+				s[id] = false
+			default:
+				s[id] = r.value(header & 0x0f)
+			}
+		}
+	}
+	r.t.Fatalf("unsupported Thrift type %d at %d", typ, r.pos)
+	return nil
+}
+
+// readParquet decodes a Parquet file written by writeParquet into a header and rows of values formatted like CSV,
+// along with the names of the optional columns
+func readParquet(t *testing.T, data []byte) ([][]string, []string) {
+	t.Helper()
+	if len(data) < 12 || string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		t.Fatalf("the file doesn't start and end with %s", parquetMagic)
+	}
+	footerLength := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := &thriftReader{t: t, data: data[:len(data)-8], pos: len(data) - 8 - footerLength}
+	metadata := footer.value(12).(map[int16]interface{})
+	numRows := int(metadata[3].(int64))
+	schema := metadata[2].([]interface{})
+	if root := schema[0].(map[int16]interface{}); int(root[5].(int64)) != len(schema)-1 {
+		t.Fatalf("root schema element has %v children, expected %d", root[5], len(schema)-1)
+	}
+	rowGroups := metadata[4].([]interface{})
+	if len(rowGroups) != 1 {
+		t.Fatalf("file has %d row groups, expected 1", len(rowGroups))
+	}
+	chunks := rowGroups[0].(map[int16]interface{})[1].([]interface{})
+
+	rows := make([][]string, numRows+1)
+	var optional []string
+	for i, element := range schema[1:] {
+		element := element.(map[int16]interface{})
+		name := element[4].(string)
+		rows[0] = append(rows[0], name)
+		if element[3].(int64) == int64(parquetOptional) {
+			optional = append(optional, name)
+		}
+
+		meta := chunks[i].(map[int16]interface{})[3].(map[int16]interface{})
+		if path := meta[3].([]interface{}); len(path) != 1 || path[0] != name {
+			t.Errorf("column %d has the path %v, expected [%s]", i, path, name)
+		}
+		reader := &thriftReader{t: t, data: data, pos: int(meta[9].(int64))}
+		header := reader.value(12).(map[int16]interface{})
+		if header[1].(int64) != 0 || header[5].(map[int16]interface{})[1].(int64) != int64(numRows) {
+			t.Fatalf("column '%s' doesn't have a data page with %d values", name, numRows)
+		}
+		page := bytes.NewReader(data[reader.pos : reader.pos+int(header[3].(int64))])
+
+		defined := make([]bool, numRows)
+		for row := range defined {
+			defined[row] = true
+		}
+		if element[3].(int64) == int64(parquetOptional) {
+			var length uint32
+			_ = binary.Read(page, binary.LittleEndian, &length)
+			levels := make([]byte, length)
+			_, _ = page.Read(levels)
+			levelReader := &thriftReader{t: t, data: levels}
+			for row := 0; row < numRows; {
+				run := levelReader.uvarint()
+				if run&1 != 0 {
+					t.Fatalf("column '%s' has bit-packed definition levels", name)
+				}
+				value := levelReader.data[levelReader.pos]
+				levelReader.pos++
+				for j := 0; j < int(run>>1); j++ {
+					defined[row] = value == 1
+					row++
+				}
+			}
+		}
+
+		var packed []byte
+		if element[1].(int64) == int64(parquetTypeBoolean) {
+			packed = make([]byte, (numRows+7)/8)
+			_, _ = page.Read(packed)
+		}
+		for row := 0; row < numRows; row++ {
+			if !defined[row] {
+				rows[row+1] = append(rows[row+1], "")
+				continue
+			}
+			var value string
+			switch element[1].(int64) {
+			case int64(parquetTypeBoolean):
+				value = strconv.FormatBool(packed[row/8]&(1<<uint(row%8)) != 0)
+			case int64(parquetTypeInt64):
+				var v int64
+				_ = binary.Read(page, binary.LittleEndian, &v)
+				value = strconv.FormatInt(v, 10)
+				if converted, exists := element[6]; exists && converted.(int64) == int64(parquetConvertedTimestampMillis) {
+					value = time.Unix(0, v*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+				}
+			case int64(parquetTypeDouble):
+				var bits uint64
+				_ = binary.Read(page, binary.LittleEndian, &bits)
+				value = strconv.FormatFloat(math.Float64frombits(bits), 'f', -1, 64)
+			case int64(parquetTypeByteArray):
+				var length uint32
+				_ = binary.Read(page, binary.LittleEndian, &length)
+				b := make([]byte, length)
+				_, _ = page.Read(b)
+				value = string(b)
+			}
+			rows[row+1] = append(rows[row+1], value)
+		}
+		if page.Len() != 0 {
+			t.Errorf("column '%s' has %d bytes left after decoding", name, page.Len())
+		}
+	}
+	return rows, optional
+}
+
+// readCSV parses the table written as CSV
+func readCSV(t *testing.T, tab *table) [][]string {
+	t.Helper()
+	content, err := writeCSV(tab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestWriteParquet(t *testing.T) {
+	cpu, memory := 0.5, float64(2*1024*1024*1024)
+	tab := &table{columns: []column{
+		{name: "timestamp", kind: kindTimestamp},
+		{name: "node", kind: kindString},
+		{name: "ready", kind: kindBool},
+		{name: "pod_count", kind: kindInt},
+		{name: "usage_cpu_cores", kind: kindFloat, optional: true},
+		{name: "usage_memory_bytes", kind: kindFloat, optional: true},
+	}}
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	// More than 8 rows, so that booleans span several bytes
+	for i := 0; i < 10; i++ {
+		row := []interface{}{now, "node-" + strconv.Itoa(i), i%3 == 0, int64(i), &cpu, &memory}
+		if i >= 4 && i < 7 {
+			row[4] = (*float64)(nil)
+		}
+		if i == 9 {
+			row[5] = (*float64)(nil)
+		}
+		tab.rows = append(tab.rows, row)
+	}
+
+	content, err := writeParquet(tab)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, optional := readParquet(t, content)
+	if expected := readCSV(t, tab); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Parquet rows = %v, expected %v", rows, expected)
+	}
+	if expected := []string{"usage_cpu_cores", "usage_memory_bytes"}; !reflect.DeepEqual(optional, expected) {
+		t.Errorf("optional columns = %v, expected %v", optional, expected)
+	}
+
+	empty := &table{columns: tab.columns}
+	content, err = writeParquet(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows, _ = readParquet(t, content); len(rows) != 1 {
+		t.Errorf("empty table has %d rows, expected only the header", len(rows)-1)
+	}
+
+	required := &table{columns: []column{{name: "request_cpu_cores", kind: kindFloat}}, rows: [][]interface{}{{(*float64)(nil)}}}
+	if _, err = writeParquet(required); err == nil {
+		t.Errorf("unknown value in a required column was written, expected an error")
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	directory := tempDir(t)
+	s, err := newDirectoryStorage(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Exporter{storage: s, format: options.ExportFormatParquet, reports: fixtureReports}
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	if err = e.export(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"containers-20200102T150405Z.parquet", "nodes-20200102T150405Z.parquet"}
+	if names := listFiles(t, s); !reflect.DeepEqual(names, expected) {
+		t.Errorf("exported %v, expected %v", names, expected)
+	}
+
+	// The Parquet files contain the same values as the CSV files
+	reports, _ := fixtureReports(context.Background(), collector.ReportFilter{})
+	for name, tab := range map[string]*table{
+		"containers-20200102T150405Z.parquet": containersTable(reports, now),
+		"nodes-20200102T150405Z.parquet":      nodesTable(reports, now),
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(directory, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows, _ := readParquet(t, content); !reflect.DeepEqual(rows, readCSV(t, tab)) {
+			t.Errorf("%s contains %v, expected %v", name, rows, readCSV(t, tab))
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/options"
+)
+
+// s3Storage stores the exported files as objects in an S3-compatible object storage (e. g. AWS S3 or MinIO). Objects
+// are addressed path-style (<endpoint>/<bucket>/<key>) and requests are signed with AWS signature version 4.
+type s3Storage struct {
+	endpoint            *url.URL
+	bucket              string
+	prefix              string
+	region              string
+	accessKeyID         string
+	secretAccessKeyFile string
+	client              *http.Client
+}
+
+// listBucketResult is the response of a ListObjectsV2 request
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// s3Error is the body of failed requests
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func newS3Storage(opts *options.Options) (*s3Storage, error) {
+	endpoint, err := url.Parse(opts.ExportS3Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse S3 endpoint: '%v'", err)
+	}
+	return &s3Storage{
+		endpoint:            endpoint,
+		bucket:              opts.ExportS3Bucket,
+		prefix:              opts.ExportS3Prefix,
+		region:              opts.ExportS3Region,
+		accessKeyID:         opts.ExportS3AccessKeyID,
+		secretAccessKeyFile: opts.ExportS3SecretAccessKeyFile,
+		client:              &http.Client{},
+	}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, content []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", "text/csv")
+	_, err := s.do(ctx, http.MethodPut, s.prefix+name, nil, header, content)
+	return err
+}
+
+// List returns the names of all objects below the prefix, following the pagination of ListObjectsV2
+func (s *s3Storage) List(ctx context.Context) ([]string, error) {
+	var names []string
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		body, err := s.do(ctx, http.MethodGet, "", query, http.Header{}, nil)
+		if err != nil {
+			return nil, err
+		}
+		result := listBucketResult{}
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse list of objects: '%v'", err)
+		}
+		for _, object := range result.Contents {
+			names = append(names, strings.TrimPrefix(object.Key, s.prefix))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	_, err := s.do(ctx, http.MethodDelete, s.prefix+name, nil, http.Header{}, nil)
+	return err
+}
+
+// do sends a signed request for the given object key (or the bucket if the key is empty) and returns the response body
+func (s *s3Storage) do(ctx context.Context, method string, key string, query url.Values, header http.Header, content []byte) ([]byte, error) {
+	secretAccessKey, err := ioutil.ReadFile(s.secretAccessKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read S3 secret access key: '%v'", err)
+	}
+
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signV4(req, content, s.accessKeyID, strings.TrimSpace(string(secretAccessKey)), s.region, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		s3Err := s3Error{}
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("%s %s failed with status %d: %s: %s", method, u.Path, res.StatusCode, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("%s %s failed with status %d", method, u.Path, res.StatusCode)
+	}
+	return body, nil
+}
+
+// signV4 signs the request with AWS signature version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html. All headers which are already set
+// are signed, as well as the host.
+func signV4(req *http.Request, content []byte, accessKeyID string, secretAccessKey string, region string, now time.Time) {
+	const service = "s3"
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(content)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes the query with sorted keys and RFC 3986 escaping, as required by signature version 4
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, escape(key, true)+"="+escape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escapePath escapes every character of the path except unreserved characters and slashes
+func escapePath(path string) string {
+	return escape(path, false)
+}
+
+// escape escapes all characters except the unreserved characters of RFC 3986 (and slashes unless escapeSlash is set)
+func escape(s string, escapeSlash bool) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
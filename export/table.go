@@ -0,0 +1,101 @@
+package export
+
+import (
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+)
+
+// columnKind is the type of the values of a column
+type columnKind int
+
+// Kinds of columns, along with the type of their values in table rows
+const (
+	// kindString values are strings
+	kindString columnKind = iota
+	// kindTimestamp values are time.Time
+	kindTimestamp
+	// kindBool values are bools
+	kindBool
+	// kindInt values are int64
+	kindInt
+	// kindFloat values are *float64, nil if they are unknown
+	kindFloat
+)
+
+// column describes a column of an exported table. Only float columns may be optional, i. e. contain unknown values.
+type column struct {
+	name     string
+	kind     columnKind
+	optional bool
+}
+
+// table is a snapshot's table, which is written in the configured format
+type table struct {
+	columns []column
+	rows    [][]interface{}
+}
+
+// containersTable returns the resources of all containers, including init containers and containers of terminated
+// pods, which can be told apart by the init and phase columns
+func containersTable(reports []*collector.Report, now time.Time) *table {
+	t := &table{columns: []column{
+		{name: "timestamp", kind: kindTimestamp},
+		{name: "cluster", kind: kindString},
+		{name: "namespace", kind: kindString},
+		{name: "pod", kind: kindString},
+		{name: "container", kind: kindString},
+		{name: "node", kind: kindString},
+		{name: "qos", kind: kindString},
+		{name: "phase", kind: kindString},
+		{name: "init", kind: kindBool},
+		{name: "request_cpu_cores", kind: kindFloat},
+		{name: "limit_cpu_cores", kind: kindFloat},
+		{name: "usage_cpu_cores", kind: kindFloat},
+		{name: "request_memory_bytes", kind: kindFloat},
+		{name: "limit_memory_bytes", kind: kindFloat},
+		{name: "usage_memory_bytes", kind: kindFloat},
+	}}
+	for _, report := range reports {
+		for _, c := range report.Containers {
+			c := c
+			t.rows = append(t.rows, []interface{}{
+				now, report.Cluster, c.Namespace, c.Pod, c.Container, c.Node, c.Qos, c.Phase, c.Init,
+				&c.RequestCPUCores, &c.LimitCPUCores, &c.UsageCPUCores,
+				&c.RequestMemoryBytes, &c.LimitMemoryBytes, &c.UsageMemoryBytes,
+			})
+		}
+	}
+	return t
+}
+
+// nodesTable returns the allocatable resources, the summed requests and limits and the usage of all nodes. Unknown
+// values (e. g. without permissions to list nodes) are nil.
+func nodesTable(reports []*collector.Report, now time.Time) *table {
+	t := &table{columns: []column{
+		{name: "timestamp", kind: kindTimestamp},
+		{name: "cluster", kind: kindString},
+		{name: "node", kind: kindString},
+		{name: "pod_count", kind: kindInt},
+		{name: "container_count", kind: kindInt},
+		{name: "allocatable_cpu_cores", kind: kindFloat, optional: true},
+		{name: "request_cpu_cores", kind: kindFloat},
+		{name: "limit_cpu_cores", kind: kindFloat},
+		{name: "usage_cpu_cores", kind: kindFloat, optional: true},
+		{name: "allocatable_memory_bytes", kind: kindFloat, optional: true},
+		{name: "request_memory_bytes", kind: kindFloat},
+		{name: "limit_memory_bytes", kind: kindFloat},
+		{name: "usage_memory_bytes", kind: kindFloat, optional: true},
+	}}
+	for _, report := range reports {
+		for _, n := range report.Nodes {
+			n := n
+			t.rows = append(t.rows, []interface{}{
+				now, report.Cluster, n.Node, int64(n.PodCount), int64(n.ContainerCount),
+				n.AllocatableCPUCores, &n.RequestCPUCores, &n.LimitCPUCores, n.UsageCPUCores,
+				n.AllocatableMemoryBytes, &n.RequestMemoryBytes, &n.LimitMemoryBytes, n.UsageMemoryBytes,
+			})
+		}
+	}
+	return t
+}
@@ -3,15 +3,22 @@ module github.com/google-cloud-tools/kube-eagle
 go 1.14
 
 require (
+	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.1
 	github.com/gophercloud/gophercloud v0.6.0 // indirect
 	github.com/imdario/mergo v0.3.8 // indirect
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/prometheus/client_golang v1.2.1
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
+	github.com/prometheus/common v0.7.0
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/crypto v0.0.0-20190611184440-5c40567a22f8
+	golang.org/x/net v0.0.0-20190813141303-74dc4d7220e7
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
 	k8s.io/api v0.0.0-20191025225708-5524a3672fbb
 	k8s.io/apimachinery v0.0.0-20191030190112-bb31b70367b7
 	k8s.io/client-go v0.0.0-20191026065934-0bdba2f91880
 	k8s.io/metrics v0.0.0-20191026071343-a166cc0bce8f
 	k8s.io/utils v0.0.0-20191030222137-2b95a09bc58d // indirect
+	sigs.k8s.io/yaml v1.1.0
 )
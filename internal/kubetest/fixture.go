@@ -0,0 +1,183 @@
+package kubetest
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+// Fixture returns the objects of a small cluster with two nodes:
+//
+//	node-a (allocatable 3920m CPU, 15Gi memory): default/web-1 (app and sidecar containers), default/job-1 (succeeded)
+//	node-b (allocatable 2 CPU, 7Gi memory): default/web-2, kube-system/dns
+//	unscheduled: default/pending-1
+//
+// All running pods have usage metrics. The objects are created freshly on each call, so tests may modify them.
+func Fixture() Objects {
+	return Objects{
+		Namespaces: []corev1.Namespace{
+			Namespace("default", map[string]string{"team": "web"}),
+			Namespace("kube-system", nil),
+		},
+		Nodes: []corev1.Node{
+			Node("node-a", "3920m", "15Gi", map[string]string{"node.kubernetes.io/instance-type": "n1-standard-4", "topology.kubernetes.io/zone": "europe-west1-b"}),
+			Node("node-b", "2", "7Gi", map[string]string{"beta.kubernetes.io/instance-type": "n1-standard-2", "failure-domain.beta.kubernetes.io/zone": "europe-west1-c"}),
+		},
+		Pods: []corev1.Pod{
+			Pod("default", "web-1", "node-a", corev1.PodRunning, map[string]string{"app": "web"},
+				Container("app", "500m", "256Mi", "1", "512Mi"),
+				Container("sidecar", "100m", "64Mi", "", "")),
+			Pod("default", "web-2", "node-b", corev1.PodRunning, map[string]string{"app": "web"},
+				Container("app", "500m", "256Mi", "1", "512Mi")),
+			Pod("default", "job-1", "node-a", corev1.PodSucceeded, map[string]string{"app": "job"},
+				Container("job", "200m", "128Mi", "", "")),
+			Pod("kube-system", "dns", "node-b", corev1.PodRunning, map[string]string{"app": "dns"},
+				Container("dns", "100m", "70Mi", "", "170Mi")),
+			Pod("default", "pending-1", "", corev1.PodPending, map[string]string{"app": "web"},
+				Container("app", "500m", "256Mi", "1", "512Mi")),
+		},
+		PodMetricses: []v1beta1.PodMetrics{
+			PodMetrics("default", "web-1", map[string]string{"app": "web"}, ContainerMetrics("app", "250m", "200Mi"), ContainerMetrics("sidecar", "50m", "30Mi")),
+			PodMetrics("default", "web-2", map[string]string{"app": "web"}, ContainerMetrics("app", "400m", "300Mi")),
+			PodMetrics("kube-system", "dns", map[string]string{"app": "dns"}, ContainerMetrics("dns", "20m", "40Mi")),
+		},
+		NodeMetricses: []v1beta1.NodeMetrics{
+			NodeMetrics("node-a", "1", "4Gi"),
+			NodeMetrics("node-b", "500m", "2Gi"),
+		},
+	}
+}
+
+// creationTimestamp is the creation time of all fixture objects, so that they are stable
+var creationTimestamp = metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+// Namespace returns a namespace with the given labels
+func Namespace(name string, labels map[string]string) corev1.Namespace {
+	return corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels, CreationTimestamp: creationTimestamp},
+		Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceActive},
+	}
+}
+
+// Node returns a ready node with the given allocatable resources, its capacity is the same
+func Node(name string, cpu string, memory string, labels map[string]string) corev1.Node {
+	resources := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse(memory),
+	}
+	return corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels, CreationTimestamp: creationTimestamp},
+		Status: corev1.NodeStatus{
+			Capacity:    resources,
+			Allocatable: resources,
+			Conditions:  []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			NodeInfo: corev1.NodeSystemInfo{
+				KubeletVersion:          "v1.16.0",
+				ContainerRuntimeVersion: "docker://19.3.1",
+				KernelVersion:           "4.19.0",
+				OSImage:                 "Container-Optimized OS",
+				Architecture:            "amd64",
+			},
+		},
+	}
+}
+
+// Pod returns a pod controlled by a replica set (or a job, if it has succeeded). The pod's IP is only set if it's
+// scheduled and its QoS class is derived from its containers' resources.
+func Pod(namespace string, name string, node string, phase corev1.PodPhase, labels map[string]string, containers ...corev1.Container) corev1.Pod {
+	isController := true
+	owner := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: labels["app"] + "-5d4f8", Controller: &isController}
+	if phase == corev1.PodSucceeded || phase == corev1.PodFailed {
+		owner = metav1.OwnerReference{APIVersion: "batch/v1", Kind: "Job", Name: name, Controller: &isController}
+	}
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         namespace,
+			Name:              name,
+			Labels:            labels,
+			OwnerReferences:   []metav1.OwnerReference{owner},
+			CreationTimestamp: creationTimestamp,
+		},
+		Spec:   corev1.PodSpec{NodeName: node, Containers: containers},
+		Status: corev1.PodStatus{Phase: phase, QOSClass: qosClass(containers)},
+	}
+	if node != "" {
+		pod.Status.HostIP = "10.0.0.1"
+		pod.Status.PodIP = "10.1.0.1"
+	}
+	return pod
+}
+
+// Container returns a container with the given resources, empty quantities are omitted
+func Container(name string, requestCPU string, requestMemory string, limitCPU string, limitMemory string) corev1.Container {
+	return corev1.Container{
+		Name: name,
+		Resources: corev1.ResourceRequirements{
+			Requests: resourceList(requestCPU, requestMemory),
+			Limits:   resourceList(limitCPU, limitMemory),
+		},
+	}
+}
+
+// PodMetrics returns the usage metrics of a pod
+func PodMetrics(namespace string, name string, labels map[string]string, containers ...v1beta1.ContainerMetrics) v1beta1.PodMetrics {
+	return v1beta1.PodMetrics{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels, CreationTimestamp: creationTimestamp},
+		Timestamp:  creationTimestamp,
+		Window:     metav1.Duration{Duration: 30 * time.Second},
+		Containers: containers,
+	}
+}
+
+// ContainerMetrics returns the usage metrics of a container
+func ContainerMetrics(name string, cpu string, memory string) v1beta1.ContainerMetrics {
+	return v1beta1.ContainerMetrics{Name: name, Usage: resourceList(cpu, memory)}
+}
+
+// NodeMetrics returns the usage metrics of a node
+func NodeMetrics(name string, cpu string, memory string) v1beta1.NodeMetrics {
+	return v1beta1.NodeMetrics{
+		ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: creationTimestamp},
+		Timestamp:  creationTimestamp,
+		Window:     metav1.Duration{Duration: 30 * time.Second},
+		Usage:      resourceList(cpu, memory),
+	}
+}
+
+func resourceList(cpu string, memory string) corev1.ResourceList {
+	resources := corev1.ResourceList{}
+	if cpu != "" {
+		resources[corev1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		resources[corev1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return resources
+}
+
+// qosClass derives the QoS class like Kubernetes does, but only considering CPU and memory of the given containers
+func qosClass(containers []corev1.Container) corev1.PodQOSClass {
+	isGuaranteed, isBestEffort := true, true
+	for _, c := range containers {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			request, hasRequest := c.Resources.Requests[name]
+			limit, hasLimit := c.Resources.Limits[name]
+			if hasRequest || hasLimit {
+				isBestEffort = false
+			}
+			if !hasLimit || (hasRequest && request.Cmp(limit) != 0) {
+				isGuaranteed = false
+			}
+		}
+	}
+	switch {
+	case isBestEffort:
+		return corev1.PodQOSBestEffort
+	case isGuaranteed:
+		return corev1.PodQOSGuaranteed
+	}
+	return corev1.PodQOSBurstable
+}
@@ -0,0 +1,348 @@
+// Package kubetest provides a fake Kubernetes API server for tests. Other than client-go's fake clientsets it serves
+// real HTTP requests, so that the clients' LIST requests (selectors, pagination and error handling) are tested as well.
+package kubetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+// Objects are the objects served by a fake API server
+type Objects struct {
+	Namespaces    []corev1.Namespace
+	Pods          []corev1.Pod
+	Nodes         []corev1.Node
+	PodMetricses  []v1beta1.PodMetrics
+	NodeMetricses []v1beta1.NodeMetrics
+}
+
+// Request is a request the fake API server received
+type Request struct {
+	// Resource is the listed resource as named by the kubernetes client's list stats (e. g. pods or podmetrics)
+	Resource  string
+	Namespace string
+	Query     url.Values
+}
+
+// leasesPrefix is the path prefix of the leases used by the leader election
+const leasesPrefix = "/apis/coordination.k8s.io/v1/namespaces/"
+
+// Server is a fake Kubernetes API server serving the LIST requests of kube eagle's kubernetes client, the endpoints
+// used by the readiness checks and the leases used by the leader election. LIST requests support label selectors,
+// field selectors and pagination.
+type Server struct {
+	*httptest.Server
+
+	mutex       sync.Mutex
+	objects     Objects
+	forbidden   map[string]bool
+	unavailable bool
+	requests    []Request
+	onRequest   func(request Request)
+	leases      map[string]coordinationv1.Lease
+}
+
+// NewServer starts a fake API server serving the given objects. It must be closed by the caller.
+func NewServer(objects Objects) *Server {
+	s := &Server{objects: objects, forbidden: make(map[string]bool), leases: make(map[string]coordinationv1.Lease)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Forbid lets LIST requests of the given resources (e. g. nodes or nodemetrics) fail as forbidden
+func (s *Server) Forbid(resources ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, resource := range resources {
+		s.forbidden[resource] = true
+	}
+}
+
+// SetUnavailable lets all requests fail with 503 (service unavailable) until it's reset
+func (s *Server) SetUnavailable(unavailable bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unavailable = unavailable
+}
+
+// OnRequest sets a function which is called for each LIST request the server receives, before it's answered
+func (s *Server) OnRequest(onRequest func(request Request)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onRequest = onRequest
+}
+
+// Requests returns the LIST requests the server received so far
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Lease returns the lease with the given namespace and name and whether it exists
+func (s *Server) Lease(namespace string, name string) (coordinationv1.Lease, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lease, exists := s.leases[namespace+"/"+name]
+	return lease, exists
+}
+
+// Config returns a client config for the server
+func (s *Server) Config() *rest.Config {
+	return &rest.Config{Host: s.URL}
+}
+
+// WriteKubeconfig writes a kubeconfig for the server to the given path, whose context is named after the cluster
+func (s *Server) WriteKubeconfig(path string, cluster string) error {
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: %[1]s
+  cluster:
+    server: %[2]s
+users:
+- name: %[1]s
+  user:
+    token: test
+contexts:
+- name: %[1]s
+  context:
+    cluster: %[1]s
+    user: %[1]s
+current-context: %[1]s
+`, cluster, s.URL)
+	return ioutil.WriteFile(path, []byte(kubeconfig), 0600)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	unavailable := s.unavailable
+	s.mutex.Unlock()
+	if unavailable {
+		writeError(w, apierrors.NewServiceUnavailable("the server is currently unable to handle the request"))
+		return
+	}
+
+	switch r.URL.Path {
+	case "/version":
+		writeJSON(w, map[string]string{"major": "1", "minor": "16", "gitVersion": "v1.16.0"})
+		return
+	case "/apis/metrics.k8s.io/v1beta1":
+		writeJSON(w, &metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: "metrics.k8s.io/v1beta1",
+			APIResources: []metav1.APIResource{{Name: "nodes", Kind: "NodeMetrics"}, {Name: "pods", Kind: "PodMetrics", Namespaced: true}},
+		})
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, leasesPrefix) {
+		s.serveLease(w, r)
+		return
+	}
+
+	resource, namespace, ok := parsePath(r.URL.Path)
+	if !ok {
+		writeError(w, apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+		return
+	}
+	query := r.URL.Query()
+	request := Request{Resource: resource, Namespace: namespace, Query: query}
+	s.mutex.Lock()
+	s.requests = append(s.requests, request)
+	isForbidden := s.forbidden[resource]
+	onRequest := s.onRequest
+	s.mutex.Unlock()
+	if onRequest != nil {
+		onRequest(request)
+	}
+	if isForbidden {
+		writeError(w, apierrors.NewForbidden(schema.GroupResource{Resource: resource}, "", fmt.Errorf("access denied")))
+		return
+	}
+
+	labelSelector, err := labels.Parse(query.Get("labelSelector"))
+	if err != nil {
+		writeError(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	fieldSelector, err := fields.ParseSelector(query.Get("fieldSelector"))
+	if err != nil {
+		writeError(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	matches := func(meta metav1.ObjectMeta, fieldSet fields.Set) bool {
+		fieldSet["metadata.name"] = meta.Name
+		fieldSet["metadata.namespace"] = meta.Namespace
+		return (namespace == "" || meta.Namespace == namespace) && labelSelector.Matches(labels.Set(meta.Labels)) && fieldSelector.Matches(fieldSet)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch resource {
+	case "namespaces":
+		var items []corev1.Namespace
+		for _, item := range s.objects.Namespaces {
+			if matches(item.ObjectMeta, fields.Set{"status.phase": string(item.Status.Phase)}) {
+				items = append(items, item)
+			}
+		}
+		start, end, continueToken := page(len(items), query)
+		writeJSON(w, &corev1.NamespaceList{TypeMeta: metav1.TypeMeta{Kind: "NamespaceList", APIVersion: "v1"}, ListMeta: metav1.ListMeta{Continue: continueToken}, Items: items[start:end]})
+	case "pods":
+		var items []corev1.Pod
+		for _, item := range s.objects.Pods {
+			if matches(item.ObjectMeta, fields.Set{"spec.nodeName": item.Spec.NodeName, "status.phase": string(item.Status.Phase)}) {
+				items = append(items, item)
+			}
+		}
+		start, end, continueToken := page(len(items), query)
+		writeJSON(w, &corev1.PodList{TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"}, ListMeta: metav1.ListMeta{Continue: continueToken}, Items: items[start:end]})
+	case "nodes":
+		var items []corev1.Node
+		for _, item := range s.objects.Nodes {
+			if matches(item.ObjectMeta, fields.Set{"spec.unschedulable": strconv.FormatBool(item.Spec.Unschedulable)}) {
+				items = append(items, item)
+			}
+		}
+		start, end, continueToken := page(len(items), query)
+		writeJSON(w, &corev1.NodeList{TypeMeta: metav1.TypeMeta{Kind: "NodeList", APIVersion: "v1"}, ListMeta: metav1.ListMeta{Continue: continueToken}, Items: items[start:end]})
+	case "podmetrics":
+		var items []v1beta1.PodMetrics
+		for _, item := range s.objects.PodMetricses {
+			if matches(item.ObjectMeta, fields.Set{}) {
+				items = append(items, item)
+			}
+		}
+		start, end, continueToken := page(len(items), query)
+		writeJSON(w, &v1beta1.PodMetricsList{TypeMeta: metav1.TypeMeta{Kind: "PodMetricsList", APIVersion: "metrics.k8s.io/v1beta1"}, ListMeta: metav1.ListMeta{Continue: continueToken}, Items: items[start:end]})
+	case "nodemetrics":
+		var items []v1beta1.NodeMetrics
+		for _, item := range s.objects.NodeMetricses {
+			if matches(item.ObjectMeta, fields.Set{}) {
+				items = append(items, item)
+			}
+		}
+		start, end, continueToken := page(len(items), query)
+		writeJSON(w, &v1beta1.NodeMetricsList{TypeMeta: metav1.TypeMeta{Kind: "NodeMetricsList", APIVersion: "metrics.k8s.io/v1beta1"}, ListMeta: metav1.ListMeta{Continue: continueToken}, Items: items[start:end]})
+	}
+}
+
+// serveLease gets, creates (POST) and updates (PUT) leases. Resource versions aren't checked, as the leader election
+// of a single replica doesn't conflict with itself.
+func (s *Server) serveLease(w http.ResponseWriter, r *http.Request) {
+	groupResource := schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, leasesPrefix), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != "leases" {
+		writeError(w, apierrors.NewNotFound(schema.GroupResource{}, r.URL.Path))
+		return
+	}
+	namespace := parts[0]
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r.Method == http.MethodGet {
+		if len(parts) != 3 {
+			writeError(w, apierrors.NewMethodNotSupported(groupResource, "list"))
+			return
+		}
+		lease, exists := s.leases[namespace+"/"+parts[2]]
+		if !exists {
+			writeError(w, apierrors.NewNotFound(groupResource, parts[2]))
+			return
+		}
+		writeJSON(w, &lease)
+		return
+	}
+
+	var lease coordinationv1.Lease
+	if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+		writeError(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	key := namespace + "/" + lease.Name
+	_, exists := s.leases[key]
+	switch {
+	case r.Method == http.MethodPost && exists:
+		writeError(w, apierrors.NewAlreadyExists(groupResource, lease.Name))
+		return
+	case r.Method == http.MethodPut && !exists:
+		writeError(w, apierrors.NewNotFound(groupResource, lease.Name))
+		return
+	case r.Method != http.MethodPost && r.Method != http.MethodPut:
+		writeError(w, apierrors.NewMethodNotSupported(groupResource, r.Method))
+		return
+	}
+	lease.TypeMeta = metav1.TypeMeta{Kind: "Lease", APIVersion: "coordination.k8s.io/v1"}
+	lease.Namespace = namespace
+	s.leases[key] = lease
+	writeJSON(w, &lease)
+}
+
+// parsePath returns the resource (named like the kubernetes client's list stats) and namespace of a LIST request
+func parsePath(path string) (string, string, bool) {
+	prefixes := map[string]string{"/api/v1/": "", "/apis/metrics.k8s.io/v1beta1/": "metrics"}
+	for prefix, suffix := range prefixes {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(path, prefix), "/")
+		namespace := ""
+		if len(parts) == 3 && parts[0] == "namespaces" {
+			namespace, parts = parts[1], parts[2:]
+		}
+		if len(parts) != 1 {
+			return "", "", false
+		}
+		resource := parts[0]
+		if suffix != "" {
+			resource = strings.TrimSuffix(resource, "s") + suffix
+		}
+		return resource, namespace, true
+	}
+	return "", "", false
+}
+
+// page returns the bounds of the requested page and the continue token of the next one. The continue token is
+// simply the offset of the next page.
+func page(count int, query url.Values) (int, int, string) {
+	start, _ := strconv.Atoi(query.Get("continue"))
+	if start > count {
+		start = count
+	}
+	end := count
+	if limit, _ := strconv.Atoi(query.Get("limit")); limit > 0 && start+limit < count {
+		end = start + limit
+		return start, end, strconv.Itoa(end)
+	}
+	return start, end, ""
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, err *apierrors.StatusError) {
+	status := err.Status()
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	json.NewEncoder(w).Encode(&status)
+}
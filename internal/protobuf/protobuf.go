@@ -0,0 +1,132 @@
+// Package protobuf encodes protobuf messages by hand, for the few messages kube eagle sends without generated code
+package protobuf
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Wire types of the protobuf encoding
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Buffer encodes a protobuf message field by field. Fields with default values are omitted, as proto3 does.
+type Buffer struct {
+	bytes []byte
+}
+
+// Bytes returns the encoded message
+func (b *Buffer) Bytes() []byte {
+	return b.bytes
+}
+
+func (b *Buffer) tag(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *Buffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.bytes = append(b.bytes, byte(v)|0x80)
+		v >>= 7
+	}
+	b.bytes = append(b.bytes, byte(v))
+}
+
+func (b *Buffer) fixed64(v uint64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	b.bytes = append(b.bytes, buf[:]...)
+}
+
+// Int64Field encodes an int64 field as varint
+func (b *Buffer) Int64Field(field int, v int64) {
+	b.Uint64Field(field, uint64(v))
+}
+
+// Uint64Field encodes an unsigned varint field
+func (b *Buffer) Uint64Field(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, wireVarint)
+		b.varint(v)
+	}
+}
+
+// BoolField encodes a bool field
+func (b *Buffer) BoolField(field int, v bool) {
+	if v {
+		b.tag(field, wireVarint)
+		b.varint(1)
+	}
+}
+
+// Fixed64Field encodes a fixed64 field
+func (b *Buffer) Fixed64Field(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, wireFixed64)
+		b.fixed64(v)
+	}
+}
+
+// DoubleField encodes a double field
+func (b *Buffer) DoubleField(field int, v float64) {
+	if v != 0 {
+		b.tag(field, wireFixed64)
+		b.fixed64(math.Float64bits(v))
+	}
+}
+
+// OneofDoubleField encodes a double which is part of a oneof or optional, thus it's encoded even if it's 0
+func (b *Buffer) OneofDoubleField(field int, v float64) {
+	b.tag(field, wireFixed64)
+	b.fixed64(math.Float64bits(v))
+}
+
+// StringField encodes a string field
+func (b *Buffer) StringField(field int, v string) {
+	if v != "" {
+		b.tag(field, wireBytes)
+		b.varint(uint64(len(v)))
+		b.bytes = append(b.bytes, v...)
+	}
+}
+
+// OneofStringField encodes a string which is part of a oneof, thus it's encoded even if it's empty
+func (b *Buffer) OneofStringField(field int, v string) {
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(v)))
+	b.bytes = append(b.bytes, v...)
+}
+
+// PackedFixed64Field encodes a packed repeated fixed64 field
+func (b *Buffer) PackedFixed64Field(field int, values []uint64) {
+	if len(values) > 0 {
+		b.tag(field, wireBytes)
+		b.varint(uint64(len(values) * 8))
+		for _, v := range values {
+			b.fixed64(v)
+		}
+	}
+}
+
+// PackedDoubleField encodes a packed repeated double field
+func (b *Buffer) PackedDoubleField(field int, values []float64) {
+	if len(values) > 0 {
+		b.tag(field, wireBytes)
+		b.varint(uint64(len(values) * 8))
+		for _, v := range values {
+			b.fixed64(math.Float64bits(v))
+		}
+	}
+}
+
+// MessageField encodes the message written by the given function as embedded message
+func (b *Buffer) MessageField(field int, message func(b *Buffer)) {
+	embedded := &Buffer{}
+	message(embedded)
+	b.tag(field, wireBytes)
+	b.varint(uint64(len(embedded.bytes)))
+	b.bytes = append(b.bytes, embedded.bytes...)
+}
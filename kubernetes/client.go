@@ -1,33 +1,94 @@
 package kubernetes
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google-cloud-tools/kube-eagle/options"
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth" // Auth required for out of cluster connections
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
 	metrics "k8s.io/metrics/pkg/client/clientset/versioned"
+	metricsscheme "k8s.io/metrics/pkg/client/clientset/versioned/scheme"
 )
 
+// completedPodsFieldSelector selects all pods which haven't completed (succeeded or failed)
+const completedPodsFieldSelector = "status.phase!=Succeeded,status.phase!=Failed"
+
 // Client provides methods to get all required metrics from Kubernetes
 type Client struct {
+	name          string
 	apiClient     *kubernetes.Clientset
 	metricsClient *metrics.Clientset
+	listPageSize  int64
+	listFromCache bool
+
+	includeNamespaces      []string
+	excludeNamespaces      map[string]bool
+	namespaceLabelSelector string
+
+	podLabelSelector  string
+	podFieldSelector  string
+	nodeLabelSelector string
+	nodeFieldSelector string
+
+	listStatsMutex      sync.Mutex
+	listStatsByResource map[string]ListStats
+
+	missingPermissionsWarning sync.Once
+
+	snapshotMutex       sync.Mutex
+	snapshotCall        *snapshotCall
+	lastSnapshot        *Snapshot
+	snapshotMinInterval time.Duration
+	// fetch fetches a snapshot of the cluster, it's fetchSnapshot unless replaced by tests
+	fetch func(ctx context.Context) (*Snapshot, error)
+}
+
+// ListStats describes the most recent LIST request of a resource type
+type ListStats struct {
+	Duration    time.Duration
+	ObjectCount int
+}
+
+// NewClients creates one client for each cluster kube eagle is supposed to monitor. Multiple clusters can be
+// configured either by a list of kubeconfig contexts or by a directory containing one kubeconfig per cluster.
+// If neither is given a single client is created, see NewClient.
+func NewClients(opts *options.Options) ([]*Client, error) {
+	if opts.KubeConfigDir != "" {
+		return newClientsFromDir(opts.KubeConfigDir, opts)
+	}
+
+	if len(opts.KubeContexts) > 0 {
+		return newClientsFromContexts(opts.KubeConfig, opts.KubeContexts, opts)
+	}
+
+	client, err := NewClient(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*Client{client}, nil
 }
 
 // NewClient creates a new client to get data from kubernetes masters
 func NewClient(opts *options.Options) (*Client, error) {
 	// Get right config to connect to kubernetes
 	var config *rest.Config
-	if opts.IsInCluster {
+	if isInCluster(opts) {
 		log.Info("Creating InCluster config to communicate with Kubernetes master")
 		var err error
 		config, err = rest.InClusterConfig()
@@ -35,19 +96,154 @@ func NewClient(opts *options.Options) (*Client, error) {
 			return nil, err
 		}
 	} else {
-		// Try to read currently set kubernetes config from your local kube config
+		// Try to read the kubernetes config using the same loading rules as kubectl
 		log.Info("Looking for Kubernetes config to communicate with Kubernetes master")
-		kubeConfigPath, err := getKubeConfigPath()
+		var err error
+		config, err = buildConfigFromKubeConfig(opts.KubeConfig, opts.KubeContext)
+		if err != nil {
+			return nil, fmt.Errorf("read kubeconfig: %v", err)
+		}
+	}
+
+	return newClientForConfig(opts.ClusterName, config, opts)
+}
+
+// NewLeaderElectionClient creates a client for the cluster holding the leader election lease only, which is the first
+// of the clusters NewClients creates clients for
+func NewLeaderElectionClient(opts *options.Options) (*Client, error) {
+	if opts.KubeConfigDir != "" {
+		files, err := kubeConfigFiles(opts.KubeConfigDir)
 		if err != nil {
 			return nil, err
 		}
-		// use the current context in kubeconfig
-		config, err = clientcmd.BuildConfigFromFlags("", kubeConfigPath)
+		return newClientFromFile(opts.KubeConfigDir, files[0], opts)
+	}
+
+	if len(opts.KubeContexts) > 0 {
+		return newClientFromContext(opts.KubeConfig, opts.KubeContexts[0], opts)
+	}
+
+	return NewClient(opts)
+}
+
+// newClientsFromContexts creates a client for each given context of the kubeconfig. The context names are used
+// as cluster names.
+func newClientsFromContexts(kubeConfig string, contexts []string, opts *options.Options) ([]*Client, error) {
+	clients := make([]*Client, 0, len(contexts))
+	for _, context := range contexts {
+		client, err := newClientFromContext(kubeConfig, context, opts)
 		if err != nil {
-			return nil, fmt.Errorf("read kubeconfig: %v", err)
+			return nil, err
 		}
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// newClientFromContext creates a client for the given context of the kubeconfig, named after the context
+func newClientFromContext(kubeConfig string, context string, opts *options.Options) (*Client, error) {
+	log.Infof("Creating Kubernetes client for context '%s'", context)
+	config, err := buildConfigFromKubeConfig(kubeConfig, context)
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig context '%s': %v", context, err)
+	}
+
+	return newClientForConfig(context, config, opts)
+}
+
+// newClientsFromDir creates a client for each kubeconfig file in the given directory. The file names (without
+// extension) are used as cluster names.
+func newClientsFromDir(dir string, opts *options.Options) ([]*Client, error) {
+	files, err := kubeConfigFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	clients := make([]*Client, 0, len(files))
+	for _, file := range files {
+		client, err := newClientFromFile(dir, file, opts)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+// kubeConfigFiles returns the names of the kubeconfig files in the given directory, sorted by name
+func kubeConfigFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig directory: %v", err)
+	}
+
+	var names []string
+	for _, file := range files {
+		// Skip directories and hidden files (e. g. the ..data symlinks of mounted configmaps and secrets)
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("couldn't find any kubeconfig in directory '%s'", dir)
+	}
+
+	return names, nil
+}
+
+// newClientFromFile creates a client for the given kubeconfig file in the directory, named after the file without
+// extension
+func newClientFromFile(dir string, file string, opts *options.Options) (*Client, error) {
+	clusterName := strings.TrimSuffix(file, filepath.Ext(file))
+	log.Infof("Creating Kubernetes client for cluster '%s'", clusterName)
+	config, err := buildConfigFromKubeConfig(filepath.Join(dir, file), "")
+	if err != nil {
+		return nil, fmt.Errorf("read kubeconfig '%s': %v", file, err)
+	}
+
+	return newClientForConfig(clusterName, config, opts)
+}
+
+// isInCluster returns whether in cluster communication shall be used. Unless it's explicitly configured, it's
+// auto detected by looking for the environment variables Kubernetes sets in every pod.
+func isInCluster(opts *options.Options) bool {
+	if opts.IsInCluster != nil {
+		return *opts.IsInCluster
 	}
 
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != "" && os.Getenv("KUBERNETES_SERVICE_PORT") != ""
+}
+
+// buildConfigFromKubeConfig reads the kubeconfig using client-go's standard loading rules (KUBECONFIG environment
+// variable, falling back to $HOME/.kube/config). A non empty kubeConfig replaces the KUBECONFIG environment
+// variable and may be a single path or a list of paths. If context is empty the kubeconfig's current context is used.
+func buildConfigFromKubeConfig(kubeConfig string, context string) (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	paths := filepath.SplitList(kubeConfig)
+	if len(paths) == 1 {
+		// An explicit path must exist, other than the paths of the precedence list
+		loadingRules.ExplicitPath = paths[0]
+	} else if len(paths) > 1 {
+		loadingRules.Precedence = paths
+	}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRules,
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+}
+
+// newClientForConfig creates the kubernetes clients for a single cluster
+func newClientForConfig(name string, config *rest.Config, opts *options.Options) (*Client, error) {
+	config.QPS = opts.APIQPS
+	config.Burst = opts.APIBurst
+	config.Timeout = opts.APITimeout
+	config.UserAgent = fmt.Sprintf("kube-eagle/%s (%s/%s)", opts.Version, runtime.GOOS, runtime.GOARCH)
+
 	// We got two clients, one for the common API and one explicitly for metrics
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -59,15 +255,77 @@ func NewClient(opts *options.Options) (*Client, error) {
 		return nil, fmt.Errorf("error creating kubernetes metrics client: '%v'", err)
 	}
 
-	return &Client{
-		apiClient:     client,
-		metricsClient: metricsClient,
-	}, nil
+	excludeNamespaces := make(map[string]bool)
+	for _, namespace := range opts.ExcludeNamespaces {
+		excludeNamespaces[namespace] = true
+	}
+
+	podFieldSelector := opts.PodFieldSelector
+	if opts.ExcludeCompletedPods {
+		// Let the API server filter completed pods, so that they aren't transferred at all
+		podFieldSelector = strings.Trim(podFieldSelector+","+completedPodsFieldSelector, ",")
+	}
+
+	c := &Client{
+		name:                name,
+		apiClient:           client,
+		metricsClient:       metricsClient,
+		listPageSize:        opts.APIListPageSize,
+		listFromCache:       opts.APIListFromCache,
+		listStatsByResource: make(map[string]ListStats),
+		snapshotMinInterval: opts.SnapshotMinInterval,
+
+		includeNamespaces:      opts.IncludeNamespaces,
+		excludeNamespaces:      excludeNamespaces,
+		namespaceLabelSelector: opts.NamespaceLabelSelector,
+
+		podLabelSelector:  opts.PodLabelSelector,
+		podFieldSelector:  podFieldSelector,
+		nodeLabelSelector: opts.NodeLabelSelector,
+		nodeFieldSelector: opts.NodeFieldSelector,
+	}
+	c.fetch = c.fetchSnapshot
+
+	return c, nil
+}
+
+// Name returns the name of the cluster this client talks to
+func (c *Client) Name() string {
+	return c.name
 }
 
-// NodeList returns a list of all known nodes in a kubernetes cluster
-func (c *Client) NodeList() (*corev1.NodeList, error) {
-	nodeList, err := c.apiClient.CoreV1().Nodes().List(metav1.ListOptions{})
+// ListStats returns the stats of the most recent LIST request of each resource type
+func (c *Client) ListStats() map[string]ListStats {
+	c.listStatsMutex.Lock()
+	defer c.listStatsMutex.Unlock()
+
+	listStatsByResource := make(map[string]ListStats, len(c.listStatsByResource))
+	for resource, stats := range c.listStatsByResource {
+		listStatsByResource[resource] = stats
+	}
+
+	return listStatsByResource
+}
+
+// NodeList returns a list of all known nodes in a kubernetes cluster which match the configured selectors
+func (c *Client) NodeList(ctx context.Context) (*corev1.NodeList, error) {
+	nodeList := &corev1.NodeList{}
+	err := c.listAll("nodes", []string{metav1.NamespaceAll}, func(_ string, listOptions metav1.ListOptions) (string, int, error) {
+		listOptions.LabelSelector = c.nodeLabelSelector
+		listOptions.FieldSelector = c.nodeFieldSelector
+		page := &corev1.NodeList{}
+		err := c.apiClient.CoreV1().RESTClient().Get().
+			Resource("nodes").
+			VersionedParams(&listOptions, scheme.ParameterCodec).
+			Context(ctx).
+			Do().
+			Into(page)
+		if err != nil {
+			return "", 0, err
+		}
+		nodeList.Items = append(nodeList.Items, page.Items...)
+		return page.Continue, len(page.Items), nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -75,9 +333,36 @@ func (c *Client) NodeList() (*corev1.NodeList, error) {
 	return nodeList, nil
 }
 
-// PodList returns a list of all known pods in a kubernetes cluster
-func (c *Client) PodList() (*corev1.PodList, error) {
-	podList, err := c.apiClient.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{})
+// PodList returns a list of all pods which match the configured namespaces and pod selectors. The node selectors are
+// only applied to snapshots, which list the nodes anyway, see Snapshot.
+func (c *Client) PodList(ctx context.Context) (*corev1.PodList, error) {
+	namespaces, err := c.namespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	podList := &corev1.PodList{}
+	err = c.listAll("pods", namespaces, func(namespace string, listOptions metav1.ListOptions) (string, int, error) {
+		listOptions.LabelSelector = c.podLabelSelector
+		listOptions.FieldSelector = c.podFieldSelector
+		page := &corev1.PodList{}
+		err := c.apiClient.CoreV1().RESTClient().Get().
+			Namespace(namespace).
+			Resource("pods").
+			VersionedParams(&listOptions, scheme.ParameterCodec).
+			Context(ctx).
+			Do().
+			Into(page)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, pod := range page.Items {
+			if !c.excludeNamespaces[pod.Namespace] {
+				podList.Items = append(podList.Items, pod)
+			}
+		}
+		return page.Continue, len(page.Items), nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -85,9 +370,58 @@ func (c *Client) PodList() (*corev1.PodList, error) {
 	return podList, nil
 }
 
-// PodMetricses returns all pods' usage metrics
-func (c *Client) PodMetricses() (*v1beta1.PodMetricsList, error) {
-	podMetricses, err := c.metricsClient.MetricsV1beta1().PodMetricses(metav1.NamespaceAll).List(metav1.ListOptions{})
+// hasNodeSelectors returns whether only a subset of all nodes shall be monitored
+func (c *Client) hasNodeSelectors() bool {
+	return c.nodeLabelSelector != "" || c.nodeFieldSelector != ""
+}
+
+// filterPodsByNodes omits all pods which are scheduled on a node that is not part of the given node list. Pending
+// pods which haven't been scheduled yet are kept.
+func filterPodsByNodes(podList *corev1.PodList, nodeList *corev1.NodeList) *corev1.PodList {
+	isMonitoredNode := make(map[string]bool)
+	for _, node := range nodeList.Items {
+		isMonitoredNode[node.Name] = true
+	}
+
+	filteredPodList := &corev1.PodList{ListMeta: podList.ListMeta}
+	for _, pod := range podList.Items {
+		if pod.Spec.NodeName == "" || isMonitoredNode[pod.Spec.NodeName] {
+			filteredPodList.Items = append(filteredPodList.Items, pod)
+		}
+	}
+
+	return filteredPodList
+}
+
+// PodMetricses returns all pods' usage metrics. Only the pod label selector is applied, as the metrics API does not
+// support field selectors. Use Snapshot to determine the pods to monitor.
+func (c *Client) PodMetricses(ctx context.Context) (*v1beta1.PodMetricsList, error) {
+	namespaces, err := c.namespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	podMetricses := &v1beta1.PodMetricsList{}
+	err = c.listAll("podmetrics", namespaces, func(namespace string, listOptions metav1.ListOptions) (string, int, error) {
+		listOptions.LabelSelector = c.podLabelSelector
+		page := &v1beta1.PodMetricsList{}
+		err := c.metricsClient.MetricsV1beta1().RESTClient().Get().
+			Namespace(namespace).
+			Resource("pods").
+			VersionedParams(&listOptions, metricsscheme.ParameterCodec).
+			Context(ctx).
+			Do().
+			Into(page)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, podMetrics := range page.Items {
+			if !c.excludeNamespaces[podMetrics.Namespace] {
+				podMetricses.Items = append(podMetricses.Items, podMetrics)
+			}
+		}
+		return page.Continue, len(page.Items), nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -95,9 +429,25 @@ func (c *Client) PodMetricses() (*v1beta1.PodMetricsList, error) {
 	return podMetricses, nil
 }
 
-// NodeMetricses returns all nodes' usage metrics
-func (c *Client) NodeMetricses() (*v1beta1.NodeMetricsList, error) {
-	nodeMetricses, err := c.metricsClient.MetricsV1beta1().NodeMetricses().List(metav1.ListOptions{})
+// NodeMetricses returns all nodes' usage metrics. Only the node label selector is applied, as the metrics API does
+// not support field selectors. Use NodeList to determine the nodes to monitor.
+func (c *Client) NodeMetricses(ctx context.Context) (*v1beta1.NodeMetricsList, error) {
+	nodeMetricses := &v1beta1.NodeMetricsList{}
+	err := c.listAll("nodemetrics", []string{metav1.NamespaceAll}, func(_ string, listOptions metav1.ListOptions) (string, int, error) {
+		listOptions.LabelSelector = c.nodeLabelSelector
+		page := &v1beta1.NodeMetricsList{}
+		err := c.metricsClient.MetricsV1beta1().RESTClient().Get().
+			Resource("nodes").
+			VersionedParams(&listOptions, metricsscheme.ParameterCodec).
+			Context(ctx).
+			Do().
+			Into(page)
+		if err != nil {
+			return "", 0, err
+		}
+		nodeMetricses.Items = append(nodeMetricses.Items, page.Items...)
+		return page.Continue, len(page.Items), nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -105,41 +455,121 @@ func (c *Client) NodeMetricses() (*v1beta1.NodeMetricsList, error) {
 	return nodeMetricses, nil
 }
 
-// IsHealthy returns whether the kubernetes client is able to get a list of all pods
-func (c *Client) IsHealthy() bool {
-	_, err := c.apiClient.CoreV1().Pods(metav1.NamespaceSystem).List(metav1.ListOptions{})
+// NamespaceList returns a list of all namespaces matching the configured namespace label selector
+func (c *Client) NamespaceList(ctx context.Context) (*corev1.NamespaceList, error) {
+	namespaceList := &corev1.NamespaceList{}
+	err := c.listAll("namespaces", []string{metav1.NamespaceAll}, func(_ string, listOptions metav1.ListOptions) (string, int, error) {
+		listOptions.LabelSelector = c.namespaceLabelSelector
+		page := &corev1.NamespaceList{}
+		err := c.apiClient.CoreV1().RESTClient().Get().
+			Resource("namespaces").
+			VersionedParams(&listOptions, scheme.ParameterCodec).
+			Context(ctx).
+			Do().
+			Into(page)
+		if err != nil {
+			return "", 0, err
+		}
+		namespaceList.Items = append(namespaceList.Items, page.Items...)
+		return page.Continue, len(page.Items), nil
+	})
 	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err.Error(),
-		}).Error("kubernetes client is not healthy")
-		return false
+		return nil, err
 	}
 
-	return true
+	return namespaceList, nil
 }
 
-// getKubeConfigPath returns the filepath to the local kubeConfig file or fails if it couldn't find it
-func getKubeConfigPath() (string, error) {
-	home := os.Getenv("HOME")
+// namespaces returns the namespaces in which namespaced resources shall be listed. Unless namespaces are included
+// explicitly or by a label selector, this is metav1.NamespaceAll. Excluded namespaces are filtered by the callers in
+// that case.
+func (c *Client) namespaces(ctx context.Context) ([]string, error) {
+	candidates := c.includeNamespaces
+	if c.namespaceLabelSelector != "" {
+		namespaceList, err := c.NamespaceList(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list namespaces matching '%s': %v", c.namespaceLabelSelector, err)
+		}
 
-	// Mac OS
-	if home != "" {
-		configPath := filepath.Join(home, ".kube", "config")
-		_, err := os.Stat(configPath)
-		if err == nil {
-			return configPath, nil
+		isIncluded := make(map[string]bool)
+		for _, namespace := range c.includeNamespaces {
+			isIncluded[namespace] = true
+		}
+		candidates = nil
+		for _, namespace := range namespaceList.Items {
+			if len(c.includeNamespaces) == 0 || isIncluded[namespace.Name] {
+				candidates = append(candidates, namespace.Name)
+			}
 		}
+	} else if len(c.includeNamespaces) == 0 {
+		return []string{metav1.NamespaceAll}, nil
 	}
 
-	// Windows
-	home = os.Getenv("USERPROFILE")
-	if home != "" {
-		configPath := filepath.Join(home, ".kube", "config")
-		_, err := os.Stat(configPath)
-		if err == nil {
-			return configPath, nil
+	var namespaces []string
+	for _, namespace := range candidates {
+		if !c.excludeNamespaces[namespace] {
+			namespaces = append(namespaces, namespace)
 		}
 	}
 
-	return "", fmt.Errorf("couldn't find home directory to look for the kube config")
+	return namespaces, nil
+}
+
+// listAll requests all pages of a LIST request in chunks of the configured page size, once for each of the given
+// namespaces. listPage is called once per page with the namespace and list options to use and returns the continue
+// token as well as the number of received objects.
+func (c *Client) listAll(resource string, namespaces []string, listPage func(namespace string, listOptions metav1.ListOptions) (string, int, error)) error {
+	begin := time.Now()
+	objectCount := 0
+	for _, namespace := range namespaces {
+		listOptions := metav1.ListOptions{Limit: c.listPageSize}
+		if c.listFromCache {
+			listOptions.ResourceVersion = "0"
+		}
+
+		for {
+			continueToken, count, err := listPage(namespace, listOptions)
+			if err != nil {
+				return err
+			}
+			objectCount += count
+			if continueToken == "" {
+				break
+			}
+			// Subsequent pages must not specify a resource version, it's implied by the continue token
+			listOptions.Continue = continueToken
+			listOptions.ResourceVersion = ""
+		}
+	}
+
+	duration := time.Since(begin)
+	log.Debugf("Listed %d %s of cluster '%s' after %fs", objectCount, resource, c.name, duration.Seconds())
+	c.listStatsMutex.Lock()
+	c.listStatsByResource[resource] = ListStats{Duration: duration, ObjectCount: objectCount}
+	c.listStatsMutex.Unlock()
+
+	return nil
+}
+
+// CheckAPIServer returns an error if the Kubernetes API server is not reachable. It requests the server's version,
+// which is cheap and doesn't require any permissions.
+func (c *Client) CheckAPIServer(ctx context.Context) error {
+	_, err := c.apiClient.Discovery().RESTClient().Get().
+		AbsPath("/version").
+		Context(ctx).
+		Do().
+		Raw()
+
+	return err
+}
+
+// CheckMetricsAPI returns an error if the metrics API (e. g. provided by metrics-server) is not reachable
+func (c *Client) CheckMetricsAPI(ctx context.Context) error {
+	_, err := c.metricsClient.Discovery().RESTClient().Get().
+		AbsPath("/apis/metrics.k8s.io/v1beta1").
+		Context(ctx).
+		Do().
+		Raw()
+
+	return err
 }
@@ -0,0 +1,522 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/internal/kubetest"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// newTestClient creates a client for the given fake API server, whose options are loaded from the given flags
+func newTestClient(t *testing.T, server *kubetest.Server, flags ...string) *Client {
+	t.Helper()
+	opts, err := options.Load(append([]string{"--version", "test"}, flags...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := newClientForConfig("test", server.Config(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// newFixtureServer starts a fake API server serving the fixture cluster, which is closed when the test finishes
+func newFixtureServer(t *testing.T) *kubetest.Server {
+	server := kubetest.NewServer(kubetest.Fixture())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// requestsOf returns the requests of the given resource the server received
+func requestsOf(server *kubetest.Server, resource string) []kubetest.Request {
+	var requests []kubetest.Request
+	for _, request := range server.Requests() {
+		if request.Resource == resource {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+func TestListAllPagination(t *testing.T) {
+	tests := []struct {
+		name          string
+		flags         []string
+		expectedPages []struct{ continueToken, resourceVersion string }
+	}{
+		{
+			name:  "pages",
+			flags: []string{"--kube-api-list-page-size", "2"},
+			expectedPages: []struct{ continueToken, resourceVersion string }{
+				{"", ""}, {"2", ""}, {"4", ""},
+			},
+		},
+		{
+			// Only the first page may be served from the watch cache, the others are implied by the continue token
+			name:  "from cache",
+			flags: []string{"--kube-api-list-page-size", "2", "--kube-api-list-from-cache"},
+			expectedPages: []struct{ continueToken, resourceVersion string }{
+				{"", "0"}, {"2", ""}, {"4", ""},
+			},
+		},
+		{
+			name:  "single page",
+			flags: []string{"--kube-api-list-page-size", "5"},
+			expectedPages: []struct{ continueToken, resourceVersion string }{
+				{"", ""},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFixtureServer(t)
+			client := newTestClient(t, server, test.flags...)
+			pods, err := client.PodList(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pods.Items) != 5 {
+				t.Errorf("listed %d pods, expected 5", len(pods.Items))
+			}
+			if stats := client.ListStats()["pods"]; stats.ObjectCount != 5 {
+				t.Errorf("list stats object count = %d, expected 5", stats.ObjectCount)
+			}
+
+			requests := requestsOf(server, "pods")
+			if len(requests) != len(test.expectedPages) {
+				t.Fatalf("requested %d pages, expected %d", len(requests), len(test.expectedPages))
+			}
+			for i, expected := range test.expectedPages {
+				query := requests[i].Query
+				if query.Get("continue") != expected.continueToken || query.Get("resourceVersion") != expected.resourceVersion {
+					t.Errorf("page %d requested with continue %q and resourceVersion %q, expected %q and %q", i, query.Get("continue"),
+						query.Get("resourceVersion"), expected.continueToken, expected.resourceVersion)
+				}
+				if query.Get("limit") != test.flags[1] {
+					t.Errorf("page %d requested with limit %q, expected %q", i, query.Get("limit"), test.flags[1])
+				}
+			}
+		})
+	}
+}
+
+func TestListAllCancellation(t *testing.T) {
+	server := newFixtureServer(t)
+	client := newTestClient(t, server, "--kube-api-list-page-size", "2")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The context is cancelled while the first page is being served
+	server.OnRequest(func(request kubetest.Request) {
+		if request.Resource == "pods" {
+			cancel()
+		}
+	})
+
+	if pods, err := client.PodList(ctx); err == nil {
+		t.Errorf("listed %d pods, expected an error", len(pods.Items))
+	}
+	if requests := requestsOf(server, "pods"); len(requests) != 1 {
+		t.Errorf("requested %d pages, expected the cancelled list to stop after the first one", len(requests))
+	}
+}
+
+func TestListAllPaginationPerNamespace(t *testing.T) {
+	server := newFixtureServer(t)
+	client := newTestClient(t, server, "--kube-api-list-page-size", "1", "--kube-api-list-from-cache", "--include-namespaces", "default,kube-system")
+	pods, err := client.PodList(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods.Items) != 5 {
+		t.Errorf("listed %d pods, expected 5", len(pods.Items))
+	}
+
+	// Each namespace is paginated separately, thus its first page is served from the cache
+	firstPages := make(map[string]int)
+	for _, request := range requestsOf(server, "pods") {
+		if request.Query.Get("continue") == "" {
+			firstPages[request.Namespace]++
+			if request.Query.Get("resourceVersion") != "0" {
+				t.Errorf("first page of namespace %s requested with resourceVersion %q, expected 0", request.Namespace, request.Query.Get("resourceVersion"))
+			}
+		} else if request.Query.Get("resourceVersion") != "" {
+			t.Errorf("subsequent page of namespace %s requested with resourceVersion %q", request.Namespace, request.Query.Get("resourceVersion"))
+		}
+	}
+	if firstPages["default"] != 1 || firstPages["kube-system"] != 1 || len(firstPages) != 2 {
+		t.Errorf("first pages by namespace = %v, expected one per namespace", firstPages)
+	}
+}
+
+// names returns the namespaced names of the pods
+func names(pods *corev1.PodList) []string {
+	var names []string
+	for _, pod := range pods.Items {
+		names = append(names, pod.Namespace+"/"+pod.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestNamespaceScoping(t *testing.T) {
+	tests := []struct {
+		name               string
+		flags              []string
+		expectedPods       []string
+		expectedNamespaces []string
+	}{
+		{
+			name:               "all namespaces",
+			expectedPods:       []string{"default/job-1", "default/pending-1", "default/web-1", "default/web-2", "kube-system/dns"},
+			expectedNamespaces: []string{""},
+		},
+		{
+			name:               "included namespaces",
+			flags:              []string{"--include-namespaces", "kube-system"},
+			expectedPods:       []string{"kube-system/dns"},
+			expectedNamespaces: []string{"kube-system"},
+		},
+		{
+			// Excluded namespaces are filtered by the client, unless namespaces are listed one by one
+			name:               "excluded namespaces",
+			flags:              []string{"--exclude-namespaces", "default"},
+			expectedPods:       []string{"kube-system/dns"},
+			expectedNamespaces: []string{""},
+		},
+		{
+			name:               "namespace label selector and excluded namespaces",
+			flags:              []string{"--namespace-label-selector", "kubernetes.io/metadata.name!=x", "--exclude-namespaces", "default"},
+			expectedPods:       []string{"kube-system/dns"},
+			expectedNamespaces: []string{"kube-system"},
+		},
+		{
+			name:               "namespace label selector",
+			flags:              []string{"--namespace-label-selector", "team=web"},
+			expectedPods:       []string{"default/job-1", "default/pending-1", "default/web-1", "default/web-2"},
+			expectedNamespaces: []string{"default"},
+		},
+		{
+			name:               "namespace label selector and included namespaces",
+			flags:              []string{"--namespace-label-selector", "team=web", "--include-namespaces", "kube-system"},
+			expectedNamespaces: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFixtureServer(t)
+			client := newTestClient(t, server, test.flags...)
+			pods, err := client.PodList(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := names(pods); !reflect.DeepEqual(actual, test.expectedPods) {
+				t.Errorf("pods = %v, expected %v", actual, test.expectedPods)
+			}
+
+			var namespaces []string
+			for _, request := range requestsOf(server, "pods") {
+				namespaces = append(namespaces, request.Namespace)
+			}
+			if !reflect.DeepEqual(namespaces, test.expectedNamespaces) {
+				t.Errorf("listed pods in namespaces %q, expected %q", namespaces, test.expectedNamespaces)
+			}
+		})
+	}
+}
+
+func TestFilterPodsByNodes(t *testing.T) {
+	objects := kubetest.Fixture()
+	pods := &corev1.PodList{Items: objects.Pods}
+	nodes := &corev1.NodeList{Items: objects.Nodes[:1]}
+
+	// Pods which haven't been scheduled yet are kept
+	expected := []string{"default/job-1", "default/pending-1", "default/web-1"}
+	if actual := names(filterPodsByNodes(pods, nodes)); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("filtered pods = %v, expected %v", actual, expected)
+	}
+	if len(pods.Items) != 5 {
+		t.Errorf("the pod list has been modified")
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	tests := []struct {
+		name                  string
+		flags                 []string
+		expectedPods          []string
+		expectedPodSelectors  [2]string
+		expectedNodeSelectors [2]string
+	}{
+		{
+			name:         "none",
+			expectedPods: []string{"default/job-1", "default/pending-1", "default/web-1", "default/web-2", "kube-system/dns"},
+		},
+		{
+			name:                 "pod selectors",
+			flags:                []string{"--pod-label-selector", "app=web", "--pod-field-selector", "status.phase=Running"},
+			expectedPods:         []string{"default/web-1", "default/web-2"},
+			expectedPodSelectors: [2]string{"app=web", "status.phase=Running"},
+		},
+		{
+			// The completed pods selector is appended to the configured field selector
+			name:                 "completed pods",
+			flags:                []string{"--pod-field-selector", "spec.nodeName=node-a", "--exclude-completed-pods"},
+			expectedPods:         []string{"default/web-1"},
+			expectedPodSelectors: [2]string{"", "spec.nodeName=node-a,status.phase!=Succeeded,status.phase!=Failed"},
+		},
+		{
+			name:                  "node label selector",
+			flags:                 []string{"--node-label-selector", "node.kubernetes.io/instance-type=n1-standard-4"},
+			expectedPods:          []string{"default/job-1", "default/pending-1", "default/web-1"},
+			expectedNodeSelectors: [2]string{"node.kubernetes.io/instance-type=n1-standard-4", ""},
+		},
+		{
+			name:                  "node field selector",
+			flags:                 []string{"--node-field-selector", "metadata.name=node-b"},
+			expectedPods:          []string{"default/pending-1", "default/web-2", "kube-system/dns"},
+			expectedNodeSelectors: [2]string{"", "metadata.name=node-b"},
+		},
+		{
+			name:                  "pod and node selectors",
+			flags:                 []string{"--pod-label-selector", "app=web", "--node-field-selector", "metadata.name=node-b"},
+			expectedPods:          []string{"default/pending-1", "default/web-2"},
+			expectedPodSelectors:  [2]string{"app=web", ""},
+			expectedNodeSelectors: [2]string{"", "metadata.name=node-b"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFixtureServer(t)
+			client := newTestClient(t, server, test.flags...)
+			snapshot, err := client.Snapshot(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := names(snapshot.Pods); !reflect.DeepEqual(actual, test.expectedPods) {
+				t.Errorf("snapshot pods = %v, expected %v", actual, test.expectedPods)
+			}
+			// Only the snapshot lists the nodes to filter the pods by
+			nodeListCount := len(requestsOf(server, "nodes"))
+			if _, err = client.PodList(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if count := len(requestsOf(server, "nodes")); count != nodeListCount {
+				t.Errorf("listing pods listed the nodes %d times, expected none", count-nodeListCount)
+			}
+
+			for resource, expected := range map[string][2]string{"pods": test.expectedPodSelectors, "nodes": test.expectedNodeSelectors} {
+				for _, request := range requestsOf(server, resource) {
+					actual := [2]string{request.Query.Get("labelSelector"), request.Query.Get("fieldSelector")}
+					if actual != expected {
+						t.Errorf("listed %s with selectors %q, expected %q", resource, actual, expected)
+					}
+				}
+			}
+			// The metrics API doesn't support field selectors
+			for _, request := range append(requestsOf(server, "podmetrics"), requestsOf(server, "nodemetrics")...) {
+				if request.Query.Get("fieldSelector") != "" {
+					t.Errorf("listed %s with field selector %q", request.Resource, request.Query.Get("fieldSelector"))
+				}
+			}
+		})
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kube-eagle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeKubeconfig writes a kubeconfig with one context per cluster, whose server is https://<cluster>.example.com. The
+// current context is omitted if it's empty.
+func writeKubeconfig(t *testing.T, path string, currentContext string, clusters ...string) {
+	t.Helper()
+	config := "apiVersion: v1\nkind: Config\n"
+	if currentContext != "" {
+		config += "current-context: " + currentContext + "\n"
+	}
+	config += "clusters:\n"
+	for _, cluster := range clusters {
+		config += fmt.Sprintf("- name: %[1]s\n  cluster:\n    server: https://%[1]s.example.com\n", cluster)
+	}
+	config += "users:\n- name: test\n  user:\n    token: test\ncontexts:\n"
+	for _, cluster := range clusters {
+		config += fmt.Sprintf("- name: %[1]s\n  context:\n    cluster: %[1]s\n    user: test\n", cluster)
+	}
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildConfigFromKubeConfig(t *testing.T) {
+	dir := tempDir(t)
+	writeKubeconfig(t, filepath.Join(dir, "a.yaml"), "a", "a")
+	writeKubeconfig(t, filepath.Join(dir, "b.yaml"), "b", "b")
+	writeKubeconfig(t, filepath.Join(dir, "ab.yaml"), "a", "a", "b")
+	writeKubeconfig(t, filepath.Join(dir, "c.yaml"), "", "c")
+	list := func(files ...string) string {
+		for i, file := range files {
+			files[i] = filepath.Join(dir, file)
+		}
+		return strings.Join(files, string(filepath.ListSeparator))
+	}
+
+	tests := []struct {
+		name         string
+		kubeConfig   string
+		context      string
+		expectedHost string
+	}{
+		{name: "explicit path", kubeConfig: list("a.yaml"), expectedHost: "https://a.example.com"},
+		{name: "missing explicit path", kubeConfig: list("missing.yaml")},
+		// The first file setting the current context wins, missing files are skipped
+		{name: "list", kubeConfig: list("missing.yaml", "c.yaml", "b.yaml", "a.yaml"), expectedHost: "https://b.example.com"},
+		{name: "context of list", kubeConfig: list("b.yaml", "a.yaml"), context: "a", expectedHost: "https://a.example.com"},
+		{name: "context", kubeConfig: list("ab.yaml"), context: "b", expectedHost: "https://b.example.com"},
+		{name: "current context", kubeConfig: list("ab.yaml"), expectedHost: "https://a.example.com"},
+		{name: "unknown context", kubeConfig: list("ab.yaml"), context: "c"},
+		{name: "no current context", kubeConfig: list("c.yaml")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := buildConfigFromKubeConfig(test.kubeConfig, test.context)
+			if test.expectedHost == "" {
+				if err == nil {
+					t.Errorf("built config for %s, expected an error", config.Host)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Host != test.expectedHost {
+				t.Errorf("host = %s, expected %s", config.Host, test.expectedHost)
+			}
+		})
+	}
+}
+
+func TestIsInCluster(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    []string
+		host     string
+		port     string
+		expected bool
+	}{
+		{name: "detected", host: "10.0.0.1", port: "443", expected: true},
+		{name: "host only", host: "10.0.0.1"},
+		{name: "port only", port: "443"},
+		{name: "outside of kubernetes"},
+		{name: "disabled", flags: []string{"--is-in-cluster=false"}, host: "10.0.0.1", port: "443"},
+		{name: "enabled", flags: []string{"--is-in-cluster=true"}, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range map[string]string{"KUBERNETES_SERVICE_HOST": test.host, "KUBERNETES_SERVICE_PORT": test.port} {
+				previous, isSet := os.LookupEnv(name)
+				os.Setenv(name, value)
+				t.Cleanup(func() {
+					if isSet {
+						os.Setenv(name, previous)
+					} else {
+						os.Unsetenv(name)
+					}
+				})
+			}
+			opts, err := options.Load(append([]string{"--version", "test"}, test.flags...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := isInCluster(opts); actual != test.expected {
+				t.Errorf("isInCluster = %v, expected %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestNewClientForConfig(t *testing.T) {
+	opts, err := options.Load([]string{"--version", "1.2.3", "--kube-api-qps", "12.5", "--kube-api-burst", "25", "--kube-api-timeout", "7s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &rest.Config{Host: "https://cluster.example.com"}
+	client, err := newClientForConfig("test", config, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedUserAgent := "kube-eagle/1.2.3 (" + runtime.GOOS + "/" + runtime.GOARCH + ")"
+	if config.QPS != 12.5 || config.Burst != 25 || config.Timeout != 7*time.Second || config.UserAgent != expectedUserAgent {
+		t.Errorf("config has QPS %v, burst %d, timeout %v and user agent %q, expected 12.5, 25, 7s and %q", config.QPS,
+			config.Burst, config.Timeout, config.UserAgent, expectedUserAgent)
+	}
+	// Both clients share the config's rate limit
+	restClients := map[string]rest.Interface{"api": client.apiClient.CoreV1().RESTClient(), "metrics": client.metricsClient.MetricsV1beta1().RESTClient()}
+	for name, restClient := range restClients {
+		if qps := restClient.GetRateLimiter().QPS(); qps != 12.5 {
+			t.Errorf("%s client is limited to %v QPS, expected 12.5", name, qps)
+		}
+	}
+}
+
+func TestNewLeaderElectionClient(t *testing.T) {
+	kubeConfigDir := tempDir(t)
+	writeKubeconfig(t, filepath.Join(kubeConfigDir, "b.yaml"), "b", "b")
+	writeKubeconfig(t, filepath.Join(kubeConfigDir, "a.yaml"), "a", "a")
+	writeKubeconfig(t, filepath.Join(kubeConfigDir, ".a.yaml"), "hidden", "hidden")
+	// Only the lease cluster's kubeconfig is read, thus the others may even be broken
+	if err := ioutil.WriteFile(filepath.Join(kubeConfigDir, "c.yaml"), []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kubeConfig := filepath.Join(tempDir(t), "config")
+	writeKubeconfig(t, kubeConfig, "a", "a", "b")
+
+	tests := []struct {
+		name         string
+		flags        []string
+		expectedName string
+		expectedHost string
+	}{
+		{name: "kubeconfig directory", flags: []string{"--kubeconfig-dir", kubeConfigDir}, expectedName: "a", expectedHost: "https://a.example.com"},
+		{name: "contexts", flags: []string{"--kubeconfig", kubeConfig, "--kube-contexts", "b,a"}, expectedName: "b", expectedHost: "https://b.example.com"},
+		{name: "single cluster", flags: []string{"--kubeconfig", kubeConfig, "--kube-context", "b", "--cluster-name", "prod", "--is-in-cluster=false"},
+			expectedName: "prod", expectedHost: "https://b.example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := options.Load(append([]string{"--version", "test"}, test.flags...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := NewLeaderElectionClient(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			host := client.apiClient.CoreV1().RESTClient().Get().URL().Host
+			if client.Name() != test.expectedName || "https://"+host != test.expectedHost {
+				t.Errorf("created client for %s at %s, expected %s at %s", client.Name(), host, test.expectedName, test.expectedHost)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google-cloud-tools/kube-eagle/options"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// serviceAccountNamespacePath is the file containing the pod's namespace when running in cluster
+const serviceAccountNamespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// podIPEnv is the environment variable containing the pod IP, if it's exposed using the downward API
+const podIPEnv = "POD_IP"
+
+// LeaderElector elects a leader among multiple kube eagle replicas using a Lease object, so that only one replica
+// has to query the Kubernetes API
+type LeaderElector struct {
+	identity string
+	elector  *leaderelection.LeaderElector
+}
+
+// NewLeaderElector creates a leader elector which uses a Lease in the cluster of the given client
+func NewLeaderElector(client *Client, opts *options.Options) (*LeaderElector, error) {
+	identity := opts.LeaderElectionIdentity
+	if identity == "" {
+		var err error
+		identity, err = defaultIdentity(opts.Port)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	namespace := opts.LeaderElectionNamespace
+	if namespace == "" {
+		namespace = podNamespace()
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      opts.LeaderElectionLeaseName,
+			Namespace: namespace,
+		},
+		Client:     client.apiClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   opts.LeaderElectionLeaseDuration,
+		RenewDeadline:   opts.LeaderElectionRenewDeadline,
+		RetryPeriod:     opts.LeaderElectionRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            opts.LeaderElectionLeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Infof("Started leading as '%s'", identity)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("Stopped leading as '%s'", identity)
+			},
+			OnNewLeader: func(leader string) {
+				log.Infof("New leader elected: '%s'", leader)
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create leader elector: %v", err)
+	}
+
+	return &LeaderElector{
+		identity: identity,
+		elector:  elector,
+	}, nil
+}
+
+// Run takes part in the leader election until the context is cancelled. It blocks, so it should be run in a
+// goroutine.
+func (l *LeaderElector) Run(ctx context.Context) {
+	// The elector returns as soon as it loses the leadership, thus it has to be restarted to take part again
+	for ctx.Err() == nil {
+		l.elector.Run(ctx)
+	}
+}
+
+// IsLeader returns whether this replica is the current leader
+func (l *LeaderElector) IsLeader() bool {
+	return l.elector.IsLeader()
+}
+
+// Leader returns the identity of the current leader or an empty string if it's unknown
+func (l *LeaderElector) Leader() string {
+	return l.elector.GetLeader()
+}
+
+// Identity returns the identity of this replica
+func (l *LeaderElector) Identity() string {
+	return l.identity
+}
+
+// defaultIdentity returns the address followers proxy requests to if this replica is the leader, i. e. the pod IP
+// (from the POD_IP environment variable, set using the downward API) or else the hostname, along with the port
+func defaultIdentity(port int) (string, error) {
+	host := os.Getenv(podIPEnv)
+	if host == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("failed to get hostname as leader election identity: %v", err)
+		}
+		host = hostname
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// podNamespace returns the namespace kube eagle is running in, defaulting to the default namespace when running
+// out of cluster
+func podNamespace() string {
+	namespace, err := ioutil.ReadFile(serviceAccountNamespacePath)
+	if err != nil {
+		return metav1.NamespaceDefault
+	}
+
+	return strings.TrimSpace(string(namespace))
+}
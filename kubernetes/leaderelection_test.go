@@ -0,0 +1,40 @@
+package kubernetes
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDefaultIdentity(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	podIP, isSet := os.LookupEnv(podIPEnv)
+	t.Cleanup(func() {
+		if isSet {
+			os.Setenv(podIPEnv, podIP)
+		} else {
+			os.Unsetenv(podIPEnv)
+		}
+	})
+
+	tests := []struct {
+		podIP            string
+		expectedIdentity string
+	}{
+		{podIP: "10.0.0.1", expectedIdentity: "10.0.0.1:8080"},
+		{podIP: "fd00::1", expectedIdentity: "[fd00::1]:8080"},
+		{podIP: "", expectedIdentity: hostname + ":8080"},
+	}
+	for _, test := range tests {
+		os.Setenv(podIPEnv, test.podIP)
+		identity, err := defaultIdentity(8080)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity != test.expectedIdentity {
+			t.Errorf("identity with pod IP %q = %q, expected %q", test.podIP, identity, test.expectedIdentity)
+		}
+	}
+}
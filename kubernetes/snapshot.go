@@ -0,0 +1,159 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+// Snapshot contains all objects of a cluster which are needed to compute kube eagle's metrics. It's fetched once per
+// scrape and shared by all collectors (and concurrent scrapes), thus it must not be modified.
+type Snapshot struct {
+	// Cluster is the name of the cluster the snapshot has been taken from
+	Cluster string
+	// FetchedAt is the time the snapshot has been fetched
+	FetchedAt time.Time
+
+	Pods         *corev1.PodList
+	PodMetricses *v1beta1.PodMetricsList
+	// Nodes and NodeMetricses are nil if kube eagle is missing the permissions to list them
+	Nodes         *corev1.NodeList
+	NodeMetricses *v1beta1.NodeMetricsList
+}
+
+// snapshotCall is an in-flight fetch of a snapshot, whose result is shared by all waiting callers
+type snapshotCall struct {
+	done     chan struct{}
+	snapshot *Snapshot
+	err      error
+	waiters  int
+	cancel   context.CancelFunc
+}
+
+// Snapshot returns a snapshot of the cluster. Concurrent calls are coalesced into a single fetch whose result is
+// shared by all callers, and a successful snapshot is reused until it's older than the minimum snapshot interval.
+// The fetch is cancelled once all callers' contexts are cancelled.
+func (c *Client) Snapshot(ctx context.Context) (*Snapshot, error) {
+	c.snapshotMutex.Lock()
+	if c.lastSnapshot != nil && time.Since(c.lastSnapshot.FetchedAt) < c.snapshotMinInterval {
+		snapshot := c.lastSnapshot
+		c.snapshotMutex.Unlock()
+		log.Debugf("Reusing snapshot of cluster '%s' fetched at %v", c.name, snapshot.FetchedAt)
+		return snapshot, nil
+	}
+
+	call := c.snapshotCall
+	if call == nil {
+		fetchCtx, cancel := context.WithCancel(context.Background())
+		call = &snapshotCall{done: make(chan struct{}), cancel: cancel}
+		c.snapshotCall = call
+		go func() {
+			defer cancel()
+			snapshot, err := c.fetch(fetchCtx)
+
+			c.snapshotMutex.Lock()
+			call.snapshot, call.err = snapshot, err
+			if err == nil {
+				c.lastSnapshot = snapshot
+			}
+			// A cancelled call has already been replaced
+			if c.snapshotCall == call {
+				c.snapshotCall = nil
+			}
+			c.snapshotMutex.Unlock()
+			close(call.done)
+		}()
+	} else {
+		log.Debugf("Waiting for in-flight snapshot of cluster '%s'", c.name)
+	}
+	call.waiters++
+	c.snapshotMutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.snapshot, call.err
+	case <-ctx.Done():
+		c.snapshotMutex.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Subsequent callers must start a new fetch instead of waiting for the cancelled one
+			call.cancel()
+			if c.snapshotCall == call {
+				c.snapshotCall = nil
+			}
+		}
+		c.snapshotMutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// fetchSnapshot fetches all objects of a snapshot concurrently. Missing permissions to list nodes or node metrics are
+// tolerated (e. g. in namespace scoped deployments), unless nodes shall be filtered by selectors.
+func (c *Client) fetchSnapshot(ctx context.Context) (*Snapshot, error) {
+	var wg sync.WaitGroup
+	var podList *corev1.PodList
+	var podListError error
+	var podMetricses *v1beta1.PodMetricsList
+	var podMetricsesError error
+	var nodeList *corev1.NodeList
+	var nodeListError error
+	var nodeMetricses *v1beta1.NodeMetricsList
+	var nodeMetricsesError error
+
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		podList, podListError = c.PodList(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		podMetricses, podMetricsesError = c.PodMetricses(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		nodeList, nodeListError = c.NodeList(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		nodeMetricses, nodeMetricsesError = c.NodeMetricses(ctx)
+	}()
+	wg.Wait()
+
+	if podListError != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", podListError)
+	}
+	if podMetricsesError != nil {
+		return nil, fmt.Errorf("failed to list pod metrics: %v", podMetricsesError)
+	}
+	if nodeListError != nil && (!apierrors.IsForbidden(nodeListError) || c.hasNodeSelectors()) {
+		return nil, fmt.Errorf("failed to list nodes: %v", nodeListError)
+	}
+	if nodeMetricsesError != nil && !apierrors.IsForbidden(nodeMetricsesError) {
+		return nil, fmt.Errorf("failed to list node metrics: %v", nodeMetricsesError)
+	}
+	if nodeListError != nil || nodeMetricsesError != nil {
+		c.missingPermissionsWarning.Do(func() {
+			log.Warnf("Missing permissions to list nodes or node metrics of cluster '%s', node metrics will only be based on pods", c.name)
+		})
+	}
+
+	// Pods scheduled on nodes which don't match the node selectors are omitted, so that node and container metrics agree
+	if nodeList != nil && c.hasNodeSelectors() {
+		podList = filterPodsByNodes(podList, nodeList)
+	}
+
+	return &Snapshot{
+		Cluster:       c.name,
+		FetchedAt:     time.Now(),
+		Pods:          podList,
+		PodMetricses:  podMetricses,
+		Nodes:         nodeList,
+		NodeMetricses: nodeMetricses,
+	}, nil
+}
@@ -0,0 +1,254 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshotForbidden(t *testing.T) {
+	tests := []struct {
+		name      string
+		forbidden []string
+		flags     []string
+		isError   bool
+	}{
+		{name: "all permissions"},
+		// Namespace scoped deployments can't list nodes, their node metrics are based on pods only
+		{name: "nodes", forbidden: []string{"nodes"}},
+		{name: "node metrics", forbidden: []string{"nodemetrics"}},
+		{name: "nodes and node metrics", forbidden: []string{"nodes", "nodemetrics"}, flags: []string{"--include-namespaces", "default"}},
+		// Pods can't be filtered by node without listing the nodes
+		{name: "nodes with node selector", forbidden: []string{"nodes"}, flags: []string{"--node-label-selector", "zone=a"}, isError: true},
+		{name: "pods", forbidden: []string{"pods"}, isError: true},
+		{name: "pod metrics", forbidden: []string{"podmetrics"}, isError: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newFixtureServer(t)
+			server.Forbid(test.forbidden...)
+			client := newTestClient(t, server, test.flags...)
+			snapshot, err := client.Snapshot(context.Background())
+			if (err != nil) != test.isError {
+				t.Fatalf("Snapshot() error = %v, expected error %v", err, test.isError)
+			}
+			if err != nil {
+				return
+			}
+
+			if snapshot.Cluster != "test" || snapshot.Pods == nil || snapshot.PodMetricses == nil {
+				t.Errorf("incomplete snapshot %+v", snapshot)
+			}
+			isForbidden := make(map[string]bool)
+			for _, resource := range test.forbidden {
+				isForbidden[resource] = true
+			}
+			if (snapshot.Nodes == nil) != isForbidden["nodes"] {
+				t.Errorf("snapshot has nodes %v, expected forbidden %v", snapshot.Nodes, isForbidden["nodes"])
+			}
+			if (snapshot.NodeMetricses == nil) != isForbidden["nodemetrics"] {
+				t.Errorf("snapshot has node metrics %v, expected forbidden %v", snapshot.NodeMetricses, isForbidden["nodemetrics"])
+			}
+		})
+	}
+}
+
+// fakeFetch is a fetch which blocks until it's released or its context is cancelled
+type fakeFetch struct {
+	count     int32
+	started   chan int
+	release   chan struct{}
+	cancelled chan int
+	// fetchedAt is the FetchedAt time of the returned snapshots, now if zero
+	fetchedAt time.Time
+	err       error
+}
+
+func newFakeFetch() *fakeFetch {
+	return &fakeFetch{started: make(chan int, 10), release: make(chan struct{}), cancelled: make(chan int, 10)}
+}
+
+func (f *fakeFetch) fetch(ctx context.Context) (*Snapshot, error) {
+	n := int(atomic.AddInt32(&f.count, 1))
+	f.started <- n
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		f.cancelled <- n
+		// Keep the cancelled fetch in flight, like slow API requests which ignore the cancellation
+		<-f.release
+		return nil, ctx.Err()
+	}
+	fetchedAt := f.fetchedAt
+	if fetchedAt.IsZero() {
+		fetchedAt = time.Now()
+	}
+	return &Snapshot{Cluster: fmt.Sprintf("fetch-%d", n), FetchedAt: fetchedAt}, f.err
+}
+
+func newFakeClient(f *fakeFetch, minInterval time.Duration) *Client {
+	return &Client{name: "test", fetch: f.fetch, snapshotMinInterval: minInterval}
+}
+
+// waitFor waits until the condition holds
+func waitFor(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waiters returns the number of callers waiting for the in-flight fetch
+func (c *Client) waiters() int {
+	c.snapshotMutex.Lock()
+	defer c.snapshotMutex.Unlock()
+	if c.snapshotCall == nil {
+		return 0
+	}
+	return c.snapshotCall.waiters
+}
+
+func TestSnapshotCoalescing(t *testing.T) {
+	f := newFakeFetch()
+	client := newFakeClient(f, 0)
+
+	var wg sync.WaitGroup
+	snapshots := make([]*Snapshot, 5)
+	for i := range snapshots {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			snapshot, err := client.Snapshot(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			snapshots[i] = snapshot
+		}(i)
+	}
+	waitFor(t, "all callers to wait", func() bool { return client.waiters() == len(snapshots) })
+	close(f.release)
+	wg.Wait()
+
+	if f.count != 1 {
+		t.Errorf("fetched %d times, expected once", f.count)
+	}
+	for i, snapshot := range snapshots {
+		if snapshot != snapshots[0] {
+			t.Errorf("caller %d got snapshot %v, expected the shared snapshot %v", i, snapshot, snapshots[0])
+		}
+	}
+
+	// The minimum interval is 0, thus the next call fetches again
+	if snapshot, _ := client.Snapshot(context.Background()); snapshot == snapshots[0] || f.count != 2 {
+		t.Errorf("snapshot has been reused without minimum interval")
+	}
+}
+
+func TestSnapshotCancellation(t *testing.T) {
+	f := newFakeFetch()
+	client := newFakeClient(f, 0)
+
+	errs := make(chan error, 2)
+	cancels := make([]context.CancelFunc, 2)
+	for i := range cancels {
+		var ctx context.Context
+		ctx, cancels[i] = context.WithCancel(context.Background())
+		go func() {
+			_, err := client.Snapshot(ctx)
+			errs <- err
+		}()
+	}
+	waitFor(t, "both callers to wait", func() bool { return client.waiters() == 2 })
+
+	// The fetch continues as long as a caller is waiting for it
+	cancels[0]()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("cancelled caller got error %v, expected %v", err, context.Canceled)
+	}
+	select {
+	case <-f.cancelled:
+		t.Fatal("fetch has been cancelled although a caller is still waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The last caller cancels the fetch
+	cancels[1]()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("cancelled caller got error %v, expected %v", err, context.Canceled)
+	}
+	select {
+	case n := <-f.cancelled:
+		if n != 1 {
+			t.Errorf("fetch %d has been cancelled, expected 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fetch hasn't been cancelled after the last caller left")
+	}
+
+	// While the cancelled fetch is still in flight, a new caller starts a new fetch instead of joining it
+	result := make(chan *Snapshot)
+	go func() {
+		snapshot, err := client.Snapshot(context.Background())
+		if err != nil {
+			t.Errorf("caller after cancellation got error %v", err)
+		}
+		result <- snapshot
+	}()
+	if n := <-f.started; n != 1 {
+		t.Fatalf("fetch %d started, expected 1", n)
+	}
+	select {
+	case n := <-f.started:
+		if n != 2 {
+			t.Fatalf("fetch %d started, expected 2", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no new fetch has been started after the cancellation")
+	}
+	close(f.release)
+	if snapshot := <-result; snapshot == nil || snapshot.Cluster != "fetch-2" {
+		t.Errorf("caller after cancellation got snapshot %v, expected the one of fetch 2", snapshot)
+	}
+}
+
+func TestSnapshotMinInterval(t *testing.T) {
+	f := newFakeFetch()
+	close(f.release)
+	client := newFakeClient(f, time.Hour)
+
+	first, err := client.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := client.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first || f.count != 1 {
+		t.Errorf("snapshot hasn't been reused within the minimum interval (fetched %d times)", f.count)
+	}
+
+	// Snapshots older than the minimum interval are fetched again
+	f.fetchedAt = time.Now().Add(-2 * time.Hour)
+	client.lastSnapshot = nil
+	client.Snapshot(context.Background())
+	if _, err = client.Snapshot(context.Background()); err != nil || f.count != 3 {
+		t.Errorf("outdated snapshot has been reused (fetched %d times)", f.count)
+	}
+
+	// Failed fetches aren't reused
+	f.fetchedAt = time.Time{}
+	f.err = fmt.Errorf("failed")
+	client.lastSnapshot = nil
+	client.Snapshot(context.Background())
+	if _, err = client.Snapshot(context.Background()); err == nil || f.count != 5 {
+		t.Errorf("failed snapshot has been reused (fetched %d times)", f.count)
+	}
+}
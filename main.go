@@ -1,40 +1,327 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/google-cloud-tools/kube-eagle/api"
 	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
 	"github.com/prometheus/client_golang/prometheus"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/google-cloud-tools/kube-eagle/export"
+	"github.com/google-cloud-tools/kube-eagle/openmetrics"
 	"github.com/google-cloud-tools/kube-eagle/options"
-	"github.com/kelseyhightower/envconfig"
+	"github.com/google-cloud-tools/kube-eagle/otlp"
+	"github.com/google-cloud-tools/kube-eagle/remotewrite"
+	"github.com/google-cloud-tools/kube-eagle/web"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
 )
 
-func healthcheck(collector *collector.KubeEagleCollector) http.HandlerFunc {
+// proxiedByHeader is set on scrapes which followers proxy to the leader
+const proxiedByHeader = "X-Kube-Eagle-Proxied-By"
+
+// healthz reports whether the process is alive. It doesn't depend on the Kubernetes API, so that kube eagle isn't
+// restarted because of an unavailable API server.
+func healthz() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Liveness check has been called")
+		writeJSON(w, http.StatusOK, healthResponse{Status: collector.CheckStatusOk})
+	})
+}
+
+// readyz reports whether kube eagle is able to serve metrics, along with the status of each cluster's readiness checks.
+// The checks' errors are only logged, as they may reveal internals of the clusters.
+func readyz(reloader *reloader) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debug("Readiness check has been called")
+		isReady, clusters := reloader.Collector().CheckReadiness(r.Context())
+		for _, cluster := range clusters {
+			for _, check := range cluster.Checks {
+				if check.Status != collector.CheckStatusOk {
+					log.Warnf("Readiness check '%s' of cluster '%s' failed: %s", check.Name, cluster.Cluster, check.Error)
+				}
+			}
+		}
+		if !isReady {
+			writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: collector.CheckStatusFailed, Clusters: clusters})
+			return
+		}
+		writeJSON(w, http.StatusOK, healthResponse{Status: collector.CheckStatusOk, Clusters: clusters})
+	})
+}
+
+type healthResponse struct {
+	Status   string                       `json:"status"`
+	Clusters []collector.ClusterReadiness `json:"clusters,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Warnf("Failed to write response: %v", err)
+	}
+}
+
+func metricsHandler(reloader *reloader, leaderProxy *leaderProxy, opts *options.Options) http.Handler {
+	handlerFor := func(gatherer prometheus.Gatherer, types map[string]string) http.Handler {
+		if opts.OpenMetrics {
+			return openmetrics.HandlerFor(gatherer, types)
+		}
+		return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+	}
+	followerHandler := handlerFor(prometheus.DefaultGatherer, nil)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if leaderProxy.isFollower() {
+			if opts.LeaderElectionFollowerMode == options.FollowerModeProxy && leaderProxy.serve(w, r) {
+				return
+			}
+			followerHandler.ServeHTTP(w, r)
+			return
+		}
+
+		handlerFor(reloader.Gatherer(r.Context()), reloader.Collector().OpenMetricsTypes()).ServeHTTP(w, r)
+	})
+
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, handler)
+}
+
+// apiHandler serves the JSON API. Followers proxy API requests to the leader, so that only the leader queries the
+// Kubernetes API.
+func apiHandler(reloader *reloader, leaderProxy *leaderProxy) http.Handler {
+	handler := api.NewHandler(func(ctx context.Context, filter collector.ReportFilter) ([]*collector.Report, map[string]error) {
+		return reloader.Collector().Reports(ctx, filter)
+	})
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Debug("Healthcheck has been called")
-		if collector.IsHealthy() == true {
-			w.Write([]byte("Ok"))
-		} else {
-			http.Error(w, "Healthcheck failed", http.StatusServiceUnavailable)
+		if leaderProxy.isFollower() {
+			if !leaderProxy.serve(w, r) {
+				writeJSON(w, http.StatusServiceUnavailable, api.ErrorResponse{Error: "the leader is unknown"})
+			}
+			return
 		}
+		handler.ServeHTTP(w, r)
 	})
 }
 
+// leadership is the state of the leader election, see kubernetes.LeaderElector
+type leadership interface {
+	IsLeader() bool
+	Leader() string
+	Identity() string
+}
+
+// leaderProxy proxies requests of followers to the leader, whose identity is its address. A nil leaderProxy means
+// that no leader is elected.
+type leaderProxy struct {
+	leadership leadership
+	scheme     string
+	transport  http.RoundTripper
+}
+
+// newLeaderProxy creates a proxy to the leader. If the server serves HTTPS, the leader is accessed using TLS and only
+// trusted if it presents the same certificate as this replica. Otherwise the credentials of proxied requests could be
+// sent to anyone who managed to acquire the lease.
+func newLeaderProxy(leadership leadership, server *web.Server) *leaderProxy {
+	p := &leaderProxy{leadership: leadership, scheme: "http", transport: http.DefaultTransport}
+	if server.IsTLS() {
+		p.scheme = "https"
+		p.transport = &http.Transport{
+			TLSClientConfig:     server.PeerTLSConfig(),
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	}
+	return p
+}
+
+// isFollower returns whether a leader is elected and this replica isn't the leader
+func (p *leaderProxy) isFollower() bool {
+	return p != nil && !p.leadership.IsLeader()
+}
+
+// serve proxies the request to the current leader and returns whether it did so. Requests which have already been
+// proxied are not proxied again, to avoid loops while the leader changes.
+func (p *leaderProxy) serve(w http.ResponseWriter, r *http.Request) bool {
+	leader := p.leadership.Leader()
+	if leader == "" || r.Header.Get(proxiedByHeader) != "" {
+		return false
+	}
+
+	log.Debugf("Proxying request to leader '%s'", leader)
+	r.Header.Set(proxiedByHeader, p.leadership.Identity())
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: p.scheme, Host: leader})
+	proxy.Transport = p.transport
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Warnf("Failed to proxy request to leader '%s': %v", leader, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	proxy.ServeHTTP(w, r)
+	return true
+}
+
+// startLeaderElection starts to take part in the leader election using the given client's cluster and exposes
+// whether this replica is the leader as metric. The lease is released once the context is cancelled.
+func startLeaderElection(ctx context.Context, wg *sync.WaitGroup, client *kubernetes.Client, opts *options.Options) (*kubernetes.LeaderElector, error) {
+	leaderElector, err := kubernetes.NewLeaderElector(client, opts)
+	if err != nil {
+		return nil, err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		leaderElector.Run(ctx)
+	}()
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Name:      "leader",
+			Help:      "Kube Eagle: Whether this replica is the elected leader.",
+		},
+		func() float64 {
+			if leaderElector.IsLeader() {
+				return 1
+			}
+			return 0
+		},
+	))
+
+	return leaderElector, nil
+}
+
+// startWorkers starts the configured background workers (snapshot export, OTLP export and remote write), which stop
+// once the context is cancelled. In high availability mode they only work while this replica is the leader.
+func startWorkers(ctx context.Context, wg *sync.WaitGroup, reloader *reloader, leaderElector *kubernetes.LeaderElector, opts *options.Options) error {
+	var isLeader func() bool
+	if leaderElector != nil {
+		isLeader = leaderElector.IsLeader
+	}
+	gather := func(ctx context.Context) ([]*dto.MetricFamily, error) {
+		return reloader.Gatherer(ctx).Gather()
+	}
+
+	if opts.ExportInterval > 0 {
+		reports := func(ctx context.Context, filter collector.ReportFilter) ([]*collector.Report, map[string]error) {
+			return reloader.Collector().Reports(ctx, filter)
+		}
+		exporter, err := export.New(opts, reports, isLeader)
+		if err != nil {
+			return fmt.Errorf("could not configure export: '%v'", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			exporter.Run(ctx)
+		}()
+	}
+
+	if opts.OTLPEndpoint != "" {
+		// Only the collector's metrics are pushed, the Go runtime and process metrics are left to the scrapes
+		collectorGather := func(ctx context.Context) ([]*dto.MetricFamily, error) {
+			return reloader.CollectorGatherer(ctx).Gather()
+		}
+		otlpExporter, err := otlp.New(opts, collectorGather, isLeader)
+		if err != nil {
+			return fmt.Errorf("could not configure OTLP export: '%v'", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			otlpExporter.Run(ctx)
+		}()
+	}
+
+	if opts.RemoteWriteURL != "" {
+		writer, err := remotewrite.New(opts, gather, isLeader)
+		if err != nil {
+			return fmt.Errorf("could not configure remote write: '%v'", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer.Run(ctx)
+		}()
+	}
+
+	return nil
+}
+
+// shutdown waits for in-flight requests to finish, then stops the background goroutines by cancelling their context
+// and waits for them. Each step is limited by the given timeout. It returns whether the background goroutines
+// stopped in time.
+func shutdown(server *web.Server, cancel context.CancelFunc, wg *sync.WaitGroup, timeout time.Duration) bool {
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), timeout)
+	defer cancelShutdown()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Warnf("In-flight requests didn't finish within %v and have been cancelled: %v", timeout, err)
+	}
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Info("Shut down kube eagle")
+		return true
+	case <-time.After(timeout):
+		log.Warnf("Background tasks (e. g. releasing the leader election lease) didn't stop within %v", timeout)
+		return false
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		err := runReport(os.Args[2:])
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize logrus settings
 	log.SetOutput(os.Stdout)
 	log.SetFormatter(&log.JSONFormatter{})
 
-	// Parse & validate environment variable
-	opts := options.NewOptions()
-	err := envconfig.Process("", opts)
+	// Parse & validate environment variables, config file and flags
+	opts, err := options.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("could not load configuration: '%v'", err)
+	}
+	err = opts.Validate()
 	if err != nil {
-		log.Fatal("Error parsing env vars into opts", err)
+		log.Fatal(err)
+	}
+	if opts.PrintConfig {
+		config, err := opts.ConfigYAML()
+		if err != nil {
+			log.Fatalf("could not print configuration: '%v'", err)
+		}
+		fmt.Print(config)
+		os.Exit(0)
 	}
 
 	// Set log level from environment variable
@@ -46,15 +333,70 @@ func main() {
 
 	// Start kube eagle exporter
 	log.Infof("Starting kube eagle v%v", opts.Version)
-	collector, err := collector.NewKubeEagleCollector(opts)
+	server, err := web.NewServer(opts)
 	if err != nil {
-		log.Fatalf("could not start kube eagle collector: '%v'", err)
+		log.Fatalf("could not configure web server: '%v'", err)
+	}
+	reloader, err := newReloader(os.Args[1:], opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Background goroutines are stopped on shutdown, after in-flight requests have been drained
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reloader.Run(ctx, opts.ConfigReloadInterval)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.Run(ctx)
+	}()
+
+	var leaderElector *kubernetes.LeaderElector
+	if opts.LeaderElection {
+		client, err := kubernetes.NewLeaderElectionClient(opts)
+		if err != nil {
+			log.Fatalf("could not initialize kubernetes client for the leader election: '%v'", err)
+		}
+		leaderElector, err = startLeaderElection(ctx, &wg, client, opts)
+		if err != nil {
+			log.Fatalf("could not start leader election: '%v'", err)
+		}
+	}
+
+	err = startWorkers(ctx, &wg, reloader, leaderElector, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Health endpoints don't require authentication, so that they can be used by Kubernetes probes
+	var proxy *leaderProxy
+	if leaderElector != nil {
+		proxy = newLeaderProxy(leaderElector, server)
+	}
+	http.Handle("/metrics", server.Authenticated(metricsHandler(reloader, proxy, opts)))
+	http.Handle(api.Prefix, server.Authenticated(apiHandler(reloader, proxy)))
+	http.Handle("/healthz", healthz())
+	http.Handle("/readyz", readyz(reloader))
+	// Deprecated: /health is kept for existing liveness probes
+	http.Handle("/health", healthz())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe(http.DefaultServeMux)
+	}()
+	select {
+	case err = <-serverErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Infof("Received %v, shutting down", sig)
 	}
-	prometheus.MustRegister(collector)
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/health", healthcheck(collector))
-	address := fmt.Sprintf("%v:%s", opts.Host, strconv.Itoa(opts.Port))
-	log.Info("Listening on ", address)
-	log.Fatal(http.ListenAndServe(address, nil))
+	shutdown(server, cancel, &wg, opts.ShutdownTimeout)
 }
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/api"
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/internal/certtest"
+	"github.com/google-cloud-tools/kube-eagle/internal/kubetest"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/google-cloud-tools/kube-eagle/web"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kube-eagle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// fakeLeadership is the state of a leader election this replica doesn't lead
+type fakeLeadership struct {
+	leader string
+}
+
+func (l *fakeLeadership) IsLeader() bool   { return false }
+func (l *fakeLeadership) Leader() string   { return l.leader }
+func (l *fakeLeadership) Identity() string { return "10.0.0.2:8080" }
+
+// fakeLeader is a leader stand-in, which records the requests proxied to it
+type fakeLeader struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests []*http.Request
+}
+
+// newFakeLeader starts a leader, which serves HTTPS with the given certificate if it isn't nil. If the client CA isn't
+// nil either, it requires client certificates issued by it.
+func newFakeLeader(t *testing.T, cert *certtest.Certificate, clientCA *certtest.Certificate) *fakeLeader {
+	l := &fakeLeader{}
+	l.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mutex.Lock()
+		l.requests = append(l.requests, r)
+		l.mutex.Unlock()
+		w.Write([]byte("served by the leader"))
+	}))
+	// Failed handshakes are expected by some tests and logged by the follower already
+	l.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	if cert != nil {
+		l.TLS = &tls.Config{Certificates: []tls.Certificate{cert.TLS}}
+		if clientCA != nil {
+			l.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+			l.TLS.ClientCAs = clientCA.Pool()
+		}
+		l.StartTLS()
+	} else {
+		l.Start()
+	}
+	t.Cleanup(l.Close)
+	return l
+}
+
+// address returns the leader's address, which is its identity in the lease
+func (l *fakeLeader) address() string {
+	return strings.TrimPrefix(strings.TrimPrefix(l.URL, "http://"), "https://")
+}
+
+// newTestFollower creates the handlers of a follower which proxies to the given leader. It serves HTTPS with the
+// given certificate if it isn't nil.
+func newTestFollower(t *testing.T, leader string, cert *certtest.Certificate, flags ...string) (metrics http.Handler, apiRequests http.Handler) {
+	t.Helper()
+	if cert != nil {
+		webConfigFile := filepath.Join(tempDir(t), "web-config.yml")
+		webConfig := "tls_server_config:\n  cert_file: " + cert.CertFile + "\n  key_file: " + cert.KeyFile + "\n"
+		if err := ioutil.WriteFile(webConfigFile, []byte(webConfig), 0600); err != nil {
+			t.Fatal(err)
+		}
+		flags = append(flags, "--web-config-file", webConfigFile)
+	}
+	opts, err := options.Load(append([]string{"--version", "test"}, flags...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	server, err := web.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := newLeaderProxy(&fakeLeadership{leader: leader}, server)
+	// Followers never access the reloader, as only the leader collects metrics
+	return metricsHandler(nil, proxy, opts), apiHandler(nil, proxy)
+}
+
+func serve(handler http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestFollowerProxiesToLeader(t *testing.T) {
+	cert := certtest.Write(t, tempDir(t), "kube-eagle", nil)
+	tests := []struct {
+		name string
+		cert *certtest.Certificate
+	}{
+		{name: "HTTP"},
+		{name: "HTTPS", cert: cert},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			leader := newFakeLeader(t, test.cert, nil)
+			metrics, apiRequests := newTestFollower(t, leader.address(), test.cert)
+
+			header := http.Header{"Authorization": {"Bearer token"}}
+			requests := []struct {
+				handler http.Handler
+				path    string
+			}{
+				{handler: metrics, path: "/metrics"},
+				{handler: apiRequests, path: api.Prefix + "pods?cluster=a"},
+			}
+			for _, request := range requests {
+				response := serve(request.handler, request.path, header)
+				if response.Code != http.StatusOK || response.Body.String() != "served by the leader" {
+					t.Errorf("%s: response %d %q, expected the leader's response", request.path, response.Code, response.Body.String())
+				}
+			}
+
+			if len(leader.requests) != 2 {
+				t.Fatalf("leader got %d requests, expected 2", len(leader.requests))
+			}
+			for i, req := range leader.requests {
+				if uri := req.URL.RequestURI(); uri != requests[i].path {
+					t.Errorf("leader got request for %s, expected %s", uri, requests[i].path)
+				}
+				// The leader authenticates proxied requests just like the follower
+				if authorization := req.Header.Get("Authorization"); authorization != "Bearer token" {
+					t.Errorf("%s: Authorization = %q, expected the client's credentials", req.URL, authorization)
+				}
+				if proxiedBy := req.Header.Get(proxiedByHeader); proxiedBy != "10.0.0.2:8080" {
+					t.Errorf("%s: %s = %q, expected the follower's identity", req.URL, proxiedByHeader, proxiedBy)
+				}
+			}
+		})
+	}
+}
+
+func TestFollowerVerifiesLeaderCertificate(t *testing.T) {
+	dir := tempDir(t)
+	cert := certtest.Write(t, dir, "kube-eagle", nil)
+	// The certificate is valid for the leader's address, but it's not the certificate the replicas share
+	other := certtest.Write(t, dir, "other", nil)
+	leader := newFakeLeader(t, other, nil)
+	metrics, apiRequests := newTestFollower(t, leader.address(), cert)
+
+	header := http.Header{"Authorization": {"Bearer token"}}
+	for _, response := range []*httptest.ResponseRecorder{serve(metrics, "/metrics", header), serve(apiRequests, api.Prefix+"pods", header)} {
+		if response.Code != http.StatusBadGateway {
+			t.Errorf("response status = %d, expected 502", response.Code)
+		}
+	}
+	if len(leader.requests) != 0 {
+		t.Errorf("leader got %d requests, expected none as the TLS handshake must fail", len(leader.requests))
+	}
+}
+
+func TestFollowerPresentsClientCertificate(t *testing.T) {
+	dir := tempDir(t)
+	clientCA := certtest.Write(t, dir, "client-ca", nil)
+	tests := []struct {
+		name               string
+		cert               *certtest.Certificate
+		expectedStatusCode int
+	}{
+		// Replicas present their shared server certificate, which the leader accepts if it's issued by its client CA
+		{name: "issued by the client CA", cert: certtest.Write(t, dir, "kube-eagle", clientCA), expectedStatusCode: http.StatusOK},
+		{name: "self-signed", cert: certtest.Write(t, dir, "self-signed", nil), expectedStatusCode: http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			leader := newFakeLeader(t, test.cert, clientCA)
+			metrics, _ := newTestFollower(t, leader.address(), test.cert)
+			if response := serve(metrics, "/metrics", nil); response.Code != test.expectedStatusCode {
+				t.Errorf("response status = %d, expected %d", response.Code, test.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestFollowerWithoutLeader(t *testing.T) {
+	leader := newFakeLeader(t, nil, nil)
+	tests := []struct {
+		name   string
+		leader string
+		flags  []string
+		header http.Header
+	}{
+		{name: "empty follower mode", leader: leader.address(), flags: []string{"--leader-election-follower-mode", "empty"}},
+		{name: "unknown leader", leader: ""},
+		// The leader changed, but the replica which proxied the request doesn't know yet
+		{name: "proxied request", leader: leader.address(), header: http.Header{proxiedByHeader: {"10.0.0.3:8080"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics, apiRequests := newTestFollower(t, test.leader, nil, test.flags...)
+
+			// Followers expose their own metrics only, e. g. of the Go runtime
+			response := serve(metrics, "/metrics", test.header)
+			if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "go_goroutines") ||
+				strings.Contains(response.Body.String(), "served by the leader") {
+				t.Errorf("/metrics: response %d %q, expected the follower's own metrics", response.Code, response.Body.String())
+			}
+
+			// The follower mode applies to /metrics only, API requests are proxied if possible
+			expectedStatusCode := http.StatusServiceUnavailable
+			if test.leader != "" && test.header == nil {
+				expectedStatusCode = http.StatusOK
+			}
+			response = serve(apiRequests, api.Prefix+"pods", test.header)
+			if response.Code != expectedStatusCode {
+				t.Errorf("%s: response status = %d, expected %d", api.Prefix, response.Code, expectedStatusCode)
+			}
+		})
+	}
+	if len(leader.requests) != 1 {
+		t.Errorf("leader got %d requests, expected 1", len(leader.requests))
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	dir := tempDir(t)
+	for _, cluster := range []string{"healthy", "broken"} {
+		server := kubetest.NewServer(kubetest.Fixture())
+		t.Cleanup(server.Close)
+		server.SetUnavailable(cluster == "broken")
+		if err := server.WriteKubeconfig(filepath.Join(dir, cluster+".yaml"), cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name               string
+		flags              []string
+		expectedStatusCode int
+		expectedStatus     string
+	}{
+		{name: "defaults", expectedStatusCode: http.StatusOK, expectedStatus: collector.CheckStatusOk},
+		{name: "all clusters required", flags: []string{"--readiness-require-all-clusters=true"}, expectedStatusCode: http.StatusServiceUnavailable, expectedStatus: collector.CheckStatusFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := options.Load(append([]string{"--version", "test", "--kubeconfig-dir", dir}, test.flags...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients, err := kubernetes.NewClients(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			eagleCollector, err := collector.New(clients, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response := serve(readyz(&reloader{collector: eagleCollector}), "/readyz", nil)
+			if response.Code != test.expectedStatusCode {
+				t.Errorf("response status = %d, expected %d", response.Code, test.expectedStatusCode)
+			}
+			// Errors are only logged, as they contain e. g. the API server's address
+			if body := response.Body.String(); strings.Contains(body, "127.0.0.1") || strings.Contains(body, "unable to handle") {
+				t.Errorf("response contains error details: %s", body)
+			}
+
+			// The broken cluster is reported in any case
+			var health healthResponse
+			if err = json.Unmarshal(response.Body.Bytes(), &health); err != nil {
+				t.Fatal(err)
+			}
+			statusByCluster := make(map[string]string)
+			for _, cluster := range health.Clusters {
+				statusByCluster[cluster.Cluster] = cluster.Status
+				if len(cluster.Checks) != 3 {
+					t.Errorf("cluster %s has %d checks, expected 3", cluster.Cluster, len(cluster.Checks))
+				}
+			}
+			expected := map[string]string{"healthy": collector.CheckStatusOk, "broken": collector.CheckStatusFailed}
+			if health.Status != test.expectedStatus || !reflect.DeepEqual(statusByCluster, expected) {
+				t.Errorf("response = %+v, expected status %s and cluster statuses %v", health, test.expectedStatus, expected)
+			}
+		})
+	}
+}
+
+func TestReloadRefusesRestartRequiredChanges(t *testing.T) {
+	dir := tempDir(t)
+	server := kubetest.NewServer(kubetest.Fixture())
+	t.Cleanup(server.Close)
+	if err := server.WriteKubeconfig(filepath.Join(dir, "a.yaml"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(tempDir(t), "config.yml")
+	config := "kubeconfig_dir: " + dir + "\nmetrics_namespace: eagle\ntelemetry_port: 8080\notlp_headers: [a=b]\n"
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--version", "test", "--config-file", configFile}
+	opts, err := options.Load(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newReloader(args, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousCollector := r.Collector()
+	previousHashes := configHashes(t, r)
+	if len(previousHashes) != 1 || len(previousHashes[0]) != 64 {
+		t.Errorf("config info hashes = %v, expected a single SHA-256 hash", previousHashes)
+	}
+
+	config = "kubeconfig_dir: " + dir + "\nmetrics_namespace: changed\ntelemetry_port: 9090\notlp_headers: [a=c]\n" +
+		"readiness_max_scrape_age: 1m\ncollector_max_series: 1000\n"
+	if err = ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r.reload(false)
+
+	// The other changes are applied
+	if r.Collector() == previousCollector {
+		t.Errorf("the collector hasn't been rebuilt")
+	}
+	if r.opts.ReadinessMaxScrapeAge != time.Minute || r.opts.CollectorMaxSeries != 1000 {
+		t.Errorf("options = %+v, expected the changed readiness max scrape age and max series", r.opts)
+	}
+	// The changes which require a restart are refused, including the metrics namespace of the rebuilt collector
+	if r.opts.Namespace != "eagle" || r.opts.Port != 8080 || !reflect.DeepEqual(r.opts.OTLPHeaders, []string{"a=b"}) {
+		t.Errorf("options = %+v, expected the previous metrics namespace, port and OTLP headers", r.opts)
+	}
+	families, err := r.Gatherer(context.Background()).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasCollectorMetrics := false
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), "changed_") {
+			t.Errorf("the rebuilt collector exposes %s, expected the previous metrics namespace", family.GetName())
+		}
+		if strings.HasPrefix(family.GetName(), "eagle_pod_") {
+			hasCollectorMetrics = true
+		}
+	}
+	if !hasCollectorMetrics {
+		t.Errorf("the rebuilt collector doesn't expose any pod metrics")
+	}
+	// Only the hash of the reloaded configuration is exposed
+	if hashes := configHashes(t, r); len(hashes) != 1 || hashes[0] == previousHashes[0] {
+		t.Errorf("config info hashes after reload = %v, expected a single hash other than %v", hashes, previousHashes)
+	}
+}
+
+func TestCollectorGatherer(t *testing.T) {
+	server := kubetest.NewServer(kubetest.Fixture())
+	t.Cleanup(server.Close)
+	dir := tempDir(t)
+	if err := server.WriteKubeconfig(filepath.Join(dir, "a.yaml"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := options.Load([]string{"--version", "test", "--kubeconfig-dir", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eagleCollector, err := newEagleCollector(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &reloader{collector: eagleCollector}
+
+	// The OTLP push only contains the collector's metrics, unlike /metrics
+	for _, test := range []struct {
+		gatherer         prometheus.Gatherer
+		expectsGoRuntime bool
+	}{
+		{gatherer: r.CollectorGatherer(context.Background()), expectsGoRuntime: false},
+		{gatherer: r.Gatherer(context.Background()), expectsGoRuntime: true},
+	} {
+		families, err := test.gatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]bool)
+		for _, family := range families {
+			names[family.GetName()] = true
+			if !test.expectsGoRuntime && !strings.HasPrefix(family.GetName(), "eagle_") {
+				t.Errorf("collector gatherer returned %s, expected only kube eagle metrics", family.GetName())
+			}
+		}
+		if !names["eagle_scrape_cluster_success"] {
+			t.Errorf("gatherer didn't return the collector's metrics: %v", names)
+		}
+		if names["go_goroutines"] != test.expectsGoRuntime {
+			t.Errorf("gatherer returned go_goroutines %v, expected %v", names["go_goroutines"], test.expectsGoRuntime)
+		}
+	}
+}
+
+// configHashes returns the hash labels of the reloader's config info metric
+func configHashes(t *testing.T, r *reloader) []string {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(r.configInfo)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, family := range families {
+		for _, m := range family.Metric {
+			if m.GetGauge().GetValue() != 1 {
+				t.Errorf("config info = %v, expected 1", m.GetGauge().GetValue())
+			}
+			for _, label := range m.Label {
+				hashes = append(hashes, label.GetValue())
+			}
+		}
+	}
+	return hashes
+}
+
+func TestRefuseRestartRequired(t *testing.T) {
+	previous, err := options.Load([]string{"--version", "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := options.Load([]string{"--version", "test", "--leader-election-retry-period", "5s", "--web-reload-interval", "1m",
+		"--log-level", "debug", "--openmetrics=false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := refuseRestartRequired(previous, next)
+	if expected := []string{"LEADER_ELECTION_*", "OPENMETRICS", "WEB_*"}; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("changed = %v, expected %v", changed, expected)
+	}
+	next.LogLevel = previous.LogLevel
+	if !reflect.DeepEqual(previous, next) {
+		t.Errorf("options after refusing the changes = %+v, expected %+v", next, previous)
+	}
+}
+
+// countingHandler counts the requests it receives and answers them with the given status code
+type countingHandler struct {
+	statusCode int
+	count      int32
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.count, 1)
+	w.WriteHeader(h.statusCode)
+}
+
+func (h *countingHandler) requests() int32 {
+	return atomic.LoadInt32(&h.count)
+}
+
+func TestShutdownStopsWorkers(t *testing.T) {
+	server := kubetest.NewServer(kubetest.Fixture())
+	t.Cleanup(server.Close)
+	kubeconfigDir := tempDir(t)
+	if err := server.WriteKubeconfig(filepath.Join(kubeconfigDir, "a.yaml"), "a"); err != nil {
+		t.Fatal(err)
+	}
+	otlpReceiver := &countingHandler{statusCode: http.StatusOK}
+	otlpServer := httptest.NewServer(otlpReceiver)
+	t.Cleanup(otlpServer.Close)
+	remoteWriteReceiver := &countingHandler{statusCode: http.StatusNoContent}
+	remoteWriteServer := httptest.NewServer(remoteWriteReceiver)
+	t.Cleanup(remoteWriteServer.Close)
+	exportDir := tempDir(t)
+
+	opts, err := options.Load([]string{"--version", "test", "--kubeconfig-dir", kubeconfigDir,
+		"--leader-election", "--leader-election-namespace", "default", "--leader-election-identity", "10.0.0.1:8080",
+		"--leader-election-lease-duration", "2s", "--leader-election-renew-deadline", "1s", "--leader-election-retry-period", "50ms",
+		"--export-interval", "50ms", "--export-directory", exportDir,
+		"--otlp-endpoint", otlpServer.URL, "--otlp-protocol", "http/protobuf", "--otlp-interval", "50ms",
+		"--remote-write-url", remoteWriteServer.URL, "--remote-write-interval", "50ms",
+		"--shutdown-timeout", "5s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := kubernetes.NewClients(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eagleCollector, err := collector.New(clients, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webServer, err := web.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wg := sync.WaitGroup{}
+	leaseClient, err := kubernetes.NewLeaderElectionClient(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaderElector, err := startLeaderElection(ctx, &wg, leaseClient, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = startWorkers(ctx, &wg, &reloader{collector: eagleCollector}, leaderElector, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait until the replica leads and all workers did their work at least once
+	isWorking := func() bool {
+		files, _ := ioutil.ReadDir(exportDir)
+		return leaderElector.IsLeader() && len(files) > 0 && otlpReceiver.requests() > 0 && remoteWriteReceiver.requests() > 0
+	}
+	for begin := time.Now(); !isWorking(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(begin) > 10*time.Second {
+			t.Fatalf("workers didn't start working (leader %v, OTLP pushes %d, remote writes %d)", leaderElector.IsLeader(),
+				otlpReceiver.requests(), remoteWriteReceiver.requests())
+		}
+	}
+
+	if !shutdown(webServer, cancel, &wg, opts.ShutdownTimeout) {
+		t.Fatalf("workers didn't stop within the shutdown timeout")
+	}
+	if lease, exists := server.Lease("default", "kube-eagle"); !exists || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "" {
+		t.Errorf("lease = %+v, expected it to be released", lease)
+	}
+	files, err := ioutil.ReadDir(exportDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otlpPushes, remoteWrites := otlpReceiver.requests(), remoteWriteReceiver.requests()
+	time.Sleep(200 * time.Millisecond)
+	if actual, _ := ioutil.ReadDir(exportDir); len(actual) != len(files) {
+		t.Errorf("exported %d files after shutdown, expected %d", len(actual), len(files))
+	}
+	if otlpReceiver.requests() != otlpPushes || remoteWriteReceiver.requests() != remoteWrites {
+		t.Errorf("workers kept pushing after shutdown")
+	}
+}
@@ -0,0 +1,181 @@
+// Package openmetrics serves the gathered metrics in the OpenMetrics text format (https://openmetrics.io), which the
+// vendored Prometheus client does not support yet
+package openmetrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ContentType is the content type of the encoded metrics
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Metric types of OpenMetrics. Prometheus metric families lack the info and stateset types, Prometheus maps both to
+// gauges: info metrics are gauges named *_info whose values are 1, statesets are gauges which have a label named after
+// the metric and whose values are 0 or 1.
+const (
+	TypeInfo     = "info"
+	TypeStateSet = "stateset"
+
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+	typeSummary   = "summary"
+	typeUnknown   = "unknown"
+)
+
+// Encode writes the metric families in the OpenMetrics text format, including the terminating "# EOF" line. The types
+// map the names of gauge families to TypeInfo or TypeStateSet, all other families are written with their own type.
+func Encode(w io.Writer, families []*dto.MetricFamily, types map[string]string) error {
+	names := make(map[string]bool, len(families))
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	bw := bufio.NewWriter(w)
+	for _, family := range families {
+		encodeFamily(bw, family, familyType(family, types), names)
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// encodeFamily writes a single metric family. The names of all families are required, as the family names of
+// counters and info metrics lack their suffix. If that name is already taken (e. g. by the gauge go_memstats_alloc_bytes),
+// counters are written as unknown metrics and info metrics as gauges.
+func encodeFamily(w *bufio.Writer, family *dto.MetricFamily, metricType string, names map[string]bool) {
+	name := family.GetName()
+	familyName := name
+	switch metricType {
+	case typeCounter:
+		familyName = strings.TrimSuffix(name, "_total")
+		if names[familyName] {
+			metricType, familyName = typeUnknown, name
+		}
+	case TypeInfo:
+		familyName = strings.TrimSuffix(name, "_info")
+		if names[familyName] {
+			metricType, familyName = typeGauge, name
+		}
+	}
+
+	w.WriteString("# TYPE " + familyName + " " + metricType + "\n")
+	if family.GetHelp() != "" {
+		w.WriteString("# HELP " + familyName + " " + escape(family.GetHelp()) + "\n")
+	}
+	for _, m := range family.Metric {
+		switch metricType {
+		case typeCounter:
+			writeSample(w, familyName+"_total", m, "", "", m.GetCounter().GetValue())
+		case typeGauge, TypeInfo, TypeStateSet:
+			writeSample(w, name, m, "", "", m.GetGauge().GetValue())
+		case typeHistogram:
+			h := m.GetHistogram()
+			hasInf := false
+			for _, bucket := range h.Bucket {
+				hasInf = hasInf || math.IsInf(bucket.GetUpperBound(), 1)
+				writeSample(w, familyName+"_bucket", m, "le", formatBound(bucket.GetUpperBound()), float64(bucket.GetCumulativeCount()))
+			}
+			if !hasInf {
+				writeSample(w, familyName+"_bucket", m, "le", "+Inf", float64(h.GetSampleCount()))
+			}
+			writeSample(w, familyName+"_count", m, "", "", float64(h.GetSampleCount()))
+			writeSample(w, familyName+"_sum", m, "", "", h.GetSampleSum())
+		case typeSummary:
+			s := m.GetSummary()
+			for _, q := range s.Quantile {
+				writeSample(w, familyName, m, "quantile", formatBound(q.GetQuantile()), q.GetValue())
+			}
+			writeSample(w, familyName+"_count", m, "", "", float64(s.GetSampleCount()))
+			writeSample(w, familyName+"_sum", m, "", "", s.GetSampleSum())
+		default:
+			writeSample(w, name, m, "", "", untypedValue(family.GetType(), m))
+		}
+	}
+}
+
+// familyType returns the OpenMetrics type of the metric family. Gauges are info metrics or statesets if the types say
+// so, info metrics must be named *_info though.
+func familyType(family *dto.MetricFamily, types map[string]string) string {
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		return typeCounter
+	case dto.MetricType_HISTOGRAM:
+		return typeHistogram
+	case dto.MetricType_SUMMARY:
+		return typeSummary
+	case dto.MetricType_UNTYPED:
+		return typeUnknown
+	}
+
+	switch types[family.GetName()] {
+	case TypeInfo:
+		if strings.HasSuffix(family.GetName(), "_info") && len(family.GetName()) > len("_info") {
+			return TypeInfo
+		}
+	case TypeStateSet:
+		return TypeStateSet
+	}
+	return typeGauge
+}
+
+// untypedValue returns the value of counters and untyped metrics which are written as unknown metrics
+func untypedValue(metricType dto.MetricType, m *dto.Metric) float64 {
+	if metricType == dto.MetricType_COUNTER {
+		return m.GetCounter().GetValue()
+	}
+	return m.GetUntyped().GetValue()
+}
+
+// writeSample writes a single sample line, the extra label (e. g. le of histogram buckets) is omitted if its name is empty
+func writeSample(w *bufio.Writer, name string, m *dto.Metric, extraName string, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(m.Label) > 0 || extraName != "" {
+		w.WriteByte('{')
+		separator := ""
+		for _, l := range m.Label {
+			w.WriteString(separator + l.GetName() + `="` + escape(l.GetValue()) + `"`)
+			separator = ","
+		}
+		if extraName != "" {
+			w.WriteString(separator + extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatFloat(value))
+	if m.TimestampMs != nil {
+		// OpenMetrics timestamps are in seconds
+		w.WriteString(" " + strconv.FormatFloat(float64(m.GetTimestampMs())/1000, 'f', -1, 64))
+	}
+	w.WriteByte('\n')
+}
+
+// escape escapes label values and help texts
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// formatBound formats bucket bounds and quantiles in their canonical form, i. e. integers have a ".0" suffix
+func formatBound(f float64) string {
+	s := formatFloat(f)
+	if strings.ContainsAny(s, ".eIN") {
+		return s
+	}
+	return s + ".0"
+}
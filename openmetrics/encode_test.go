@@ -0,0 +1,99 @@
+package openmetrics
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func label(name string, value string) *dto.LabelPair {
+	return &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
+
+func gauge(value float64, labels ...*dto.LabelPair) *dto.Metric {
+	return &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+}
+
+func family(name string, metricType dto.MetricType, help string, metrics ...*dto.Metric) *dto.MetricFamily {
+	return &dto.MetricFamily{Name: proto.String(name), Help: proto.String(help), Type: metricType.Enum(), Metric: metrics}
+}
+
+// testFamilies covers all metric types, including the corner cases of family names and values
+func testFamilies() []*dto.MetricFamily {
+	return []*dto.MetricFamily{
+		family("eagle_pod_info", dto.MetricType_GAUGE, "Information about a pod",
+			gauge(1, label("namespace", "default"), label("pod", "web-1")),
+			gauge(1, label("namespace", "default"), label("pod", `quoted "pod"`))),
+		family("eagle_pod_phase", dto.MetricType_GAUGE, "The pod's current phase",
+			gauge(0, label("eagle_pod_phase", "Pending"), label("pod", "web-1")),
+			gauge(1, label("eagle_pod_phase", "Running"), label("pod", "web-1"))),
+		// Looks like an info metric and a stateset, but isn't declared as one
+		family("eagle_build_info", dto.MetricType_GAUGE, "Not declared", gauge(1, label("version", "1.0"))),
+		family("eagle_enabled", dto.MetricType_GAUGE, "Not declared", gauge(1, label("eagle_enabled", "true"))),
+		// Declared as info metric, but not named *_info
+		family("eagle_misnamed", dto.MetricType_GAUGE, "Misnamed", gauge(1)),
+		family("eagle_memory_bytes", dto.MetricType_GAUGE, "Help with\nnewline and \\ backslash", gauge(1.5e9)),
+		family("eagle_requests_total", dto.MetricType_COUNTER, "Counter",
+			&dto.Metric{Label: []*dto.LabelPair{label("code", "200")}, Counter: &dto.Counter{Value: proto.Float64(42)}, TimestampMs: proto.Int64(1600000000123)}),
+		// The family name eagle_memory_bytes is already taken by the gauge
+		family("eagle_memory_bytes_total", dto.MetricType_COUNTER, "Colliding counter", &dto.Metric{Counter: &dto.Counter{Value: proto.Float64(1)}}),
+		family("eagle_duration_seconds", dto.MetricType_HISTOGRAM, "Histogram", &dto.Metric{Histogram: &dto.Histogram{
+			SampleCount: proto.Uint64(3),
+			SampleSum:   proto.Float64(2.5),
+			Bucket: []*dto.Bucket{
+				{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(1)},
+				{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+			},
+		}}),
+		family("eagle_latency_seconds", dto.MetricType_SUMMARY, "", &dto.Metric{Summary: &dto.Summary{
+			SampleCount: proto.Uint64(2),
+			SampleSum:   proto.Float64(math.Inf(1)),
+			Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(math.NaN())}, {Quantile: proto.Float64(1), Value: proto.Float64(3)}},
+		}}),
+		family("eagle_untyped", dto.MetricType_UNTYPED, "Untyped", &dto.Metric{Untyped: &dto.Untyped{Value: proto.Float64(-1)}}),
+	}
+}
+
+func TestEncodeGolden(t *testing.T) {
+	types := map[string]string{
+		"eagle_pod_info":  TypeInfo,
+		"eagle_pod_phase": TypeStateSet,
+		"eagle_misnamed":  TypeInfo,
+	}
+	var buffer bytes.Buffer
+	if err := Encode(&buffer, testFamilies(), types); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join("testdata", "encode.txt")
+	if *update {
+		if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), expected) {
+		t.Errorf("encoded metrics differ from %s (run the tests with -update after verifying the changes):\n%s", path, buffer.String())
+	}
+}
+
+func TestEncodeEmpty(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := Encode(&buffer, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "# EOF\n" {
+		t.Errorf("encoded %q, expected only the EOF line", buffer.String())
+	}
+}
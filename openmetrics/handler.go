@@ -0,0 +1,79 @@
+package openmetrics
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// mediaType is the media type scrapers request OpenMetrics with
+const mediaType = "application/openmetrics-text"
+
+// HandlerFor returns a handler serving the gatherer's metrics. Scrapers which accept OpenMetrics (e. g. Prometheus
+// 2.5+) get the OpenMetrics text format, all others the Prometheus text format served by promhttp. The types are the
+// info metrics and statesets by family name, see Encode.
+func HandlerFor(gatherer prometheus.Gatherer, types map[string]string) http.Handler {
+	fallback := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if !Accepts(r.Header) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		// Like promhttp, any error fails the whole scrape
+		families, err := gatherer.Gather()
+		if err != nil {
+			log.Errorf("Failed to gather metrics: %v", err)
+			http.Error(w, fmt.Sprintf("An error has occurred while serving metrics:\n\n%v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", ContentType)
+		var out io.Writer = w
+		if acceptsGzip(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		err = Encode(out, families, types)
+		if err != nil {
+			log.Warnf("Failed to write metrics: %v", err)
+		}
+	})
+}
+
+// Accepts returns whether the Accept header of a request contains the OpenMetrics text format
+func Accepts(header http.Header) bool {
+	for _, accept := range header["Accept"] {
+		for _, part := range strings.Split(accept, ",") {
+			accepted, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || accepted != mediaType {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsGzip(header http.Header) bool {
+	for _, part := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(part, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
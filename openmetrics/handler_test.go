@@ -0,0 +1,116 @@
+package openmetrics
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestAccepts(t *testing.T) {
+	tests := map[string]bool{
+		"":                             false,
+		"text/plain":                   false,
+		"application/openmetrics-text": true,
+		"application/openmetrics-text; version=1.0.0; charset=utf-8,text/plain;version=0.0.4;q=0.5,*/*;q=0.1": true,
+		"text/plain, application/openmetrics-text;q=0":                                                        false,
+		"application/openmetrics-text-other":                                                                  false,
+	}
+	for accept, expected := range tests {
+		header := http.Header{}
+		if accept != "" {
+			header.Set("Accept", accept)
+		}
+		if actual := Accepts(header); actual != expected {
+			t.Errorf("Accepts(%q) = %v, expected %v", accept, actual, expected)
+		}
+	}
+}
+
+func TestHandlerFor(t *testing.T) {
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{family("eagle_pod_info", dto.MetricType_GAUGE, "Info", gauge(1, label("pod", "web-1")))}, nil
+	})
+	handler := HandlerFor(gatherer, map[string]string{"eagle_pod_info": TypeInfo})
+
+	tests := []struct {
+		name                string
+		accept              string
+		acceptEncoding      string
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			name:                "openmetrics",
+			accept:              "application/openmetrics-text; version=1.0.0",
+			expectedContentType: ContentType,
+			expectedBody:        "# TYPE eagle_pod info\n# HELP eagle_pod Info\neagle_pod_info{pod=\"web-1\"} 1\n# EOF\n",
+		},
+		{
+			name:                "openmetrics gzip",
+			accept:              "application/openmetrics-text",
+			acceptEncoding:      "deflate, gzip;q=1.0",
+			expectedContentType: ContentType,
+			expectedBody:        "# TYPE eagle_pod info\n# HELP eagle_pod Info\neagle_pod_info{pod=\"web-1\"} 1\n# EOF\n",
+		},
+		{
+			name:                "prometheus",
+			accept:              "text/plain",
+			expectedContentType: "text/plain; version=0.0.4; charset=utf-8",
+			expectedBody:        "# HELP eagle_pod_info Info\n# TYPE eagle_pod_info gauge\neagle_pod_info{pod=\"web-1\"} 1\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			request.Header.Set("Accept", test.accept)
+			request.Header.Set("Accept-Encoding", test.acceptEncoding)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+
+			if contentType := recorder.Header().Get("Content-Type"); contentType != test.expectedContentType {
+				t.Errorf("Content-Type = %q, expected %q", contentType, test.expectedContentType)
+			}
+			if vary := recorder.Header().Get("Vary"); vary != "Accept" {
+				t.Errorf("Vary = %q, expected Accept", vary)
+			}
+			body := recorder.Body.String()
+			if test.acceptEncoding != "" {
+				if encoding := recorder.Header().Get("Content-Encoding"); encoding != "gzip" {
+					t.Fatalf("Content-Encoding = %q, expected gzip", encoding)
+				}
+				reader, err := gzip.NewReader(recorder.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				decompressed, err := ioutil.ReadAll(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(decompressed)
+			}
+			if body != test.expectedBody {
+				t.Errorf("body = %q, expected %q", body, test.expectedBody)
+			}
+		})
+	}
+}
+
+func TestHandlerForGatherError(t *testing.T) {
+	failing := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return nil, fmt.Errorf("collector failed")
+	})
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Accept", "application/openmetrics-text")
+	recorder := httptest.NewRecorder()
+	HandlerFor(failing, nil).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusInternalServerError || !strings.Contains(recorder.Body.String(), "collector failed") {
+		t.Errorf("response = %d %q, expected an internal server error", recorder.Code, recorder.Body.String())
+	}
+}
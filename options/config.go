@@ -0,0 +1,338 @@
+package options
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"sigs.k8s.io/yaml"
+)
+
+// Options which only control how the configuration is loaded, thus they can't be set in the config file
+var notInConfigFile = map[string]bool{
+	"CONFIG_FILE":  true,
+	"PRINT_CONFIG": true,
+}
+
+// secretHeaderOptions are lists of key=value headers, whose values usually carry credentials
+var secretHeaderOptions = map[string]bool{
+	"OTLP_HEADERS": true,
+}
+
+// urlOptions are URLs, which may contain a password
+var urlOptions = map[string]bool{
+	"EXPORT_S3_ENDPOINT": true,
+	"OTLP_ENDPOINT":      true,
+	"REMOTE_WRITE_URL":   true,
+}
+
+// secretPlaceholder replaces secrets in the printed configuration
+const secretPlaceholder = "<secret>"
+
+// option is a single configurable field of the options
+type option struct {
+	envName string
+	value   reflect.Value
+	def     string
+}
+
+// fileKey is the option's key in the config file, e. g. kube_api_qps for KUBE_API_QPS
+func (o option) fileKey() string {
+	return strings.ToLower(o.envName)
+}
+
+// flagName is the option's command line flag, e. g. --kube-api-qps for KUBE_API_QPS
+func (o option) flagName() string {
+	return strings.Replace(strings.ToLower(o.envName), "_", "-", -1)
+}
+
+// Load builds the effective options from defaults, environment variables, the YAML config file and command line
+// flags, where each source overrides the previous ones. The config file uses the lower cased environment variable
+// names as keys (e. g. kube_api_qps), the flags use their kebab case (e. g. --kube-api-qps).
+func Load(args []string) (*Options, error) {
+	return LoadWithFlagSet(flag.NewFlagSet("kube-eagle", flag.ContinueOnError), args)
+}
+
+// LoadWithFlagSet is like Load, but registers the option flags in the given flag set, so that callers (e. g.
+// subcommands) can add flags of their own
+func LoadWithFlagSet(flagSet *flag.FlagSet, args []string) (*Options, error) {
+	opts := NewOptions()
+	options := opts.fields()
+
+	// Flags are parsed first, as they may specify the config file, but they are applied last
+	flagValues := make(map[string]string)
+	for _, o := range options {
+		usage := fmt.Sprintf("Overrides %s", o.envName)
+		if o.def != "" {
+			usage = fmt.Sprintf("%s (default %s)", usage, o.def)
+		}
+		flagSet.Var(&flagValue{name: o.envName, kind: o.value.Type(), values: flagValues}, o.flagName(), usage)
+	}
+	err := flagSet.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flagSet.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", flagSet.Args())
+	}
+
+	err = envconfig.Process("", opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse environment variables: %v", err)
+	}
+
+	configFile := opts.ConfigFile
+	if value, exists := flagValues["CONFIG_FILE"]; exists {
+		configFile = value
+	}
+	if configFile != "" {
+		err = opts.loadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config file '%s': %v", configFile, err)
+		}
+	}
+
+	for _, o := range options {
+		if value, exists := flagValues[o.envName]; exists {
+			err = setValue(o.value, value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s' for flag --%s: %v", value, o.flagName(), err)
+			}
+		}
+	}
+
+	return opts, nil
+}
+
+// loadFile overrides the options with all values of the given YAML config file. Unknown keys are rejected, so that
+// typos don't go unnoticed.
+func (o *Options) loadFile(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	err = yaml.Unmarshal(content, &values)
+	if err != nil {
+		return fmt.Errorf("invalid YAML: %v", err)
+	}
+
+	optionByKey := make(map[string]option)
+	for _, opt := range o.fields() {
+		optionByKey[opt.fileKey()] = opt
+	}
+	for key, value := range values {
+		opt, exists := optionByKey[key]
+		if !exists || notInConfigFile[opt.envName] {
+			return fmt.Errorf("unknown option '%s'", key)
+		}
+		stringValue, err := fileValueToString(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for '%s': %v", key, err)
+		}
+		err = setValue(opt.value, stringValue)
+		if err != nil {
+			return fmt.Errorf("invalid value '%s' for '%s': %v", stringValue, key, err)
+		}
+	}
+
+	return nil
+}
+
+// ConfigYAML returns the effective options in the config file format. Secrets, i. e. header values and passwords in
+// URLs, are redacted, so that the configuration can be printed and logged safely.
+func (o *Options) ConfigYAML() (string, error) {
+	values := make(map[string]interface{})
+	for _, opt := range o.fields() {
+		if notInConfigFile[opt.envName] {
+			continue
+		}
+		value := opt.value
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+		switch v := value.Interface().(type) {
+		case time.Duration:
+			values[opt.fileKey()] = v.String()
+		case []string:
+			if v == nil {
+				v = []string{}
+			}
+			if secretHeaderOptions[opt.envName] {
+				v = redactHeaders(v)
+			}
+			values[opt.fileKey()] = v
+		case string:
+			if urlOptions[opt.envName] {
+				v = redactURL(v)
+			}
+			values[opt.fileKey()] = v
+		default:
+			values[opt.fileKey()] = v
+		}
+	}
+
+	out, err := yaml.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// redactHeaders replaces the values of the key=value headers
+func redactHeaders(headers []string) []string {
+	redacted := make([]string, len(headers))
+	for i, header := range headers {
+		redacted[i] = strings.SplitN(header, "=", 2)[0] + "=" + secretPlaceholder
+	}
+	return redacted
+}
+
+// redactURL replaces the URL's password. URLs which can't be parsed are replaced completely, as their password can't
+// be located.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return secretPlaceholder
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return rawURL
+	}
+	// The placeholder is inserted after encoding, as url.UserPassword would escape it
+	u.User = url.UserPassword(u.User.Username(), "redacted")
+	return strings.Replace(u.String(), ":redacted@", ":"+secretPlaceholder+"@", 1)
+}
+
+// fields returns all options which can be set by an environment variable
+func (o *Options) fields() []option {
+	var options []option
+	value := reflect.ValueOf(o).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		envName := field.Tag.Get("envconfig")
+		if envName == "" {
+			continue
+		}
+		options = append(options, option{envName: envName, value: value.Field(i), def: field.Tag.Get("default")})
+	}
+
+	return options
+}
+
+// fileValueToString converts a YAML value into the string representation used by environment variables, so that
+// all sources are parsed the same way
+func fileValueToString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := fileValueToString(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list items must not contain commas")
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+// setValue parses the given string into the option's value
+func setValue(value reflect.Value, s string) error {
+	if _, isDuration := value.Interface().(time.Duration); isDuration {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr:
+		ptr := reflect.New(value.Type().Elem())
+		err := setValue(ptr.Elem(), s)
+		if err != nil {
+			return err
+		}
+		value.Set(ptr)
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetInt(i)
+	case reflect.Float32:
+		f, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Slice:
+		items := []string{}
+		if s != "" {
+			items = strings.Split(s, ",")
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported option type %s", value.Type())
+	}
+
+	return nil
+}
+
+// flagValue records the values of command line flags, so that they can be applied after the config file
+type flagValue struct {
+	name   string
+	kind   reflect.Type
+	values map[string]string
+}
+
+// String implements the flag.Value interface
+func (f *flagValue) String() string {
+	if f == nil || f.values == nil {
+		return ""
+	}
+	return f.values[f.name]
+}
+
+// Set implements the flag.Value interface
+func (f *flagValue) Set(value string) error {
+	f.values[f.name] = value
+	return nil
+}
+
+// IsBoolFlag allows boolean flags to be set without a value (e. g. --print-config)
+func (f *flagValue) IsBoolFlag() bool {
+	return f.kind.Kind() == reflect.Bool || (f.kind.Kind() == reflect.Ptr && f.kind.Elem().Kind() == reflect.Bool)
+}
@@ -1,21 +1,203 @@
 package options
 
-// Options are configuration options that can be set by Environment Variables
+import "time"
+
+// Options are configuration options that can be set by Environment Variables, a YAML config file or command line
+// flags (see Load)
 type Options struct {
 	// General
-	Version string `envconfig:"VERSION" required:"true"`
+	// ConfigFile - Path of a YAML config file, which overrides the environment variables
+	// PrintConfig - Whether to print the effective configuration and exit
+	// ConfigReloadInterval - Interval in which the config file is checked for changes, 0 disables the check (the
+	// configuration can still be reloaded by sending SIGHUP)
+	Version              string        `envconfig:"VERSION"`
+	ConfigFile           string        `envconfig:"CONFIG_FILE"`
+	PrintConfig          bool          `envconfig:"PRINT_CONFIG" default:"false"`
+	ConfigReloadInterval time.Duration `envconfig:"CONFIG_RELOAD_INTERVAL" default:"30s"`
 
 	// Kubernetes
-	// IsInCluster - Whether to use in cluster communication (if deployed inside of Kubernetes) or to look for a kubeconfig in home directory
-	IsInCluster bool `envconfig:"IS_IN_CLUSTER" default:"true"`
+	// IsInCluster - Whether to use in cluster communication (if deployed inside of Kubernetes) or to look for a kubeconfig.
+	// Auto detected if not set.
+	// KubeConfig - Path (or list of paths separated by the OS path list separator) of the kubeconfig files to use
+	// KubeContext - Kubeconfig context to use, defaults to the kubeconfig's current context
+	// ClusterName - Value of the cluster label when kube eagle monitors a single cluster
+	// KubeContexts - Kubeconfig contexts of all clusters which shall be monitored (multi cluster mode)
+	// KubeConfigDir - Directory containing one kubeconfig per cluster which shall be monitored (multi cluster mode)
+	IsInCluster   *bool    `envconfig:"IS_IN_CLUSTER"`
+	KubeConfig    string   `envconfig:"KUBECONFIG"`
+	KubeContext   string   `envconfig:"KUBE_CONTEXT"`
+	ClusterName   string   `envconfig:"CLUSTER_NAME" default:""`
+	KubeContexts  []string `envconfig:"KUBE_CONTEXTS"`
+	KubeConfigDir string   `envconfig:"KUBECONFIG_DIR"`
+
+	// Kubernetes API client
+	// APIQPS - Maximum number of queries per second against the Kubernetes API (per cluster)
+	// APIBurst - Maximum burst of queries against the Kubernetes API (per cluster)
+	// APITimeout - Timeout of a single request against the Kubernetes API
+	APIQPS     float32       `envconfig:"KUBE_API_QPS" default:"5"`
+	APIBurst   int           `envconfig:"KUBE_API_BURST" default:"10"`
+	APITimeout time.Duration `envconfig:"KUBE_API_TIMEOUT" default:"30s"`
+	// APIListPageSize - Maximum number of objects per LIST request, 0 disables pagination
+	// APIListFromCache - Whether LIST requests shall be served from the API server's watch cache (resourceVersion 0).
+	// The API server ignores the page size for such requests.
+	APIListPageSize  int64 `envconfig:"KUBE_API_LIST_PAGE_SIZE" default:"500"`
+	APIListFromCache bool  `envconfig:"KUBE_API_LIST_FROM_CACHE" default:"false"`
+	// SnapshotMinInterval - Minimum interval between two fetches of a cluster's objects, scrapes within this interval
+	// reuse the previous snapshot. Concurrent scrapes always share one fetch.
+	SnapshotMinInterval time.Duration `envconfig:"SNAPSHOT_MIN_INTERVAL" default:"0s"`
+
+	// Namespace scoping
+	// IncludeNamespaces - Namespaces to monitor, all namespaces if empty. Namespaced resources are listed per namespace
+	// so that kube eagle only needs permissions in these namespaces.
+	// ExcludeNamespaces - Namespaces which shall not be monitored
+	// NamespaceLabelSelector - Label selector of the namespaces to monitor (requires permissions to list namespaces)
+	IncludeNamespaces      []string `envconfig:"INCLUDE_NAMESPACES"`
+	ExcludeNamespaces      []string `envconfig:"EXCLUDE_NAMESPACES"`
+	NamespaceLabelSelector string   `envconfig:"NAMESPACE_LABEL_SELECTOR"`
+
+	// Pod and node filtering
+	// PodLabelSelector - Label selector of the pods to monitor
+	// PodFieldSelector - Field selector of the pods to monitor
+	// NodeLabelSelector - Label selector of the nodes to monitor. Pods scheduled on other nodes are not monitored either.
+	// NodeFieldSelector - Field selector of the nodes to monitor. Pods scheduled on other nodes are not monitored either.
+	// ExcludeCompletedPods - Whether completed (succeeded or failed) pods shall not be monitored, e. g. pods of finished
+	// jobs. They are filtered by the Kubernetes API.
+	PodLabelSelector     string `envconfig:"POD_LABEL_SELECTOR"`
+	PodFieldSelector     string `envconfig:"POD_FIELD_SELECTOR"`
+	NodeLabelSelector    string `envconfig:"NODE_LABEL_SELECTOR"`
+	NodeFieldSelector    string `envconfig:"NODE_FIELD_SELECTOR"`
+	ExcludeCompletedPods bool   `envconfig:"EXCLUDE_COMPLETED_PODS" default:"false"`
+
+	// Leader election
+	// LeaderElection - Whether to elect a leader among multiple replicas, so that only the leader queries the Kubernetes API
+	// LeaderElectionNamespace - Namespace of the leader election lease, defaults to kube eagle's namespace
+	// LeaderElectionLeaseName - Name of the leader election lease
+	// LeaderElectionIdentity - Unique identity of this replica. Followers proxy scrapes to http://<identity of the
+	// leader>, thus it defaults to "<pod ip>:<port>" if the POD_IP environment variable is set and "<hostname>:<port>"
+	// otherwise.
+	// LeaderElectionFollowerMode - What followers serve on /metrics, either the leader's metrics (proxy) or no kube
+	// eagle metrics at all (empty)
+	// LeaderElectionLeaseDuration - Duration followers wait before they try to acquire a lease which hasn't been renewed
+	// LeaderElectionRenewDeadline - Duration the leader retries to renew the lease before it gives up the leadership
+	// LeaderElectionRetryPeriod - Duration between two attempts to acquire or renew the lease
+	LeaderElection              bool          `envconfig:"LEADER_ELECTION" default:"false"`
+	LeaderElectionNamespace     string        `envconfig:"LEADER_ELECTION_NAMESPACE"`
+	LeaderElectionLeaseName     string        `envconfig:"LEADER_ELECTION_LEASE_NAME" default:"kube-eagle"`
+	LeaderElectionIdentity      string        `envconfig:"LEADER_ELECTION_IDENTITY"`
+	LeaderElectionFollowerMode  string        `envconfig:"LEADER_ELECTION_FOLLOWER_MODE" default:"proxy"`
+	LeaderElectionLeaseDuration time.Duration `envconfig:"LEADER_ELECTION_LEASE_DURATION" default:"15s"`
+	LeaderElectionRenewDeadline time.Duration `envconfig:"LEADER_ELECTION_RENEW_DEADLINE" default:"10s"`
+	LeaderElectionRetryPeriod   time.Duration `envconfig:"LEADER_ELECTION_RETRY_PERIOD" default:"2s"`
 
 	// Prometheus
 	// Host - Host to bind socket on for the prometheus exporter
 	// Port - Port to listen on for the prometheus exporter
 	// Namespace - Prefix of exposed prometheus metrics
-	Host      string `envconfig:"TELEMETRY_HOST" default:"0.0.0.0"`
-	Port      int    `envconfig:"TELEMETRY_PORT" default:"8080"`
-	Namespace string `envconfig:"METRICS_NAMESPACE" default:"eagle"`
+	// OpenMetrics - Whether to serve the OpenMetrics text format to scrapers which accept it
+	Host        string `envconfig:"TELEMETRY_HOST" default:"0.0.0.0"`
+	Port        int    `envconfig:"TELEMETRY_PORT" default:"8080"`
+	Namespace   string `envconfig:"METRICS_NAMESPACE" default:"eagle"`
+	OpenMetrics bool   `envconfig:"OPENMETRICS" default:"true"`
+
+	// Web
+	// WebConfigFile - Path of a web config file (Prometheus exporter-toolkit format) to enable TLS, client certificate
+	// authentication and basic auth
+	// WebBearerTokenFile - Path of a file containing a bearer token which is required to access the metrics
+	// WebReloadInterval - Interval in which the web config file, the certificates and the bearer token file are
+	// checked for changes, 0 disables the check
+	WebConfigFile      string        `envconfig:"WEB_CONFIG_FILE"`
+	WebBearerTokenFile string        `envconfig:"WEB_BEARER_TOKEN_FILE"`
+	WebReloadInterval  time.Duration `envconfig:"WEB_RELOAD_INTERVAL" default:"10s"`
+	// ShutdownTimeout - Maximum duration in-flight requests may take to finish on shutdown (SIGTERM or SIGINT) before
+	// they are cancelled, and background tasks (e. g. releasing the leader election lease) may take afterwards
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"10s"`
+
+	// Export
+	// ExportInterval - Interval in which a snapshot of the container and node resources is exported, 0 disables the
+	// export. In high availability mode only the leader exports snapshots.
+	// ExportFormat - File format of the exported snapshots (csv or parquet)
+	// ExportRetention - Age after which exported snapshots are deleted, 0 keeps them forever
+	// ExportDirectory - Directory the snapshots are written to
+	// ExportS3Endpoint - Endpoint of an S3-compatible object storage the snapshots are uploaded to instead of a
+	// directory (e. g. https://s3.eu-west-1.amazonaws.com or http://minio:9000), objects are addressed path-style
+	// ExportS3Bucket - Bucket the snapshots are uploaded to
+	// ExportS3Prefix - Prefix of the uploaded objects' keys (e. g. "kube-eagle/")
+	// ExportS3Region - Region of the bucket, used to sign the requests
+	// ExportS3AccessKeyID - Access key ID of the object storage
+	// ExportS3SecretAccessKeyFile - Path of a file containing the secret access key, read before every export
+	ExportInterval              time.Duration `envconfig:"EXPORT_INTERVAL" default:"0s"`
+	ExportFormat                string        `envconfig:"EXPORT_FORMAT" default:"csv"`
+	ExportRetention             time.Duration `envconfig:"EXPORT_RETENTION" default:"0s"`
+	ExportDirectory             string        `envconfig:"EXPORT_DIRECTORY"`
+	ExportS3Endpoint            string        `envconfig:"EXPORT_S3_ENDPOINT"`
+	ExportS3Bucket              string        `envconfig:"EXPORT_S3_BUCKET"`
+	ExportS3Prefix              string        `envconfig:"EXPORT_S3_PREFIX"`
+	ExportS3Region              string        `envconfig:"EXPORT_S3_REGION" default:"us-east-1"`
+	ExportS3AccessKeyID         string        `envconfig:"EXPORT_S3_ACCESS_KEY_ID"`
+	ExportS3SecretAccessKeyFile string        `envconfig:"EXPORT_S3_SECRET_ACCESS_KEY_FILE"`
+
+	// OpenTelemetry
+	// OTLPEndpoint - Endpoint of an OTLP receiver the metrics are pushed to (e. g. http://otel-collector:4317 for gRPC or
+	// http://otel-collector:4318 for HTTP), empty disables the push. https endpoints are accessed using TLS.
+	// OTLPProtocol - Protocol of the OTLP receiver (grpc, http/protobuf or http/json)
+	// OTLPInterval - Interval in which the metrics are pushed. In high availability mode only the leader pushes metrics.
+	// OTLPTimeout - Maximum duration of a single push, including the computation of the metrics
+	// OTLPHeaders - Headers sent with every push as key=value pairs (e. g. "authorization=Bearer <token>")
+	OTLPEndpoint string        `envconfig:"OTLP_ENDPOINT"`
+	OTLPProtocol string        `envconfig:"OTLP_PROTOCOL" default:"grpc"`
+	OTLPInterval time.Duration `envconfig:"OTLP_INTERVAL" default:"60s"`
+	OTLPTimeout  time.Duration `envconfig:"OTLP_TIMEOUT" default:"10s"`
+	OTLPHeaders  []string      `envconfig:"OTLP_HEADERS"`
+
+	// Remote write
+	// RemoteWriteURL - URL of a Prometheus remote write endpoint the metrics are pushed to (e. g.
+	// https://prometheus.example.com/api/v1/write), empty disables the push
+	// RemoteWriteInterval - Interval in which the metrics are computed and queued. In high availability mode only the
+	// leader queues metrics.
+	// RemoteWriteTimeout - Maximum duration of computing the metrics and of a single request
+	// RemoteWriteQueueSize - Maximum number of queued requests, the oldest request is dropped if the queue is full
+	// RemoteWriteQueueDirectory - Directory in which the queued requests are stored, so that they survive restarts.
+	// Requests are queued in memory if it's empty.
+	// RemoteWriteMinBackoff - Initial duration to wait before a failed request is retried, doubled on every retry
+	// RemoteWriteMaxBackoff - Maximum duration to wait before a failed request is retried
+	// RemoteWriteUsername - Username for basic auth
+	// RemoteWritePasswordFile - Path of a file containing the password for basic auth
+	// RemoteWriteBearerTokenFile - Path of a file containing a bearer token
+	RemoteWriteURL             string        `envconfig:"REMOTE_WRITE_URL"`
+	RemoteWriteInterval        time.Duration `envconfig:"REMOTE_WRITE_INTERVAL" default:"60s"`
+	RemoteWriteTimeout         time.Duration `envconfig:"REMOTE_WRITE_TIMEOUT" default:"30s"`
+	RemoteWriteQueueSize       int           `envconfig:"REMOTE_WRITE_QUEUE_SIZE" default:"360"`
+	RemoteWriteQueueDirectory  string        `envconfig:"REMOTE_WRITE_QUEUE_DIRECTORY"`
+	RemoteWriteMinBackoff      time.Duration `envconfig:"REMOTE_WRITE_MIN_BACKOFF" default:"1s"`
+	RemoteWriteMaxBackoff      time.Duration `envconfig:"REMOTE_WRITE_MAX_BACKOFF" default:"1m"`
+	RemoteWriteUsername        string        `envconfig:"REMOTE_WRITE_USERNAME"`
+	RemoteWritePasswordFile    string        `envconfig:"REMOTE_WRITE_PASSWORD_FILE"`
+	RemoteWriteBearerTokenFile string        `envconfig:"REMOTE_WRITE_BEARER_TOKEN_FILE"`
+
+	// Collectors
+	// CollectorTimeout - Maximum duration a collector may take to compute its metrics for one cluster
+	// CollectorMaxSeries - Maximum number of series a collector may expose per cluster. Exceeding collectors drop
+	// whole pods (or nodes) in the order of their names, so that the same ones are exposed in every scrape. 0 disables
+	// the limit.
+	// ContainerResourceDropLabels - Labels which are dropped from the container resource metrics. Series which only
+	// differ in the dropped labels are summed up (e. g. dropping pod and container yields the resources per namespace
+	// and node).
+	// IncludeTerminatedPods - Whether the container resources of terminated (succeeded or failed) pods shall be exposed
+	// as separate metrics for auditing, along with their pod status metrics. Otherwise they are excluded from the
+	// container resource and pod status metrics, like from the node resource metrics, as terminated pods don't hold
+	// their requested resources anymore.
+	CollectorTimeout            time.Duration `envconfig:"COLLECTOR_TIMEOUT" default:"10s"`
+	CollectorMaxSeries          int           `envconfig:"COLLECTOR_MAX_SERIES" default:"0"`
+	ContainerResourceDropLabels []string      `envconfig:"CONTAINER_RESOURCE_DROP_LABELS"`
+	IncludeTerminatedPods       bool          `envconfig:"INCLUDE_TERMINATED_PODS" default:"false"`
+
+	// Health
+	// ReadinessMaxScrapeAge - Maximum age of a cluster's last successful scrape, before kube eagle is considered not
+	// ready if the subsequent scrapes failed
+	// ReadinessRequireAllClusters - Whether all clusters must pass the readiness checks, otherwise kube eagle is ready
+	// as long as one cluster passes them
+	ReadinessMaxScrapeAge       time.Duration `envconfig:"READINESS_MAX_SCRAPE_AGE" default:"5m"`
+	ReadinessRequireAllClusters bool          `envconfig:"READINESS_REQUIRE_ALL_CLUSTERS" default:"false"`
 
 	// Logger
 	// LogLevel - Logger's log granularity (debug, info, warn, error, fatal, panic)
@@ -0,0 +1,259 @@
+package options
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Follower modes of the leader election
+const (
+	FollowerModeProxy = "proxy"
+	FollowerModeEmpty = "empty"
+)
+
+// File formats of exported snapshots
+const (
+	ExportFormatCSV     = "csv"
+	ExportFormatParquet = "parquet"
+)
+
+// Protocols of the OTLP exporter
+const (
+	OTLPProtocolGRPC         = "grpc"
+	OTLPProtocolHTTPProtobuf = "http/protobuf"
+	OTLPProtocolHTTPJSON     = "http/json"
+)
+
+// DroppableContainerResourceLabels are the labels which can be dropped from the container resource metrics. The
+// cluster label is always kept, so that the metrics of multiple clusters don't get mixed.
+var DroppableContainerResourceLabels = []string{"pod", "container", "namespace", "node"}
+
+var metricsNamespaceRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Validate checks all options and returns an error which lists every invalid option, so that a misconfiguration is
+// detected at startup rather than on the first scrape
+func (o *Options) Validate() error {
+	var errs []string
+	addError := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	// General
+	if o.Version == "" {
+		addError("VERSION must be set")
+	}
+	if o.ConfigReloadInterval < 0 {
+		addError("CONFIG_RELOAD_INTERVAL must not be negative, got %v", o.ConfigReloadInterval)
+	}
+
+	// Kubernetes
+	if o.KubeConfigDir != "" && len(o.KubeContexts) > 0 {
+		addError("KUBECONFIG_DIR and KUBE_CONTEXTS are mutually exclusive")
+	}
+	if o.KubeContext != "" && (o.KubeConfigDir != "" || len(o.KubeContexts) > 0) {
+		addError("KUBE_CONTEXT can't be used in multi cluster mode (KUBECONFIG_DIR or KUBE_CONTEXTS)")
+	}
+
+	// Kubernetes API client
+	if o.APIQPS <= 0 {
+		addError("KUBE_API_QPS must be greater than 0, got %v", o.APIQPS)
+	}
+	if o.APIBurst <= 0 {
+		addError("KUBE_API_BURST must be greater than 0, got %v", o.APIBurst)
+	}
+	if o.APITimeout < 0 {
+		addError("KUBE_API_TIMEOUT must not be negative, got %v", o.APITimeout)
+	}
+	if o.APIListPageSize < 0 {
+		addError("KUBE_API_LIST_PAGE_SIZE must not be negative, got %v", o.APIListPageSize)
+	}
+	if o.SnapshotMinInterval < 0 {
+		addError("SNAPSHOT_MIN_INTERVAL must not be negative, got %v", o.SnapshotMinInterval)
+	}
+
+	// Namespace scoping
+	excluded := make(map[string]bool)
+	for _, namespace := range o.ExcludeNamespaces {
+		excluded[namespace] = true
+	}
+	for _, namespace := range o.IncludeNamespaces {
+		if excluded[namespace] {
+			addError("namespace '%s' is both included and excluded", namespace)
+		}
+	}
+	if _, err := labels.Parse(o.NamespaceLabelSelector); err != nil {
+		addError("invalid NAMESPACE_LABEL_SELECTOR: %v", err)
+	}
+
+	// Pod and node filtering
+	if _, err := labels.Parse(o.PodLabelSelector); err != nil {
+		addError("invalid POD_LABEL_SELECTOR: %v", err)
+	}
+	if _, err := fields.ParseSelector(o.PodFieldSelector); err != nil {
+		addError("invalid POD_FIELD_SELECTOR: %v", err)
+	}
+	if _, err := labels.Parse(o.NodeLabelSelector); err != nil {
+		addError("invalid NODE_LABEL_SELECTOR: %v", err)
+	}
+	if _, err := fields.ParseSelector(o.NodeFieldSelector); err != nil {
+		addError("invalid NODE_FIELD_SELECTOR: %v", err)
+	}
+
+	// Leader election
+	if o.LeaderElection {
+		if o.LeaderElectionFollowerMode != FollowerModeProxy && o.LeaderElectionFollowerMode != FollowerModeEmpty {
+			addError("LEADER_ELECTION_FOLLOWER_MODE must be either '%s' or '%s', got '%s'", FollowerModeProxy, FollowerModeEmpty, o.LeaderElectionFollowerMode)
+		}
+		if o.LeaderElectionLeaseName == "" {
+			addError("LEADER_ELECTION_LEASE_NAME must be set")
+		}
+		if o.LeaderElectionRetryPeriod <= 0 {
+			addError("LEADER_ELECTION_RETRY_PERIOD must be greater than 0, got %v", o.LeaderElectionRetryPeriod)
+		}
+		if o.LeaderElectionRenewDeadline >= o.LeaderElectionLeaseDuration {
+			addError("LEADER_ELECTION_RENEW_DEADLINE (%v) must be less than LEADER_ELECTION_LEASE_DURATION (%v)", o.LeaderElectionRenewDeadline, o.LeaderElectionLeaseDuration)
+		}
+	}
+
+	// Prometheus
+	if o.Port < 1 || o.Port > 65535 {
+		addError("TELEMETRY_PORT must be between 1 and 65535, got %v", o.Port)
+	}
+	if o.Namespace != "" && !metricsNamespaceRegexp.MatchString(o.Namespace) {
+		addError("METRICS_NAMESPACE '%s' is not a valid metric name prefix", o.Namespace)
+	}
+
+	// Web
+	if o.WebReloadInterval < 0 {
+		addError("WEB_RELOAD_INTERVAL must not be negative, got %v", o.WebReloadInterval)
+	}
+	if o.ShutdownTimeout <= 0 {
+		addError("SHUTDOWN_TIMEOUT must be greater than 0, got %v", o.ShutdownTimeout)
+	}
+
+	// Export
+	if o.ExportInterval < 0 {
+		addError("EXPORT_INTERVAL must not be negative, got %v", o.ExportInterval)
+	}
+	if o.ExportInterval > 0 {
+		if o.ExportFormat != ExportFormatCSV && o.ExportFormat != ExportFormatParquet {
+			addError("EXPORT_FORMAT must be '%s' or '%s', got '%s'", ExportFormatCSV, ExportFormatParquet, o.ExportFormat)
+		}
+		if o.ExportRetention < 0 {
+			addError("EXPORT_RETENTION must not be negative, got %v", o.ExportRetention)
+		}
+		if (o.ExportDirectory == "") == (o.ExportS3Endpoint == "") {
+			addError("exactly one of EXPORT_DIRECTORY or EXPORT_S3_ENDPOINT must be set")
+		}
+		if o.ExportS3Endpoint != "" {
+			if endpoint, err := url.Parse(o.ExportS3Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+				addError("EXPORT_S3_ENDPOINT must be an http or https URL, got '%s'", o.ExportS3Endpoint)
+			}
+			if o.ExportS3Bucket == "" {
+				addError("EXPORT_S3_BUCKET must be set")
+			}
+			if o.ExportS3Region == "" {
+				addError("EXPORT_S3_REGION must be set")
+			}
+			if o.ExportS3AccessKeyID == "" || o.ExportS3SecretAccessKeyFile == "" {
+				addError("EXPORT_S3_ACCESS_KEY_ID and EXPORT_S3_SECRET_ACCESS_KEY_FILE must be set")
+			}
+		}
+	}
+
+	// OpenTelemetry
+	if o.OTLPEndpoint != "" {
+		if endpoint, err := url.Parse(o.OTLPEndpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			addError("OTLP_ENDPOINT must be an http or https URL, got '%s'", o.OTLPEndpoint)
+		}
+		if o.OTLPProtocol != OTLPProtocolGRPC && o.OTLPProtocol != OTLPProtocolHTTPProtobuf && o.OTLPProtocol != OTLPProtocolHTTPJSON {
+			addError("OTLP_PROTOCOL must be one of '%s', '%s' or '%s', got '%s'", OTLPProtocolGRPC, OTLPProtocolHTTPProtobuf, OTLPProtocolHTTPJSON, o.OTLPProtocol)
+		}
+		if o.OTLPInterval <= 0 {
+			addError("OTLP_INTERVAL must be greater than 0, got %v", o.OTLPInterval)
+		}
+		if o.OTLPTimeout <= 0 {
+			addError("OTLP_TIMEOUT must be greater than 0, got %v", o.OTLPTimeout)
+		}
+		for _, header := range o.OTLPHeaders {
+			if !strings.Contains(header, "=") {
+				addError("OTLP_HEADERS must contain key=value pairs, got '%s'", header)
+			}
+		}
+	}
+
+	// Remote write
+	if o.RemoteWriteURL != "" {
+		if u, err := url.Parse(o.RemoteWriteURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addError("REMOTE_WRITE_URL must be an http or https URL, got '%s'", o.RemoteWriteURL)
+		}
+		if o.RemoteWriteInterval <= 0 {
+			addError("REMOTE_WRITE_INTERVAL must be greater than 0, got %v", o.RemoteWriteInterval)
+		}
+		if o.RemoteWriteTimeout <= 0 {
+			addError("REMOTE_WRITE_TIMEOUT must be greater than 0, got %v", o.RemoteWriteTimeout)
+		}
+		if o.RemoteWriteQueueSize < 1 {
+			addError("REMOTE_WRITE_QUEUE_SIZE must be at least 1, got %v", o.RemoteWriteQueueSize)
+		}
+		if o.RemoteWriteMinBackoff <= 0 || o.RemoteWriteMinBackoff > o.RemoteWriteMaxBackoff {
+			addError("REMOTE_WRITE_MIN_BACKOFF (%v) must be greater than 0 and at most REMOTE_WRITE_MAX_BACKOFF (%v)", o.RemoteWriteMinBackoff, o.RemoteWriteMaxBackoff)
+		}
+		if (o.RemoteWriteUsername == "") != (o.RemoteWritePasswordFile == "") {
+			addError("REMOTE_WRITE_USERNAME and REMOTE_WRITE_PASSWORD_FILE must be set together")
+		}
+		if o.RemoteWriteUsername != "" && o.RemoteWriteBearerTokenFile != "" {
+			addError("only one of basic auth and REMOTE_WRITE_BEARER_TOKEN_FILE may be set")
+		}
+	}
+
+	// Collectors
+	if o.CollectorTimeout <= 0 {
+		addError("COLLECTOR_TIMEOUT must be greater than 0, got %v", o.CollectorTimeout)
+	}
+	if o.CollectorMaxSeries < 0 {
+		addError("COLLECTOR_MAX_SERIES must not be negative, got %d", o.CollectorMaxSeries)
+	}
+	if o.IncludeTerminatedPods && o.ExcludeCompletedPods {
+		addError("INCLUDE_TERMINATED_PODS and EXCLUDE_COMPLETED_PODS are mutually exclusive")
+	}
+	for _, label := range o.ContainerResourceDropLabels {
+		if label == "phase" || label == "qos" {
+			addError("CONTAINER_RESOURCE_DROP_LABELS contains '%s', which isn't a label of the container resource metrics "+
+				"anymore, see eagle_pod_phase and eagle_pod_qos_class", label)
+		} else if !contains(DroppableContainerResourceLabels, label) {
+			addError("CONTAINER_RESOURCE_DROP_LABELS contains '%s', but only %s can be dropped", label,
+				strings.Join(DroppableContainerResourceLabels, ", "))
+		}
+	}
+
+	// Health
+	if o.ReadinessMaxScrapeAge <= 0 {
+		addError("READINESS_MAX_SCRAPE_AGE must be greater than 0, got %v", o.ReadinessMaxScrapeAge)
+	}
+
+	// Logger
+	if _, err := log.ParseLevel(o.LogLevel); err != nil {
+		addError("invalid LOG_LEVEL: %v", err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
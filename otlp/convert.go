@@ -0,0 +1,179 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// clusterLabel is the label which is mapped to the resource attribute k8s.cluster.name
+const clusterLabel = "cluster"
+
+// attributeNames maps Prometheus labels to the attribute names of the OpenTelemetry semantic conventions. Other labels
+// keep their name.
+var attributeNames = map[string]string{
+	"namespace": "k8s.namespace.name",
+	"pod":       "k8s.pod.name",
+	"container": "k8s.container.name",
+	"node":      "k8s.node.name",
+}
+
+// units maps suffixes of Prometheus metric names to UCUM units
+var units = []struct {
+	suffix string
+	unit   string
+}{
+	{"_seconds", "s"},
+	{"_seconds_total", "s"},
+	{"_bytes", "By"},
+	{"_bytes_total", "By"},
+}
+
+// convert converts the gathered metric families into an export request. The metrics are grouped into one resource per
+// cluster, so that the cluster label becomes the resource attribute k8s.cluster.name. Empty labels are dropped, as
+// Prometheus treats them like missing labels.
+func convert(families []*dto.MetricFamily, resourceAttributes []keyValue, scope instrumentationScope, startTime time.Time, now time.Time) *exportMetricsServiceRequest {
+	metricsByCluster := make(map[string]map[string]*metric)
+	for _, family := range families {
+		for _, m := range family.Metric {
+			cluster := ""
+			var attributes []keyValue
+			for _, label := range m.Label {
+				if label.GetValue() == "" {
+					continue
+				}
+				if label.GetName() == clusterLabel {
+					cluster = label.GetValue()
+					continue
+				}
+				name, exists := attributeNames[label.GetName()]
+				if !exists {
+					name = label.GetName()
+				}
+				attributes = append(attributes, keyValue{Key: name, Value: anyValue{StringValue: label.GetValue()}})
+			}
+
+			if metricsByCluster[cluster] == nil {
+				metricsByCluster[cluster] = make(map[string]*metric)
+			}
+			converted, exists := metricsByCluster[cluster][family.GetName()]
+			if !exists {
+				converted = newMetric(family)
+				metricsByCluster[cluster][family.GetName()] = converted
+			}
+			timestamp := now
+			if m.TimestampMs != nil {
+				timestamp = time.Unix(0, m.GetTimestampMs()*int64(time.Millisecond))
+			}
+			addDataPoint(converted, m, attributes, uint64(startTime.UnixNano()), uint64(timestamp.UnixNano()))
+		}
+	}
+
+	clusters := make([]string, 0, len(metricsByCluster))
+	for cluster := range metricsByCluster {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	request := &exportMetricsServiceRequest{}
+	for _, cluster := range clusters {
+		attributes := append([]keyValue{}, resourceAttributes...)
+		if cluster != "" {
+			attributes = append(attributes, keyValue{Key: "k8s.cluster.name", Value: anyValue{StringValue: cluster}})
+		}
+		names := make([]string, 0, len(metricsByCluster[cluster]))
+		for name := range metricsByCluster[cluster] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		sm := &scopeMetrics{Scope: scope}
+		for _, name := range names {
+			sm.Metrics = append(sm.Metrics, metricsByCluster[cluster][name])
+		}
+		request.ResourceMetrics = append(request.ResourceMetrics, &resourceMetrics{
+			Resource:     resource{Attributes: attributes},
+			ScopeMetrics: []*scopeMetrics{sm},
+		})
+	}
+	return request
+}
+
+func newMetric(family *dto.MetricFamily) *metric {
+	m := &metric{Name: family.GetName(), Description: family.GetHelp()}
+	for _, u := range units {
+		if strings.HasSuffix(m.Name, u.suffix) {
+			m.Unit = u.unit
+		}
+	}
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		m.Sum = &sum{AggregationTemporality: aggregationTemporalityCumulative, IsMonotonic: true}
+	case dto.MetricType_HISTOGRAM:
+		m.Histogram = &histogram{AggregationTemporality: aggregationTemporalityCumulative}
+	case dto.MetricType_SUMMARY:
+		m.Summary = &summary{}
+	default:
+		m.Gauge = &gauge{}
+	}
+	return m
+}
+
+// addDataPoint adds the Prometheus metric as data point. Only cumulative data points have a start time, which is the
+// time kube eagle started to push the metrics.
+func addDataPoint(converted *metric, m *dto.Metric, attributes []keyValue, startTime uint64, timestamp uint64) {
+	switch {
+	case converted.Sum != nil:
+		converted.Sum.DataPoints = append(converted.Sum.DataPoints, &numberDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: startTime,
+			TimeUnixNano:      timestamp,
+			AsDouble:          double(m.GetCounter().GetValue()),
+		})
+	case converted.Histogram != nil:
+		h := m.GetHistogram()
+		dp := &histogramDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: startTime,
+			TimeUnixNano:      timestamp,
+			Count:             h.GetSampleCount(),
+			Sum:               double(h.GetSampleSum()),
+		}
+		// Prometheus buckets are cumulative, whereas OTLP buckets contain the count between two bounds
+		var previous uint64
+		for _, bucket := range h.Bucket {
+			if math.IsInf(bucket.GetUpperBound(), 1) {
+				continue
+			}
+			dp.ExplicitBounds = append(dp.ExplicitBounds, double(bucket.GetUpperBound()))
+			dp.BucketCounts = append(dp.BucketCounts, bucket.GetCumulativeCount()-previous)
+			previous = bucket.GetCumulativeCount()
+		}
+		dp.BucketCounts = append(dp.BucketCounts, h.GetSampleCount()-previous)
+		converted.Histogram.DataPoints = append(converted.Histogram.DataPoints, dp)
+	case converted.Summary != nil:
+		s := m.GetSummary()
+		dp := &summaryDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: startTime,
+			TimeUnixNano:      timestamp,
+			Count:             s.GetSampleCount(),
+			Sum:               double(s.GetSampleSum()),
+		}
+		for _, q := range s.Quantile {
+			dp.QuantileValues = append(dp.QuantileValues, valueAtQuantile{Quantile: double(q.GetQuantile()), Value: double(q.GetValue())})
+		}
+		converted.Summary.DataPoints = append(converted.Summary.DataPoints, dp)
+	default:
+		value := m.GetGauge().GetValue()
+		if m.Untyped != nil {
+			value = m.GetUntyped().GetValue()
+		}
+		converted.Gauge.DataPoints = append(converted.Gauge.DataPoints, &numberDataPoint{
+			Attributes:   attributes,
+			TimeUnixNano: timestamp,
+			AsDouble:     double(value),
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Package otlp pushes the metrics of kube eagle to an OpenTelemetry collector (or any other OTLP receiver), for setups
+// which don't scrape Prometheus metrics
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// grpcExportPath is the path of the gRPC method MetricsService/Export
+const grpcExportPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// GatherFunc gathers the metrics to push. The context is cancelled if the push times out.
+type GatherFunc func(ctx context.Context) ([]*dto.MetricFamily, error)
+
+// Exporter pushes the gathered metrics in a fixed interval
+type Exporter struct {
+	url                string
+	protocol           string
+	headers            http.Header
+	interval           time.Duration
+	timeout            time.Duration
+	client             *http.Client
+	gather             GatherFunc
+	isLeader           func() bool
+	resourceAttributes []keyValue
+	scope              instrumentationScope
+	startTime          time.Time
+
+	lastSuccessTimestamp prometheus.Gauge
+	failures             prometheus.Counter
+}
+
+// New creates an exporter pushing to the configured endpoint. isLeader may be nil if no leader is elected, otherwise
+// only the leader pushes metrics.
+func New(opts *options.Options, gather GatherFunc, isLeader func() bool) (*Exporter, error) {
+	e, err := newExporter(opts, gather, isLeader)
+	if err != nil {
+		return nil, err
+	}
+	prometheus.MustRegister(e.lastSuccessTimestamp, e.failures)
+	return e, nil
+}
+
+// newExporter creates an exporter whose own metrics aren't registered yet
+func newExporter(opts *options.Options, gather GatherFunc, isLeader func() bool) (*Exporter, error) {
+	endpoint, err := url.Parse(opts.OTLPEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse OTLP endpoint: '%v'", err)
+	}
+	headers := http.Header{}
+	for _, header := range opts.OTLPHeaders {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("OTLP header '%s' is not a key=value pair", header)
+		}
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	client := &http.Client{}
+	if opts.OTLPProtocol == options.OTLPProtocolGRPC {
+		// gRPC requires HTTP/2, which is used without TLS (h2c) for http endpoints
+		transport := &http2.Transport{}
+		if endpoint.Scheme == "http" {
+			transport.AllowHTTP = true
+			transport.DialTLS = func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			}
+		}
+		client.Transport = transport
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + grpcExportPath
+	} else {
+		endpoint.Path = strings.TrimSuffix(endpoint.Path, "/") + "/v1/metrics"
+	}
+
+	e := &Exporter{
+		url:      endpoint.String(),
+		protocol: opts.OTLPProtocol,
+		headers:  headers,
+		interval: opts.OTLPInterval,
+		timeout:  opts.OTLPTimeout,
+		client:   client,
+		gather:   gather,
+		isLeader: isLeader,
+		resourceAttributes: []keyValue{
+			{Key: "service.name", Value: anyValue{StringValue: "kube-eagle"}},
+			{Key: "service.version", Value: anyValue{StringValue: opts.Version}},
+		},
+		scope:     instrumentationScope{Name: "github.com/google-cloud-tools/kube-eagle", Version: opts.Version},
+		startTime: time.Now(),
+		lastSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "otlp",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Kube Eagle: Timestamp of the last successful OTLP push.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "otlp",
+			Name:      "failures_total",
+			Help:      "Kube Eagle: Number of failed OTLP pushes.",
+		}),
+	}
+
+	return e, nil
+}
+
+// Run pushes the metrics in every interval until the context is cancelled
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if e.isLeader != nil && !e.isLeader() {
+				log.Debug("Skipping OTLP push, as this replica is not the leader")
+				continue
+			}
+			pushCtx, cancel := context.WithTimeout(ctx, e.timeout)
+			err := e.push(pushCtx, now)
+			cancel()
+			if err != nil {
+				log.Errorf("Failed to push metrics via OTLP: %v", err)
+				e.failures.Inc()
+				continue
+			}
+			e.lastSuccessTimestamp.Set(float64(now.Unix()))
+		}
+	}
+}
+
+func (e *Exporter) push(ctx context.Context, now time.Time) error {
+	families, err := e.gather(ctx)
+	if err != nil {
+		// Gatherers return all metrics they could gather along with the error, e. g. if a single cluster failed
+		log.Warnf("Failed to gather some metrics for OTLP push: %v", err)
+	}
+	if len(families) == 0 {
+		return fmt.Errorf("no metrics have been gathered")
+	}
+	request := convert(families, e.resourceAttributes, e.scope, e.startTime, now)
+
+	var body []byte
+	var contentType string
+	switch e.protocol {
+	case options.OTLPProtocolHTTPJSON:
+		contentType = "application/json"
+		body, err = json.Marshal(request)
+		if err != nil {
+			return err
+		}
+	case options.OTLPProtocolHTTPProtobuf:
+		contentType = "application/x-protobuf"
+		body = request.marshalProto()
+	case options.OTLPProtocolGRPC:
+		// gRPC messages are prefixed by the compression flag and their length
+		contentType = "application/grpc"
+		message := request.marshalProto()
+		body = make([]byte, 5, 5+len(message))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(message)))
+		body = append(body, message...)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range e.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "kube-eagle")
+	if e.protocol == options.OTLPProtocolGRPC {
+		req.Header.Set("TE", "trailers")
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// The body must be read completely before gRPC trailers are available
+	resBody, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with status %d: %s", res.StatusCode, strings.TrimSpace(string(resBody)))
+	}
+	if e.protocol == options.OTLPProtocolGRPC {
+		// Errors without a response message are sent as headers only (trailers-only response)
+		status := res.Trailer.Get("Grpc-Status")
+		message := res.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status = res.Header.Get("Grpc-Status")
+			message = res.Header.Get("Grpc-Message")
+		}
+		if status != "0" {
+			message, _ = url.PathUnescape(message)
+			return fmt.Errorf("receiver responded with gRPC status %s %s", status, message)
+		}
+	}
+
+	log.Debugf("Pushed %d metric families via OTLP", len(families))
+	return nil
+}
@@ -0,0 +1,518 @@
+package otlp
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// The following types mirror the OTLP messages of opentelemetry-proto (metrics_service.proto, metrics.proto,
+// resource.proto and common.proto), limited to gauges and sums, so that pushed requests can be decoded by the
+// protobuf library instead of the encoder under test
+type otlpExportMetricsServiceRequest struct {
+	ResourceMetrics []*otlpResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics,proto3"`
+}
+
+func (m *otlpExportMetricsServiceRequest) Reset()         { *m = otlpExportMetricsServiceRequest{} }
+func (m *otlpExportMetricsServiceRequest) String() string { return proto.CompactTextString(m) }
+func (*otlpExportMetricsServiceRequest) ProtoMessage()    {}
+
+type otlpResourceMetrics struct {
+	Resource     *otlpResource       `protobuf:"bytes,1,opt,name=resource,proto3"`
+	ScopeMetrics []*otlpScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics,proto3"`
+}
+
+func (m *otlpResourceMetrics) Reset()         { *m = otlpResourceMetrics{} }
+func (m *otlpResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpResourceMetrics) ProtoMessage()    {}
+
+type otlpResource struct {
+	Attributes []*otlpKeyValue `protobuf:"bytes,1,rep,name=attributes,proto3"`
+}
+
+func (m *otlpResource) Reset()         { *m = otlpResource{} }
+func (m *otlpResource) String() string { return proto.CompactTextString(m) }
+func (*otlpResource) ProtoMessage()    {}
+
+type otlpScopeMetrics struct {
+	Scope   *otlpScope    `protobuf:"bytes,1,opt,name=scope,proto3"`
+	Metrics []*otlpMetric `protobuf:"bytes,2,rep,name=metrics,proto3"`
+}
+
+func (m *otlpScopeMetrics) Reset()         { *m = otlpScopeMetrics{} }
+func (m *otlpScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*otlpScopeMetrics) ProtoMessage()    {}
+
+type otlpScope struct {
+	Name    string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Version string `protobuf:"bytes,2,opt,name=version,proto3"`
+}
+
+func (m *otlpScope) Reset()         { *m = otlpScope{} }
+func (m *otlpScope) String() string { return proto.CompactTextString(m) }
+func (*otlpScope) ProtoMessage()    {}
+
+type otlpMetric struct {
+	Name  string     `protobuf:"bytes,1,opt,name=name,proto3"`
+	Gauge *otlpGauge `protobuf:"bytes,5,opt,name=gauge,proto3"`
+	Sum   *otlpSum   `protobuf:"bytes,7,opt,name=sum,proto3"`
+}
+
+func (m *otlpMetric) Reset()         { *m = otlpMetric{} }
+func (m *otlpMetric) String() string { return proto.CompactTextString(m) }
+func (*otlpMetric) ProtoMessage()    {}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3"`
+}
+
+func (m *otlpGauge) Reset()         { *m = otlpGauge{} }
+func (m *otlpGauge) String() string { return proto.CompactTextString(m) }
+func (*otlpGauge) ProtoMessage()    {}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberDataPoint `protobuf:"bytes,1,rep,name=data_points,proto3"`
+	AggregationTemporality int32                  `protobuf:"varint,2,opt,name=aggregation_temporality,proto3"`
+	IsMonotonic            bool                   `protobuf:"varint,3,opt,name=is_monotonic,proto3"`
+}
+
+func (m *otlpSum) Reset()         { *m = otlpSum{} }
+func (m *otlpSum) String() string { return proto.CompactTextString(m) }
+func (*otlpSum) ProtoMessage()    {}
+
+type otlpNumberDataPoint struct {
+	StartTimeUnixNano uint64          `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3"`
+	TimeUnixNano      uint64          `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	AsDouble          float64         `protobuf:"fixed64,4,opt,name=as_double,proto3"`
+	Attributes        []*otlpKeyValue `protobuf:"bytes,7,rep,name=attributes,proto3"`
+}
+
+func (m *otlpNumberDataPoint) Reset()         { *m = otlpNumberDataPoint{} }
+func (m *otlpNumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*otlpNumberDataPoint) ProtoMessage()    {}
+
+type otlpKeyValue struct {
+	Key   string        `protobuf:"bytes,1,opt,name=key,proto3"`
+	Value *otlpAnyValue `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *otlpKeyValue) Reset()         { *m = otlpKeyValue{} }
+func (m *otlpKeyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpKeyValue) ProtoMessage()    {}
+
+type otlpAnyValue struct {
+	StringValue string `protobuf:"bytes,1,opt,name=string_value,proto3"`
+}
+
+func (m *otlpAnyValue) Reset()         { *m = otlpAnyValue{} }
+func (m *otlpAnyValue) String() string { return proto.CompactTextString(m) }
+func (*otlpAnyValue) ProtoMessage()    {}
+
+// jsonExportMetricsServiceRequest mirrors the JSON mapping of the same messages, independently of the exporter's types
+type jsonExportMetricsServiceRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes []jsonKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Scope struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"scope"`
+			Metrics []struct {
+				Name  string `json:"name"`
+				Gauge *struct {
+					DataPoints []jsonNumberDataPoint `json:"dataPoints"`
+				} `json:"gauge"`
+				Sum *struct {
+					DataPoints             []jsonNumberDataPoint `json:"dataPoints"`
+					AggregationTemporality int32                 `json:"aggregationTemporality"`
+					IsMonotonic            bool                  `json:"isMonotonic"`
+				} `json:"sum"`
+			} `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type jsonNumberDataPoint struct {
+	StartTimeUnixNano uint64         `json:"startTimeUnixNano,string"`
+	TimeUnixNano      uint64         `json:"timeUnixNano,string"`
+	AsDouble          float64        `json:"asDouble"`
+	Attributes        []jsonKeyValue `json:"attributes"`
+}
+
+type jsonKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// receivedPoint is a decoded data point along with the attributes of its resource and metric
+type receivedPoint struct {
+	resource   map[string]string
+	metric     string
+	monotonic  bool
+	attributes map[string]string
+	startTime  uint64
+	time       uint64
+	value      float64
+}
+
+func protoAttributes(attributes []*otlpKeyValue) map[string]string {
+	values := make(map[string]string, len(attributes))
+	for _, kv := range attributes {
+		values[kv.Key] = kv.Value.StringValue
+	}
+	return values
+}
+
+func jsonAttributes(attributes []jsonKeyValue) map[string]string {
+	values := make(map[string]string, len(attributes))
+	for _, kv := range attributes {
+		values[kv.Key] = kv.Value.StringValue
+	}
+	return values
+}
+
+// decodeProto decodes a protobuf encoded export request into its data points
+func decodeProto(t *testing.T, data []byte) []receivedPoint {
+	t.Helper()
+	request := &otlpExportMetricsServiceRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		t.Fatalf("could not decode export request: %v", err)
+	}
+	var points []receivedPoint
+	for _, rm := range request.ResourceMetrics {
+		resource := protoAttributes(rm.Resource.Attributes)
+		for _, sm := range rm.ScopeMetrics {
+			if sm.Scope.Name != "github.com/google-cloud-tools/kube-eagle" || sm.Scope.Version != "test" {
+				t.Errorf("scope = %+v, expected github.com/google-cloud-tools/kube-eagle test", sm.Scope)
+			}
+			for _, m := range sm.Metrics {
+				dataPoints, monotonic := []*otlpNumberDataPoint(nil), false
+				switch {
+				case m.Gauge != nil:
+					dataPoints = m.Gauge.DataPoints
+				case m.Sum != nil:
+					dataPoints, monotonic = m.Sum.DataPoints, m.Sum.IsMonotonic
+					if m.Sum.AggregationTemporality != aggregationTemporalityCumulative {
+						t.Errorf("%s: aggregation temporality = %d, expected cumulative", m.Name, m.Sum.AggregationTemporality)
+					}
+				default:
+					t.Errorf("%s is neither a gauge nor a sum", m.Name)
+				}
+				for _, dp := range dataPoints {
+					points = append(points, receivedPoint{resource: resource, metric: m.Name, monotonic: monotonic,
+						attributes: protoAttributes(dp.Attributes), startTime: dp.StartTimeUnixNano, time: dp.TimeUnixNano,
+						value: dp.AsDouble})
+				}
+			}
+		}
+	}
+	return points
+}
+
+// decodeJSON decodes a JSON encoded export request into its data points
+func decodeJSON(t *testing.T, data []byte) []receivedPoint {
+	t.Helper()
+	request := &jsonExportMetricsServiceRequest{}
+	if err := json.Unmarshal(data, request); err != nil {
+		t.Fatalf("could not decode export request: %v", err)
+	}
+	var points []receivedPoint
+	for _, rm := range request.ResourceMetrics {
+		resource := jsonAttributes(rm.Resource.Attributes)
+		for _, sm := range rm.ScopeMetrics {
+			if sm.Scope.Name != "github.com/google-cloud-tools/kube-eagle" || sm.Scope.Version != "test" {
+				t.Errorf("scope = %+v, expected github.com/google-cloud-tools/kube-eagle test", sm.Scope)
+			}
+			for _, m := range sm.Metrics {
+				dataPoints, monotonic := []jsonNumberDataPoint(nil), false
+				switch {
+				case m.Gauge != nil:
+					dataPoints = m.Gauge.DataPoints
+				case m.Sum != nil:
+					dataPoints, monotonic = m.Sum.DataPoints, m.Sum.IsMonotonic
+					if m.Sum.AggregationTemporality != aggregationTemporalityCumulative {
+						t.Errorf("%s: aggregation temporality = %d, expected cumulative", m.Name, m.Sum.AggregationTemporality)
+					}
+				default:
+					t.Errorf("%s is neither a gauge nor a sum", m.Name)
+				}
+				for _, dp := range dataPoints {
+					points = append(points, receivedPoint{resource: resource, metric: m.Name, monotonic: monotonic,
+						attributes: jsonAttributes(dp.Attributes), startTime: dp.StartTimeUnixNano, time: dp.TimeUnixNano,
+						value: dp.AsDouble})
+				}
+			}
+		}
+	}
+	return points
+}
+
+// receiver is an OTLP receiver stand-in, which serves gRPC over HTTP/2 without TLS (h2c) as well as OTLP/HTTP. It
+// records the requests it received and responds with the configured status.
+type receiver struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	requests   []*http.Request
+	bodies     [][]byte
+	statusCode int
+	grpcStatus string
+}
+
+func newReceiver(t *testing.T) *receiver {
+	r := &receiver{statusCode: http.StatusOK, grpcStatus: "0"}
+	r.Server = httptest.NewServer(h2c.NewHandler(http.HandlerFunc(r.serveHTTP), &http2.Server{}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+
+	if req.URL.Path != grpcExportPath {
+		if r.statusCode != http.StatusOK {
+			http.Error(w, "invalid metrics", r.statusCode)
+			return
+		}
+		w.Header().Set("Content-Type", req.Header.Get("Content-Type"))
+		if req.Header.Get("Content-Type") == "application/json" {
+			w.Write([]byte("{}"))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	if r.grpcStatus != "0" {
+		// Trailers-only response
+		w.Header().Set("Grpc-Status", r.grpcStatus)
+		w.Header().Set("Grpc-Message", "invalid%20credentials")
+		return
+	}
+	// An empty ExportMetricsServiceResponse, followed by the status in the trailers
+	w.Write([]byte{0, 0, 0, 0, 0})
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+// newTestExporter creates an exporter pushing the given metric families to the receiver with the given protocol
+func newTestExporter(t *testing.T, r *receiver, protocol string, families []*dto.MetricFamily) *Exporter {
+	t.Helper()
+	opts, err := options.Load([]string{"--version", "test", "--otlp-endpoint", r.URL, "--otlp-protocol", protocol,
+		"--otlp-headers", "authorization=Bearer secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newExporter(opts, func(ctx context.Context) ([]*dto.MetricFamily, error) {
+		return families, nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.startTime = time.Unix(1500000000, 0)
+	return e
+}
+
+func labelPairs(labels ...string) []*dto.LabelPair {
+	var pairs []*dto.LabelPair
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return pairs
+}
+
+// fixtureFamilies returns container and node metrics of two clusters and a counter of kube eagle itself
+func fixtureFamilies() []*dto.MetricFamily {
+	return []*dto.MetricFamily{
+		{
+			Name: proto.String("eagle_pod_container_resource_requests_cpu_cores"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: labelPairs("cluster", "a", "container", "app", "namespace", "default", "node", "node-a",
+						"phase", "Running", "pod", "web-1", "qos", "Burstable"),
+					Gauge: &dto.Gauge{Value: proto.Float64(0.5)},
+				},
+			},
+		},
+		{
+			Name: proto.String("eagle_node_resource_allocatable_cpu_cores"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: labelPairs("cluster", "b", "node", "node-b"),
+					Gauge: &dto.Gauge{Value: proto.Float64(3.92)},
+				},
+			},
+		},
+		{
+			Name: proto.String("eagle_kube_api_requests_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   labelPairs("cluster", "", "code", "200"),
+					Counter: &dto.Counter{Value: proto.Float64(7)},
+				},
+			},
+		},
+	}
+}
+
+func pointKey(p receivedPoint) string {
+	return fmt.Sprintf("%s %v", p.metric, p.attributes)
+}
+
+func TestPush(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	serviceAttributes := map[string]string{"service.name": "kube-eagle", "service.version": "test"}
+	withCluster := func(cluster string) map[string]string {
+		attributes := map[string]string{"k8s.cluster.name": cluster}
+		for key, value := range serviceAttributes {
+			attributes[key] = value
+		}
+		return attributes
+	}
+	expected := []receivedPoint{
+		{
+			resource: serviceAttributes,
+			metric:   "eagle_kube_api_requests_total",
+			// Cumulative data points start when kube eagle started to push
+			monotonic:  true,
+			attributes: map[string]string{"code": "200"},
+			startTime:  uint64(time.Unix(1500000000, 0).UnixNano()),
+			time:       uint64(now.UnixNano()),
+			value:      7,
+		},
+		{
+			resource:   withCluster("b"),
+			metric:     "eagle_node_resource_allocatable_cpu_cores",
+			attributes: map[string]string{"k8s.node.name": "node-b"},
+			time:       uint64(now.UnixNano()),
+			value:      3.92,
+		},
+		{
+			resource: withCluster("a"),
+			metric:   "eagle_pod_container_resource_requests_cpu_cores",
+			attributes: map[string]string{"k8s.container.name": "app", "k8s.namespace.name": "default",
+				"k8s.node.name": "node-a", "k8s.pod.name": "web-1", "phase": "Running", "qos": "Burstable"},
+			time:  uint64(now.UnixNano()),
+			value: 0.5,
+		},
+	}
+
+	tests := []struct {
+		protocol            string
+		expectedPath        string
+		expectedContentType string
+		expectedProtoMajor  int
+		decode              func(t *testing.T, body []byte) []receivedPoint
+	}{
+		{
+			protocol:            options.OTLPProtocolGRPC,
+			expectedPath:        grpcExportPath,
+			expectedContentType: "application/grpc",
+			expectedProtoMajor:  2,
+			decode: func(t *testing.T, body []byte) []receivedPoint {
+				// Unframe the gRPC message, which must be uncompressed
+				if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+					t.Fatalf("invalid gRPC message frame %v", body[:5])
+				}
+				return decodeProto(t, body[5:])
+			},
+		},
+		{
+			protocol:            options.OTLPProtocolHTTPProtobuf,
+			expectedPath:        "/v1/metrics",
+			expectedContentType: "application/x-protobuf",
+			expectedProtoMajor:  1,
+			decode:              decodeProto,
+		},
+		{
+			protocol:            options.OTLPProtocolHTTPJSON,
+			expectedPath:        "/v1/metrics",
+			expectedContentType: "application/json",
+			expectedProtoMajor:  1,
+			decode:              decodeJSON,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.protocol, func(t *testing.T) {
+			r := newReceiver(t)
+			e := newTestExporter(t, r, test.protocol, fixtureFamilies())
+			if err := e.push(context.Background(), now); err != nil {
+				t.Fatalf("push failed: %v", err)
+			}
+			if len(r.requests) != 1 {
+				t.Fatalf("receiver got %d requests, expected 1", len(r.requests))
+			}
+
+			req := r.requests[0]
+			if req.Method != http.MethodPost || req.URL.Path != test.expectedPath || req.ProtoMajor != test.expectedProtoMajor {
+				t.Errorf("request = %s %s %s, expected POST %s HTTP/%d", req.Method, req.URL.Path, req.Proto,
+					test.expectedPath, test.expectedProtoMajor)
+			}
+			if contentType := req.Header.Get("Content-Type"); contentType != test.expectedContentType {
+				t.Errorf("Content-Type = %q, expected %q", contentType, test.expectedContentType)
+			}
+			if authorization := req.Header.Get("Authorization"); authorization != "Bearer secret" {
+				t.Errorf("Authorization = %q, expected the configured header", authorization)
+			}
+
+			points := test.decode(t, r.bodies[0])
+			sort.Slice(points, func(i, j int) bool { return pointKey(points[i]) < pointKey(points[j]) })
+			if !reflect.DeepEqual(points, expected) {
+				t.Errorf("received data points\n%+v\nexpected\n%+v", points, expected)
+			}
+		})
+	}
+}
+
+func TestPushErrors(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	r := newReceiver(t)
+	r.grpcStatus = "16"
+	e := newTestExporter(t, r, options.OTLPProtocolGRPC, fixtureFamilies())
+	err := e.push(context.Background(), now)
+	if err == nil || err.Error() != "receiver responded with gRPC status 16 invalid credentials" {
+		t.Errorf("push = %v, expected gRPC status 16", err)
+	}
+
+	r = newReceiver(t)
+	r.statusCode = http.StatusBadRequest
+	e = newTestExporter(t, r, options.OTLPProtocolHTTPProtobuf, fixtureFamilies())
+	err = e.push(context.Background(), now)
+	if err == nil || err.Error() != "receiver responded with status 400: invalid metrics" {
+		t.Errorf("push = %v, expected status 400", err)
+	}
+
+	e = newTestExporter(t, r, options.OTLPProtocolHTTPJSON, nil)
+	if err = e.push(context.Background(), now); err == nil || !strings.Contains(err.Error(), "no metrics") {
+		t.Errorf("push without metrics = %v, expected an error", err)
+	}
+}
@@ -0,0 +1,247 @@
+package otlp
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/google-cloud-tools/kube-eagle/internal/protobuf"
+)
+
+// The types below mirror the messages of the OTLP metrics protocol (opentelemetry-proto v1), limited to the fields
+// kube eagle sets. They are encoded either as JSON (OTLP/HTTP JSON) or protobuf (OTLP/HTTP protobuf and gRPC).
+
+// aggregationTemporalityCumulative is the temporality of all sums and histograms, as Prometheus metrics are cumulative
+const aggregationTemporalityCumulative = 2
+
+type exportMetricsServiceRequest struct {
+	ResourceMetrics []*resourceMetrics `json:"resourceMetrics"`
+}
+
+type resourceMetrics struct {
+	Resource     resource        `json:"resource"`
+	ScopeMetrics []*scopeMetrics `json:"scopeMetrics"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeMetrics struct {
+	Scope   instrumentationScope `json:"scope"`
+	Metrics []*metric            `json:"metrics"`
+}
+
+type instrumentationScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type metric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Gauge       *gauge     `json:"gauge,omitempty"`
+	Sum         *sum       `json:"sum,omitempty"`
+	Histogram   *histogram `json:"histogram,omitempty"`
+	Summary     *summary   `json:"summary,omitempty"`
+}
+
+type gauge struct {
+	DataPoints []*numberDataPoint `json:"dataPoints"`
+}
+
+type sum struct {
+	DataPoints             []*numberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                `json:"aggregationTemporality"`
+	IsMonotonic            bool               `json:"isMonotonic"`
+}
+
+type histogram struct {
+	DataPoints             []*histogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+}
+
+type summary struct {
+	DataPoints []*summaryDataPoint `json:"dataPoints"`
+}
+
+type numberDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64     `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64     `json:"timeUnixNano,string"`
+	AsDouble          double     `json:"asDouble"`
+}
+
+type histogramDataPoint struct {
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64     `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64     `json:"timeUnixNano,string"`
+	Count             uint64     `json:"count,string"`
+	Sum               double     `json:"sum"`
+	BucketCounts      uint64s    `json:"bucketCounts"`
+	ExplicitBounds    []double   `json:"explicitBounds"`
+}
+
+type summaryDataPoint struct {
+	Attributes        []keyValue        `json:"attributes,omitempty"`
+	StartTimeUnixNano uint64            `json:"startTimeUnixNano,string,omitempty"`
+	TimeUnixNano      uint64            `json:"timeUnixNano,string"`
+	Count             uint64            `json:"count,string"`
+	Sum               double            `json:"sum"`
+	QuantileValues    []valueAtQuantile `json:"quantileValues"`
+}
+
+type valueAtQuantile struct {
+	Quantile double `json:"quantile"`
+	Value    double `json:"value"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// double is a float64 which is encoded like protobuf's JSON mapping does, i. e. NaN and infinities are strings
+type double float64
+
+func (d double) MarshalJSON() ([]byte, error) {
+	v := float64(d)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"Infinity"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Infinity"`), nil
+	}
+	return json.Marshal(v)
+}
+
+// uint64s are encoded as strings, like protobuf's JSON mapping does for 64 bit integers
+type uint64s []uint64
+
+func (u uint64s) MarshalJSON() ([]byte, error) {
+	values := make([]string, len(u))
+	for i, v := range u {
+		values[i] = strconv.FormatUint(v, 10)
+	}
+	return json.Marshal(values)
+}
+
+// marshalProto encodes the request as protobuf, see opentelemetry/proto/collector/metrics/v1/metrics_service.proto
+func (r *exportMetricsServiceRequest) marshalProto() []byte {
+	b := &protobuf.Buffer{}
+	for _, rm := range r.ResourceMetrics {
+		b.MessageField(1, rm.encode)
+	}
+	return b.Bytes()
+}
+
+func (rm *resourceMetrics) encode(b *protobuf.Buffer) {
+	b.MessageField(1, rm.Resource.encode)
+	for _, sm := range rm.ScopeMetrics {
+		b.MessageField(2, sm.encode)
+	}
+}
+
+func (r *resource) encode(b *protobuf.Buffer) {
+	encodeAttributes(b, 1, r.Attributes)
+}
+
+func (sm *scopeMetrics) encode(b *protobuf.Buffer) {
+	b.MessageField(1, sm.Scope.encode)
+	for _, m := range sm.Metrics {
+		b.MessageField(2, m.encode)
+	}
+}
+
+func (s *instrumentationScope) encode(b *protobuf.Buffer) {
+	b.StringField(1, s.Name)
+	b.StringField(2, s.Version)
+}
+
+func (m *metric) encode(b *protobuf.Buffer) {
+	b.StringField(1, m.Name)
+	b.StringField(2, m.Description)
+	b.StringField(3, m.Unit)
+	switch {
+	case m.Gauge != nil:
+		b.MessageField(5, func(b *protobuf.Buffer) {
+			for _, dp := range m.Gauge.DataPoints {
+				b.MessageField(1, dp.encode)
+			}
+		})
+	case m.Sum != nil:
+		b.MessageField(7, func(b *protobuf.Buffer) {
+			for _, dp := range m.Sum.DataPoints {
+				b.MessageField(1, dp.encode)
+			}
+			b.Uint64Field(2, uint64(m.Sum.AggregationTemporality))
+			b.BoolField(3, m.Sum.IsMonotonic)
+		})
+	case m.Histogram != nil:
+		b.MessageField(9, func(b *protobuf.Buffer) {
+			for _, dp := range m.Histogram.DataPoints {
+				b.MessageField(1, dp.encode)
+			}
+			b.Uint64Field(2, uint64(m.Histogram.AggregationTemporality))
+		})
+	case m.Summary != nil:
+		b.MessageField(11, func(b *protobuf.Buffer) {
+			for _, dp := range m.Summary.DataPoints {
+				b.MessageField(1, dp.encode)
+			}
+		})
+	}
+}
+
+func (dp *numberDataPoint) encode(b *protobuf.Buffer) {
+	b.Fixed64Field(2, dp.StartTimeUnixNano)
+	b.Fixed64Field(3, dp.TimeUnixNano)
+	b.OneofDoubleField(4, float64(dp.AsDouble))
+	encodeAttributes(b, 7, dp.Attributes)
+}
+
+func (dp *histogramDataPoint) encode(b *protobuf.Buffer) {
+	b.Fixed64Field(2, dp.StartTimeUnixNano)
+	b.Fixed64Field(3, dp.TimeUnixNano)
+	b.Fixed64Field(4, dp.Count)
+	b.OneofDoubleField(5, float64(dp.Sum))
+	b.PackedFixed64Field(6, dp.BucketCounts)
+	bounds := make([]float64, len(dp.ExplicitBounds))
+	for i, bound := range dp.ExplicitBounds {
+		bounds[i] = float64(bound)
+	}
+	b.PackedDoubleField(7, bounds)
+	encodeAttributes(b, 9, dp.Attributes)
+}
+
+func (dp *summaryDataPoint) encode(b *protobuf.Buffer) {
+	b.Fixed64Field(2, dp.StartTimeUnixNano)
+	b.Fixed64Field(3, dp.TimeUnixNano)
+	b.Fixed64Field(4, dp.Count)
+	b.DoubleField(5, float64(dp.Sum))
+	for _, q := range dp.QuantileValues {
+		b.MessageField(6, func(b *protobuf.Buffer) {
+			b.DoubleField(1, float64(q.Quantile))
+			b.DoubleField(2, float64(q.Value))
+		})
+	}
+	encodeAttributes(b, 7, dp.Attributes)
+}
+
+func encodeAttributes(b *protobuf.Buffer, field int, attributes []keyValue) {
+	for _, kv := range attributes {
+		b.MessageField(field, func(b *protobuf.Buffer) {
+			b.StringField(1, kv.Key)
+			b.MessageField(2, func(b *protobuf.Buffer) {
+				b.OneofStringField(1, kv.Value.StringValue)
+			})
+		})
+	}
+}
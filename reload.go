@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloader owns the kube eagle collector and rebuilds it (including the Kubernetes clients and all collectors) when
+// the config file changes, so that configuration changes don't require a restart. Rebuilt collectors consist of the
+// built-in collectors only.
+type reloader struct {
+	args []string
+
+	mutex     sync.RWMutex
+	opts      *options.Options
+	collector *collector.KubeEagleCollector
+	fileHash  [sha256.Size]byte
+
+	lastReloadSuccess          prometheus.Gauge
+	lastReloadSuccessTimestamp prometheus.Gauge
+	configInfo                 *prometheus.GaugeVec
+}
+
+// newReloader creates the initial collector from the given options. The command line args are kept, as flags
+// override the config file on every reload.
+func newReloader(args []string, opts *options.Options) (*reloader, error) {
+	eagleCollector, err := newEagleCollector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reloader{
+		args:      args,
+		opts:      opts,
+		collector: eagleCollector,
+		lastReloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "config",
+			Name:      "last_reload_success",
+			Help:      "Kube Eagle: Whether the last configuration reload attempt was successful.",
+		}),
+		lastReloadSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "config",
+			Name:      "last_reload_success_timestamp_seconds",
+			Help:      "Kube Eagle: Timestamp of the last successful configuration reload.",
+		}),
+		configInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "config",
+			Name:      "info",
+			Help:      "Kube Eagle: Always 1, labeled with the SHA-256 hash of the currently loaded configuration.",
+		}, []string{"hash"}),
+	}
+	if opts.ConfigFile != "" {
+		r.fileHash, err = hashFile(opts.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+	}
+	err = r.recordSuccess(opts)
+	if err != nil {
+		return nil, err
+	}
+	prometheus.MustRegister(r.lastReloadSuccess, r.lastReloadSuccessTimestamp, r.configInfo)
+
+	return r, nil
+}
+
+// Collector returns the collector of the currently loaded configuration
+func (r *reloader) Collector() *collector.KubeEagleCollector {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.collector
+}
+
+// Gatherer returns a gatherer of the kube eagle metrics along with the metrics of the default registry, see
+// CollectorGatherer
+func (r *reloader) Gatherer(ctx context.Context) prometheus.Gatherer {
+	return prometheus.Gatherers{prometheus.DefaultGatherer, r.CollectorGatherer(ctx)}
+}
+
+// CollectorGatherer returns a gatherer of the kube eagle collector's metrics only, i. e. without the Go runtime,
+// process and status metrics of the default registry. It uses a registry per call, so that the collector's Kubernetes
+// API calls are cancelled along with the context and the descriptors of a reloaded collector are picked up.
+func (r *reloader) CollectorGatherer(ctx context.Context) prometheus.Gatherer {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(r.Collector().WithContext(ctx))
+	return registry
+}
+
+// Run watches the config file for changes by polling it in the given interval (0 disables polling) and reloads the
+// configuration when it changes or the process receives a SIGHUP. It blocks until the context is cancelled.
+func (r *reloader) Run(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 && r.opts.ConfigFile != "" {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Info("Received SIGHUP, reloading configuration")
+			r.reload(true)
+		case <-tick:
+			r.reload(false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload loads the configuration and swaps the collector if the config file has changed (or if forced). On errors
+// the previous configuration is kept.
+func (r *reloader) reload(force bool) {
+	if r.opts.ConfigFile != "" {
+		fileHash, err := hashFile(r.opts.ConfigFile)
+		if err != nil {
+			r.recordFailure(fmt.Errorf("failed to read config file: %v", err))
+			return
+		}
+		if fileHash == r.fileHash && !force {
+			return
+		}
+		if fileHash != r.fileHash {
+			log.Infof("Config file '%s' has changed, reloading configuration", r.opts.ConfigFile)
+		}
+		r.fileHash = fileHash
+	}
+
+	opts, err := options.Load(r.args)
+	if err != nil {
+		r.recordFailure(err)
+		return
+	}
+	err = opts.Validate()
+	if err != nil {
+		r.recordFailure(err)
+		return
+	}
+	for _, option := range refuseRestartRequired(r.opts, opts) {
+		log.Warnf("Changes of %s require a restart and are ignored", option)
+	}
+
+	eagleCollector, err := newEagleCollector(opts)
+	if err != nil {
+		r.recordFailure(err)
+		return
+	}
+
+	level, _ := log.ParseLevel(opts.LogLevel)
+	log.SetLevel(level)
+	r.mutex.Lock()
+	r.opts = opts
+	r.collector = eagleCollector
+	r.mutex.Unlock()
+
+	err = r.recordSuccess(opts)
+	if err != nil {
+		log.Warnf("Failed to hash configuration: %v", err)
+	}
+	log.Info("Configuration has been reloaded")
+}
+
+func (r *reloader) recordSuccess(opts *options.Options) error {
+	r.lastReloadSuccess.Set(1)
+	r.lastReloadSuccessTimestamp.SetToCurrentTime()
+
+	config, err := opts.ConfigYAML()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(config))
+	// Only the hash of the configuration in effect is exposed
+	r.configInfo.Reset()
+	r.configInfo.WithLabelValues(hex.EncodeToString(sum[:])).Set(1)
+	return nil
+}
+
+func (r *reloader) recordFailure(err error) {
+	log.Errorf("Failed to reload configuration, keeping the previous one: %v", err)
+	r.lastReloadSuccess.Set(0)
+}
+
+// newEagleCollector creates the Kubernetes clients and the kube eagle collector for the given options
+func newEagleCollector(opts *options.Options) (*collector.KubeEagleCollector, error) {
+	clients, err := kubernetes.NewClients(opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize kubernetes clients: '%v'", err)
+	}
+	eagleCollector, err := collector.New(clients, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not start kube eagle collector: '%v'", err)
+	}
+	// Registering the collector validates its descriptors (e. g. duplicate metrics or inconsistent label sets)
+	err = prometheus.NewPedanticRegistry().Register(eagleCollector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kube eagle collector metrics: '%v'", err)
+	}
+
+	return eagleCollector, nil
+}
+
+// startupOptions are the options which are only applied at startup, by the name changes are reported with. They are
+// matched by their environment variable names, where names ending with an underscore are prefixes.
+var startupOptions = []struct {
+	name     string
+	envNames []string
+}{
+	{name: "TELEMETRY_HOST/TELEMETRY_PORT", envNames: []string{"TELEMETRY_HOST", "TELEMETRY_PORT"}},
+	{name: "METRICS_NAMESPACE", envNames: []string{"METRICS_NAMESPACE"}},
+	{name: "LEADER_ELECTION_*", envNames: []string{"LEADER_ELECTION", "LEADER_ELECTION_"}},
+	{name: "OPENMETRICS", envNames: []string{"OPENMETRICS"}},
+	{name: "CONFIG_RELOAD_INTERVAL", envNames: []string{"CONFIG_RELOAD_INTERVAL"}},
+	{name: "WEB_*", envNames: []string{"WEB_"}},
+	{name: "SHUTDOWN_TIMEOUT", envNames: []string{"SHUTDOWN_TIMEOUT"}},
+	{name: "EXPORT_*", envNames: []string{"EXPORT_"}},
+	{name: "OTLP_*", envNames: []string{"OTLP_"}},
+	{name: "REMOTE_WRITE_*", envNames: []string{"REMOTE_WRITE_"}},
+}
+
+// refuseRestartRequired returns the options which have changed, but are only applied at startup, and resets them to
+// their previous values, so that the new options reflect the configuration in effect
+func refuseRestartRequired(previous *options.Options, next *options.Options) []string {
+	var changed []string
+	previousValue := reflect.ValueOf(previous).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+	for _, startupOption := range startupOptions {
+		hasChanged := false
+		for i := 0; i < nextValue.NumField(); i++ {
+			envName := nextValue.Type().Field(i).Tag.Get("envconfig")
+			if envName == "" || !matchesEnvName(envName, startupOption.envNames) {
+				continue
+			}
+			if !reflect.DeepEqual(previousValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+				hasChanged = true
+				nextValue.Field(i).Set(previousValue.Field(i))
+			}
+		}
+		if hasChanged {
+			changed = append(changed, startupOption.name)
+		}
+	}
+
+	return changed
+}
+
+func matchesEnvName(envName string, envNames []string) bool {
+	for _, name := range envNames {
+		if envName == name || (strings.HasSuffix(name, "_") && strings.HasPrefix(envName, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hashFile(path string) ([sha256.Size]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(content), nil
+}
@@ -0,0 +1,121 @@
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/internal/protobuf"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// label is a label of a time series
+type label struct {
+	name  string
+	value string
+}
+
+// timeSeries is a time series with a single sample
+type timeSeries struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// convert flattens the gathered metric families into time series the way Prometheus would store them when scraping,
+// i. e. histograms and summaries are split into their _bucket, _sum and _count series. Samples without a timestamp
+// get the given one.
+func convert(families []*dto.MetricFamily, now time.Time) []timeSeries {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	var series []timeSeries
+	for _, family := range families {
+		for _, m := range family.Metric {
+			ts := timestamp
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...label) {
+				labels := []label{{name: "__name__", value: name}}
+				for _, l := range m.Label {
+					labels = append(labels, label{name: l.GetName(), value: l.GetValue()})
+				}
+				labels = append(labels, extra...)
+				series = append(series, timeSeries{labels: labels, value: value, timestamp: ts})
+			}
+
+			name := family.GetName()
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				hasInf := false
+				for _, bucket := range h.Bucket {
+					hasInf = hasInf || math.IsInf(bucket.GetUpperBound(), 1)
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), label{name: "le", value: formatFloat(bucket.GetUpperBound())})
+				}
+				if !hasInf {
+					add(name+"_bucket", float64(h.GetSampleCount()), label{name: "le", value: "+Inf"})
+				}
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					add(name, q.GetValue(), label{name: "quantile", value: formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			default:
+				add(name, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return series
+}
+
+// marshalWriteRequest encodes the time series as remote write request, see prometheus/prompb/remote.proto. Labels are
+// sorted by name and empty labels are dropped, as the protocol requires.
+func marshalWriteRequest(series []timeSeries) []byte {
+	b := &protobuf.Buffer{}
+	for _, s := range series {
+		labels := make([]label, 0, len(s.labels))
+		for _, l := range s.labels {
+			if l.value != "" {
+				labels = append(labels, l)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			return labels[i].name < labels[j].name
+		})
+		b.MessageField(1, func(b *protobuf.Buffer) {
+			for _, l := range labels {
+				b.MessageField(1, func(b *protobuf.Buffer) {
+					b.StringField(1, l.name)
+					b.StringField(2, l.value)
+				})
+			}
+			b.MessageField(2, func(b *protobuf.Buffer) {
+				b.DoubleField(1, s.value)
+				b.Int64Field(2, s.timestamp)
+			})
+		})
+	}
+	return b.Bytes()
+}
+
+// formatFloat formats bucket bounds and quantiles like the Prometheus text format does
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,151 @@
+package remotewrite
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The following types mirror prometheus/prompb (types.proto and remote.proto), so that encoded write requests can be
+// decoded by the protobuf library instead of the encoder under test
+type prompbWriteRequest struct {
+	Timeseries []*prompbTimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3"`
+}
+
+func (m *prompbWriteRequest) Reset()         { *m = prompbWriteRequest{} }
+func (m *prompbWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*prompbWriteRequest) ProtoMessage()    {}
+
+type prompbTimeSeries struct {
+	Labels  []*prompbLabel  `protobuf:"bytes,1,rep,name=labels,proto3"`
+	Samples []*prompbSample `protobuf:"bytes,2,rep,name=samples,proto3"`
+}
+
+func (m *prompbTimeSeries) Reset()         { *m = prompbTimeSeries{} }
+func (m *prompbTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*prompbTimeSeries) ProtoMessage()    {}
+
+type prompbLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *prompbLabel) Reset()         { *m = prompbLabel{} }
+func (m *prompbLabel) String() string { return proto.CompactTextString(m) }
+func (*prompbLabel) ProtoMessage()    {}
+
+type prompbSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *prompbSample) Reset()         { *m = prompbSample{} }
+func (m *prompbSample) String() string { return proto.CompactTextString(m) }
+func (*prompbSample) ProtoMessage()    {}
+
+// decodeWriteRequest decodes the write request into a map of the series' labels (in the encoded order) to their sample
+func decodeWriteRequest(t *testing.T, data []byte) map[string]prompbSample {
+	t.Helper()
+	request := &prompbWriteRequest{}
+	if err := proto.Unmarshal(data, request); err != nil {
+		t.Fatalf("could not decode write request: %v", err)
+	}
+	series := make(map[string]prompbSample, len(request.Timeseries))
+	for _, ts := range request.Timeseries {
+		key := ""
+		for _, l := range ts.Labels {
+			key += l.Name + "=" + l.Value + ","
+		}
+		if len(ts.Samples) != 1 {
+			t.Fatalf("series %s has %d samples, expected 1", key, len(ts.Samples))
+		}
+		series[key] = *ts.Samples[0]
+	}
+	return series
+}
+
+func TestMarshalWriteRequest(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	families := []*dto.MetricFamily{
+		{
+			Name: proto.String("eagle_node_resource_allocatable_cpu_cores"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("node"), Value: proto.String("node-a")},
+						{Name: proto.String("cluster"), Value: proto.String("")},
+					},
+					Gauge: &dto.Gauge{Value: proto.Float64(3.5)},
+				},
+				{
+					Label:       []*dto.LabelPair{{Name: proto.String("node"), Value: proto.String("node-b")}},
+					Gauge:       &dto.Gauge{Value: proto.Float64(0)},
+					TimestampMs: proto.Int64(1234),
+				},
+			},
+		},
+		{
+			Name: proto.String("eagle_scrape_errors_total"),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{Counter: &dto.Counter{Value: proto.Float64(2)}},
+			},
+		},
+		{
+			Name: proto.String("eagle_scrape_duration_seconds"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label: []*dto.LabelPair{{Name: proto.String("collector"), Value: proto.String("node_resource")}},
+					Histogram: &dto.Histogram{
+						SampleCount: proto.Uint64(3),
+						SampleSum:   proto.Float64(1.5),
+						Bucket: []*dto.Bucket{
+							{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(2)},
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(3)},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: proto.String("go_gc_duration_seconds"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Summary: &dto.Summary{
+						SampleCount: proto.Uint64(10),
+						SampleSum:   proto.Float64(0.25),
+						Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(math.Inf(1))}},
+					},
+				},
+			},
+		},
+	}
+
+	ms := now.UnixNano() / int64(time.Millisecond)
+	expected := map[string]prompbSample{
+		// Empty labels are dropped and the labels are sorted by name
+		"__name__=eagle_node_resource_allocatable_cpu_cores,node=node-a,":                {Value: 3.5, Timestamp: ms},
+		"__name__=eagle_node_resource_allocatable_cpu_cores,node=node-b,":                {Value: 0, Timestamp: 1234},
+		"__name__=eagle_scrape_errors_total,":                                            {Value: 2, Timestamp: ms},
+		"__name__=eagle_scrape_duration_seconds_bucket,collector=node_resource,le=0.5,":  {Value: 2, Timestamp: ms},
+		"__name__=eagle_scrape_duration_seconds_bucket,collector=node_resource,le=1,":    {Value: 3, Timestamp: ms},
+		"__name__=eagle_scrape_duration_seconds_bucket,collector=node_resource,le=+Inf,": {Value: 3, Timestamp: ms},
+		"__name__=eagle_scrape_duration_seconds_sum,collector=node_resource,":            {Value: 1.5, Timestamp: ms},
+		"__name__=eagle_scrape_duration_seconds_count,collector=node_resource,":          {Value: 3, Timestamp: ms},
+		"__name__=go_gc_duration_seconds,quantile=0.5,":                                  {Value: math.Inf(1), Timestamp: ms},
+		"__name__=go_gc_duration_seconds_sum,":                                           {Value: 0.25, Timestamp: ms},
+		"__name__=go_gc_duration_seconds_count,":                                         {Value: 10, Timestamp: ms},
+	}
+
+	actual := decodeWriteRequest(t, marshalWriteRequest(convert(families, now)))
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("decoded series = %v, expected %v", actual, expected)
+	}
+}
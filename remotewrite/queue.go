@@ -0,0 +1,193 @@
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queue holds the encoded write requests which haven't been sent yet. It's bounded, pushing to a full queue drops the
+// oldest request.
+type queue interface {
+	// Push appends the request and returns whether the oldest request has been dropped
+	Push(request []byte) (bool, error)
+	// Peek returns the ID and content of the oldest request, or nil if the queue is empty
+	Peek() (string, []byte, error)
+	// Remove removes the request with the given ID, unless it has already been dropped
+	Remove(id string) error
+	// Len returns the number of queued requests
+	Len() int
+}
+
+// memoryQueue keeps the requests in memory, thus they are lost on restart
+type memoryQueue struct {
+	mutex    sync.Mutex
+	requests []memoryQueueEntry
+	size     int
+	nextID   int
+}
+
+type memoryQueueEntry struct {
+	id      string
+	request []byte
+}
+
+func newMemoryQueue(size int) *memoryQueue {
+	return &memoryQueue{size: size}
+}
+
+func (q *memoryQueue) Push(request []byte) (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	dropped := false
+	if len(q.requests) >= q.size {
+		q.requests = q.requests[1:]
+		dropped = true
+	}
+	q.requests = append(q.requests, memoryQueueEntry{id: strconv.Itoa(q.nextID), request: request})
+	q.nextID++
+	return dropped, nil
+}
+
+func (q *memoryQueue) Peek() (string, []byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.requests) == 0 {
+		return "", nil, nil
+	}
+	return q.requests[0].id, q.requests[0].request, nil
+}
+
+func (q *memoryQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.requests) > 0 && q.requests[0].id == id {
+		q.requests = q.requests[1:]
+	}
+	return nil
+}
+
+func (q *memoryQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.requests)
+}
+
+// diskQueue stores each request in a file of a directory, so that requests which haven't been sent survive restarts.
+// The files are named after the time they have been queued, thus their names sort in queue order.
+type diskQueue struct {
+	mutex     sync.Mutex
+	directory string
+	files     []string
+	size      int
+}
+
+// diskQueueFileSuffix is the suffix of queued requests, other files in the directory are ignored
+const diskQueueFileSuffix = ".snappy"
+
+func newDiskQueue(directory string, size int) (*diskQueue, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create queue directory: '%v'", err)
+	}
+	infos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("could not read queue directory: '%v'", err)
+	}
+	q := &diskQueue{directory: directory, size: size}
+	for _, info := range infos {
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") && strings.HasSuffix(info.Name(), diskQueueFileSuffix) {
+			q.files = append(q.files, info.Name())
+		}
+	}
+	sort.Strings(q.files)
+	for len(q.files) > q.size {
+		err = q.removeOldest()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *diskQueue) Push(request []byte) (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), diskQueueFileSuffix)
+	if len(q.files) > 0 && name <= q.files[len(q.files)-1] {
+		// Keep the queue order even if the clock went backwards
+		name = incrementName(q.files[len(q.files)-1])
+	}
+	// Write to a temporary file first, so that a crash never leaves a partially written request behind
+	file, err := ioutil.TempFile(q.directory, ".queue")
+	if err != nil {
+		return false, err
+	}
+	_, err = file.Write(request)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(q.directory, name))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return false, err
+	}
+	q.files = append(q.files, name)
+
+	dropped := false
+	if len(q.files) > q.size {
+		dropped = true
+		err = q.removeOldest()
+	}
+	return dropped, err
+}
+
+func (q *diskQueue) Peek() (string, []byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.files) == 0 {
+		return "", nil, nil
+	}
+	request, err := ioutil.ReadFile(filepath.Join(q.directory, q.files[0]))
+	return q.files[0], request, err
+}
+
+func (q *diskQueue) Remove(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.files) == 0 || q.files[0] != id {
+		return nil
+	}
+	return q.removeOldest()
+}
+
+func (q *diskQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.files)
+}
+
+func (q *diskQueue) removeOldest() error {
+	err := os.Remove(filepath.Join(q.directory, q.files[0]))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.files = q.files[1:]
+	return nil
+}
+
+// incrementName returns the name of the file queued right after the given one
+func incrementName(name string) string {
+	var nanos int64
+	fmt.Sscanf(strings.TrimSuffix(name, diskQueueFileSuffix), "%d", &nanos)
+	return fmt.Sprintf("%020d%s", nanos+1, diskQueueFileSuffix)
+}
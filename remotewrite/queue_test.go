@@ -0,0 +1,142 @@
+package remotewrite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// drain removes all requests from the queue and returns them in queue order
+func drain(t *testing.T, q queue) []string {
+	t.Helper()
+	var requests []string
+	for {
+		id, request, err := q.Peek()
+		if err != nil {
+			t.Fatalf("could not peek: %v", err)
+		}
+		if request == nil {
+			return requests
+		}
+		requests = append(requests, string(request))
+		if err = q.Remove(id); err != nil {
+			t.Fatalf("could not remove %s: %v", id, err)
+		}
+	}
+}
+
+func push(t *testing.T, q queue, request string, expectDropped bool) {
+	t.Helper()
+	dropped, err := q.Push([]byte(request))
+	if err != nil {
+		t.Fatalf("could not push %s: %v", request, err)
+	}
+	if dropped != expectDropped {
+		t.Errorf("pushing %s dropped = %v, expected %v", request, dropped, expectDropped)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	directory, err := ioutil.TempDir("", "remotewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(directory)
+	})
+	return directory
+}
+
+func TestQueue(t *testing.T) {
+	newQueues := map[string]func(t *testing.T, size int) queue{
+		"memory": func(t *testing.T, size int) queue {
+			return newMemoryQueue(size)
+		},
+		"disk": func(t *testing.T, size int) queue {
+			q, err := newDiskQueue(tempDir(t), size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return q
+		},
+	}
+	for name, newQueue := range newQueues {
+		t.Run(name, func(t *testing.T) {
+			q := newQueue(t, 3)
+			push(t, q, "a", false)
+			push(t, q, "b", false)
+			push(t, q, "c", false)
+			push(t, q, "d", true)
+			if q.Len() != 3 {
+				t.Errorf("len = %d, expected 3", q.Len())
+			}
+
+			// Removing a request which has been dropped meanwhile must not remove another one
+			id, _, _ := q.Peek()
+			push(t, q, "e", true)
+			if err := q.Remove(id); err != nil {
+				t.Fatal(err)
+			}
+			if actual := drain(t, q); !reflect.DeepEqual(actual, []string{"c", "d", "e"}) {
+				t.Errorf("queued requests = %v, expected [c d e]", actual)
+			}
+		})
+	}
+}
+
+func TestDiskQueueRestart(t *testing.T) {
+	directory := tempDir(t)
+	q, err := newDiskQueue(directory, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range []string{"a", "b", "c", "d"} {
+		push(t, q, request, false)
+	}
+	// Other files and interrupted writes are ignored
+	ioutil.WriteFile(filepath.Join(directory, "README"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(directory, ".queue123"), []byte("x"), 0644)
+
+	// A restart with a smaller queue drops the oldest requests
+	q, err = newDiskQueue(directory, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("len after restart = %d, expected 2", q.Len())
+	}
+	push(t, q, "e", true)
+
+	q, err = newDiskQueue(directory, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := drain(t, q); !reflect.DeepEqual(actual, []string{"d", "e"}) {
+		t.Errorf("queued requests after restart = %v, expected [d e]", actual)
+	}
+	files, _ := filepath.Glob(filepath.Join(directory, "*"+diskQueueFileSuffix))
+	if len(files) != 0 {
+		t.Errorf("files of removed requests are left behind: %v", files)
+	}
+}
+
+func TestDiskQueueOrder(t *testing.T) {
+	directory := tempDir(t)
+	// A request queued "in the future", e. g. before the clock was set back
+	future := "09000000000000000000" + diskQueueFileSuffix
+	if err := ioutil.WriteFile(filepath.Join(directory, future), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	q, err := newDiskQueue(directory, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push(t, q, "b", false)
+	push(t, q, "c", false)
+	if actual := drain(t, q); !reflect.DeepEqual(actual, []string{"a", "b", "c"}) {
+		t.Errorf("queued requests = %v, expected [a b c]", actual)
+	}
+}
@@ -0,0 +1,289 @@
+// Package remotewrite pushes the metrics of kube eagle via the Prometheus remote write protocol, for clusters which
+// Prometheus can't scrape (e. g. edge clusters behind NAT)
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// GatherFunc gathers the metrics to push. The context is cancelled if gathering times out.
+type GatherFunc func(ctx context.Context) ([]*dto.MetricFamily, error)
+
+// Writer gathers the metrics in a fixed interval and queues them as remote write requests, which are sent one after
+// another in queue order. Failed requests are retried with an exponential backoff, unless the endpoint rejected them.
+type Writer struct {
+	url             string
+	interval        time.Duration
+	timeout         time.Duration
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	username        string
+	passwordFile    string
+	bearerTokenFile string
+	client          *http.Client
+	gather          GatherFunc
+	isLeader        func() bool
+	queue           queue
+	queued          chan struct{}
+
+	lastSuccessTimestamp prometheus.Gauge
+	retries              prometheus.Counter
+	dropped              *prometheus.CounterVec
+}
+
+// New creates a writer pushing to the configured endpoint. isLeader may be nil if no leader is elected, otherwise only
+// the leader queues metrics.
+func New(opts *options.Options, gather GatherFunc, isLeader func() bool) (*Writer, error) {
+	var q queue
+	if opts.RemoteWriteQueueDirectory != "" {
+		var err error
+		q, err = newDiskQueue(opts.RemoteWriteQueueDirectory, opts.RemoteWriteQueueSize)
+		if err != nil {
+			return nil, err
+		}
+		if q.Len() > 0 {
+			log.Infof("Found %d queued remote write requests, which will be sent first", q.Len())
+		}
+	} else {
+		q = newMemoryQueue(opts.RemoteWriteQueueSize)
+	}
+
+	w := &Writer{
+		url:             opts.RemoteWriteURL,
+		interval:        opts.RemoteWriteInterval,
+		timeout:         opts.RemoteWriteTimeout,
+		minBackoff:      opts.RemoteWriteMinBackoff,
+		maxBackoff:      opts.RemoteWriteMaxBackoff,
+		username:        opts.RemoteWriteUsername,
+		passwordFile:    opts.RemoteWritePasswordFile,
+		bearerTokenFile: opts.RemoteWriteBearerTokenFile,
+		client:          &http.Client{},
+		gather:          gather,
+		isLeader:        isLeader,
+		queue:           q,
+		queued:          make(chan struct{}, 1),
+		lastSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "remote_write",
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Kube Eagle: Timestamp of the last successful remote write request.",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "remote_write",
+			Name:      "retries_total",
+			Help:      "Kube Eagle: Number of failed remote write requests which have been retried.",
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: opts.Namespace,
+			Subsystem: "remote_write",
+			Name:      "dropped_requests_total",
+			Help:      "Kube Eagle: Number of remote write requests which have been dropped by reason (queue_full or rejected).",
+		}, []string{"reason"}),
+	}
+	queueLength := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: opts.Namespace,
+		Subsystem: "remote_write",
+		Name:      "queue_length",
+		Help:      "Kube Eagle: Number of remote write requests which haven't been sent yet.",
+	}, func() float64 {
+		return float64(q.Len())
+	})
+	prometheus.MustRegister(w.lastSuccessTimestamp, w.retries, w.dropped, queueLength)
+
+	return w, nil
+}
+
+// Run queues the metrics in every interval and sends the queued requests until the context is cancelled. Requests
+// which are still queued in memory on shutdown are lost.
+func (w *Writer) Run(ctx context.Context) {
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		w.sendQueued(ctx)
+	}()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			<-sent
+			if _, isMemoryQueue := w.queue.(*memoryQueue); isMemoryQueue && w.queue.Len() > 0 {
+				log.Warnf("Discarding %d remote write requests which haven't been sent", w.queue.Len())
+			}
+			return
+		case now := <-ticker.C:
+			if w.isLeader != nil && !w.isLeader() {
+				log.Debug("Skipping remote write, as this replica is not the leader")
+				continue
+			}
+			err := w.enqueue(ctx, now)
+			if err != nil {
+				log.Errorf("Failed to queue remote write request: %v", err)
+			}
+		}
+	}
+}
+
+// enqueue gathers the metrics and queues them as a single remote write request
+func (w *Writer) enqueue(ctx context.Context, now time.Time) error {
+	gatherCtx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	families, err := w.gather(gatherCtx)
+	if err != nil {
+		// Gatherers return all metrics they could gather along with the error, e. g. if a single cluster failed
+		log.Warnf("Failed to gather some metrics for remote write: %v", err)
+	}
+	if len(families) == 0 {
+		return fmt.Errorf("no metrics have been gathered")
+	}
+
+	series := convert(families, now)
+	dropped, err := w.queue.Push(snappy.Encode(nil, marshalWriteRequest(series)))
+	if dropped {
+		log.Warn("Remote write queue is full, dropped the oldest request")
+		w.dropped.WithLabelValues("queue_full").Inc()
+	}
+	if err != nil {
+		return err
+	}
+	log.Debugf("Queued remote write request with %d series", len(series))
+
+	select {
+	case w.queued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sendQueued sends the queued requests in queue order until the context is cancelled
+func (w *Writer) sendQueued(ctx context.Context) {
+	backoff := w.minBackoff
+	for {
+		id, request, err := w.queue.Peek()
+		if err != nil {
+			log.Errorf("Failed to read queued remote write request, dropping it: %v", err)
+			if w.remove(id) != nil {
+				// Don't spin if the queue directory is broken
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(w.maxBackoff):
+				}
+			}
+			continue
+		}
+		if request == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.queued:
+				continue
+			}
+		}
+
+		isRetryable, err := w.send(ctx, request)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			w.lastSuccessTimestamp.SetToCurrentTime()
+			w.remove(id)
+			backoff = w.minBackoff
+			continue
+		}
+		if !isRetryable {
+			log.Errorf("Remote write endpoint rejected request, dropping it: %v", err)
+			w.dropped.WithLabelValues("rejected").Inc()
+			w.remove(id)
+			continue
+		}
+
+		log.Warnf("Remote write request failed, retrying in %v: %v", backoff, err)
+		w.retries.Inc()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// remove removes the sent (or dropped) request from the queue. A full queue might have dropped it meanwhile.
+func (w *Writer) remove(id string) error {
+	err := w.queue.Remove(id)
+	if err != nil {
+		log.Errorf("Failed to remove remote write request from queue: %v", err)
+	}
+	return err
+}
+
+// send sends a single request and returns whether it may be retried if it failed. Like Prometheus, server errors,
+// 429 (too many requests) and network errors are retried, whereas other client errors are not.
+func (w *Writer) send(ctx context.Context, request []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(request))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "kube-eagle")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	err = w.authenticate(req)
+	if err != nil {
+		return true, err
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+	if res.StatusCode >= 200 && res.StatusCode <= 299 {
+		return false, nil
+	}
+	err = fmt.Errorf("endpoint responded with status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	return res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests, err
+}
+
+// authenticate adds basic auth or the bearer token to the request. The secrets are read on every request, so that
+// they can be rotated without a restart.
+func (w *Writer) authenticate(req *http.Request) error {
+	if w.username != "" {
+		password, err := ioutil.ReadFile(w.passwordFile)
+		if err != nil {
+			return fmt.Errorf("could not read password file: '%v'", err)
+		}
+		req.SetBasicAuth(w.username, strings.TrimSpace(string(password)))
+	}
+	if w.bearerTokenFile != "" {
+		token, err := ioutil.ReadFile(w.bearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("could not read bearer token file: '%v'", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return nil
+}
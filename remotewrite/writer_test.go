@@ -0,0 +1,215 @@
+package remotewrite
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSendRetryable(t *testing.T) {
+	tests := []struct {
+		status      int
+		isRetryable bool
+		isError     bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNoContent},
+		{status: http.StatusBadRequest, isError: true},
+		{status: http.StatusUnauthorized, isError: true},
+		{status: http.StatusRequestEntityTooLarge, isError: true},
+		{status: http.StatusTooManyRequests, isRetryable: true, isError: true},
+		{status: http.StatusInternalServerError, isRetryable: true, isError: true},
+		{status: http.StatusServiceUnavailable, isRetryable: true, isError: true},
+	}
+	for _, test := range tests {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			w := &Writer{url: server.URL, timeout: time.Second, client: server.Client()}
+			isRetryable, err := w.send(context.Background(), []byte("request"))
+			if isRetryable != test.isRetryable || (err != nil) != test.isError {
+				t.Errorf("send = (%v, %v), expected retryable %v and error %v", isRetryable, err, test.isRetryable, test.isError)
+			}
+		})
+	}
+
+	t.Run("network error", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+		w := &Writer{url: server.URL, timeout: time.Second, client: &http.Client{}}
+		isRetryable, err := w.send(context.Background(), []byte("request"))
+		if !isRetryable || err == nil {
+			t.Errorf("send = (%v, %v), expected a retryable error", isRetryable, err)
+		}
+	})
+}
+
+func TestSendAuthentication(t *testing.T) {
+	directory := tempDir(t)
+	passwordFile := filepath.Join(directory, "password")
+	tokenFile := filepath.Join(directory, "token")
+	ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600)
+	ioutil.WriteFile(tokenFile, []byte(" token\n"), 0600)
+
+	tests := []struct {
+		name     string
+		writer   Writer
+		expected string
+	}{
+		{name: "none", expected: ""},
+		{name: "basic", writer: Writer{username: "eagle", passwordFile: passwordFile}, expected: "Basic ZWFnbGU6c2VjcmV0"},
+		{name: "bearer", writer: Writer{bearerTokenFile: tokenFile}, expected: "Bearer token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var authorization string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				authorization = r.Header.Get("Authorization")
+			}))
+			defer server.Close()
+
+			w := test.writer
+			w.url, w.timeout, w.client = server.URL, time.Second, server.Client()
+			if _, err := w.send(context.Background(), []byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			if authorization != test.expected {
+				t.Errorf("Authorization = %q, expected %q", authorization, test.expected)
+			}
+		})
+	}
+
+	t.Run("missing password file", func(t *testing.T) {
+		w := &Writer{url: "http://localhost", timeout: time.Second, client: &http.Client{}, username: "eagle", passwordFile: filepath.Join(directory, "missing")}
+		if isRetryable, err := w.send(context.Background(), []byte("request")); !isRetryable || err == nil {
+			t.Errorf("send = (%v, %v), expected a retryable error", isRetryable, err)
+		}
+	})
+}
+
+func TestEnqueueAndSend(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	gather := func(ctx context.Context) ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{{
+			Name:   proto.String("eagle_up"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		}}, nil
+	}
+	w := newTestWriter(server, gather)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.sendQueued(ctx)
+	if err := w.enqueue(ctx, time.Unix(1600000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	var r *http.Request
+	select {
+	case r = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request hasn't been sent")
+	}
+	for header, expected := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if r.Header.Get(header) != expected {
+			t.Errorf("%s = %q, expected %q", header, r.Header.Get(header), expected)
+		}
+	}
+	request, err := snappy.Decode(nil, <-bodies)
+	if err != nil {
+		t.Fatalf("could not decompress request: %v", err)
+	}
+	series := decodeWriteRequest(t, request)
+	if sample, ok := series["__name__=eagle_up,"]; !ok || sample.Value != 1 || sample.Timestamp != 1600000000000 {
+		t.Errorf("decoded series = %v, expected eagle_up 1 at 1600000000000", series)
+	}
+}
+
+func TestSendQueuedRetriesAndDrops(t *testing.T) {
+	// The first request is retried after a server error and then rejected, the second one is accepted
+	statuses := make(chan int, 3)
+	statuses <- http.StatusServiceUnavailable
+	statuses <- http.StatusBadRequest
+	statuses <- http.StatusOK
+	bodies := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(<-statuses)
+	}))
+	defer server.Close()
+
+	w := newTestWriter(server, nil)
+	w.queue.Push([]byte("a"))
+	w.queue.Push([]byte("b"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.sendQueued(ctx)
+
+	for _, expected := range []string{"a", "a", "b"} {
+		select {
+		case body := <-bodies:
+			if body != expected {
+				t.Errorf("sent %q, expected %q", body, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request %q hasn't been sent", expected)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for w.queue.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if w.queue.Len() != 0 {
+		t.Errorf("queue length = %d, expected 0", w.queue.Len())
+	}
+	if retries := testutil.ToFloat64(w.retries); retries != 1 {
+		t.Errorf("retries = %v, expected 1", retries)
+	}
+	if dropped := testutil.ToFloat64(w.dropped.WithLabelValues("rejected")); dropped != 1 {
+		t.Errorf("rejected requests = %v, expected 1", dropped)
+	}
+}
+
+// newTestWriter creates a writer with a memory queue, whose metrics aren't registered, that sends to the test server
+func newTestWriter(server *httptest.Server, gather GatherFunc) *Writer {
+	return &Writer{
+		url:        server.URL,
+		timeout:    time.Second,
+		minBackoff: time.Millisecond,
+		maxBackoff: time.Millisecond,
+		client:     server.Client(),
+		gather:     gather,
+		queue:      newMemoryQueue(10),
+		queued:     make(chan struct{}, 1),
+
+		lastSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{Name: "last_success_timestamp_seconds"}),
+		retries:              prometheus.NewCounter(prometheus.CounterOpts{Name: "retries_total"}),
+		dropped:              prometheus.NewCounterVec(prometheus.CounterOpts{Name: "dropped_requests_total"}, []string{"reason"}),
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"github.com/google-cloud-tools/kube-eagle/report"
+	log "github.com/sirupsen/logrus"
+)
+
+// runReport takes a single snapshot of all configured clusters and prints an allocation report, instead of serving
+// metrics. It accepts the same options as the exporter (e. g. --kube-context or --include-namespaces).
+func runReport(args []string) error {
+	// Logs are written to stderr, so that they don't mix with the report
+	log.SetOutput(os.Stderr)
+	log.SetFormatter(&log.TextFormatter{})
+
+	flagSet := flag.NewFlagSet("kube-eagle report", flag.ContinueOnError)
+	output := flagSet.String("output", report.OutputTable, "Output format (table, json, csv or markdown)")
+	top := flagSet.Int("top", 10, "Number of over and under provisioned containers to list")
+	rankBy := flagSet.String("rank-by", report.RankByCPU, "Resource to rank the containers by (cpu or memory)")
+	opts, err := options.LoadWithFlagSet(flagSet, args)
+	if err != nil {
+		return err
+	}
+	// The version is only used in the user agent, thus it's not required for reports
+	if opts.Version == "" {
+		opts.Version = "unknown"
+	}
+	err = opts.Validate()
+	if err != nil {
+		return err
+	}
+	err = report.ValidateOutput(*output)
+	if err != nil {
+		return err
+	}
+	err = report.ValidateRankBy(*rankBy)
+	if err != nil {
+		return err
+	}
+	level, _ := log.ParseLevel(opts.LogLevel)
+	log.SetLevel(level)
+
+	clients, err := kubernetes.NewClients(opts)
+	if err != nil {
+		return fmt.Errorf("could not initialize kubernetes clients: '%v'", err)
+	}
+	eagleCollector, err := collector.New(clients, opts)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	reports, errorsByCluster := eagleCollector.Reports(ctx, collector.ReportFilter{})
+	clusters := make([]string, 0, len(errorsByCluster))
+	for cluster := range errorsByCluster {
+		clusters = append(clusters, cluster)
+	}
+	sort.Strings(clusters)
+	for _, cluster := range clusters {
+		log.Errorf("Failed to fetch resources of cluster '%s': %v", cluster, errorsByCluster[cluster])
+	}
+	if len(reports) == 0 {
+		return fmt.Errorf("couldn't fetch the resources of any cluster")
+	}
+
+	summary, err := report.Build(reports, *top, *rankBy)
+	if err != nil {
+		return err
+	}
+	return report.Write(os.Stdout, summary, *output)
+}
@@ -0,0 +1,213 @@
+package report
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats of a summary
+const (
+	OutputTable    = "table"
+	OutputJSON     = "json"
+	OutputCSV      = "csv"
+	OutputMarkdown = "markdown"
+)
+
+// table is a titled table of a summary, whose values are already formatted
+type table struct {
+	title  string
+	header []string
+	rows   [][]string
+}
+
+// Write writes the summary in the given output format. Table and markdown outputs contain human readable values,
+// whereas CSV contains the raw values (cores, bytes and percentages) with one table after another, separated by an
+// empty line.
+func Write(w io.Writer, summary *Summary, output string) error {
+	switch output {
+	case OutputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summary)
+	case OutputTable:
+		return writeTables(w, summary.tables(true))
+	case OutputCSV:
+		return writeCSV(w, summary.tables(false))
+	case OutputMarkdown:
+		return writeMarkdown(w, summary.tables(true))
+	default:
+		return ValidateOutput(output)
+	}
+}
+
+// ValidateOutput returns an error if the given output format is unknown
+func ValidateOutput(output string) error {
+	switch output {
+	case OutputTable, OutputJSON, OutputCSV, OutputMarkdown:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format '%s', must be one of %s, %s, %s or %s", output, OutputTable, OutputJSON, OutputCSV, OutputMarkdown)
+	}
+}
+
+// tables converts the summary into tables. Human readable values are rounded and use binary units for bytes.
+func (s *Summary) tables(isHuman bool) []table {
+	f := formatter{isHuman: isHuman}
+	hasClusters := false
+	for _, node := range s.Nodes {
+		hasClusters = hasClusters || node.Cluster != ""
+	}
+	for _, c := range append(append([]ContainerAllocation{}, s.OverProvisioned...), s.UnderProvisioned...) {
+		hasClusters = hasClusters || c.Cluster != ""
+	}
+	withCluster := func(cluster string, values ...string) []string {
+		if !hasClusters {
+			return values
+		}
+		return append([]string{cluster}, values...)
+	}
+
+	nodes := table{
+		title:  "Nodes",
+		header: withCluster("CLUSTER", "NODE", "CPU ALLOCATABLE", "CPU REQUESTED", "CPU LIMITED", "CPU USED", "MEMORY ALLOCATABLE", "MEMORY REQUESTED", "MEMORY LIMITED", "MEMORY USED"),
+	}
+	for _, n := range s.Nodes {
+		nodes.rows = append(nodes.rows, withCluster(n.Cluster, n.Node,
+			f.cores(n.AllocatableCPUCores), f.percent(n.RequestedCPUPercent), f.percent(n.LimitedCPUPercent), f.percent(n.UsedCPUPercent),
+			f.bytes(n.AllocatableMemoryBytes), f.percent(n.RequestedMemoryPercent), f.percent(n.LimitedMemoryPercent), f.percent(n.UsedMemoryPercent),
+		))
+	}
+
+	containerTable := func(title string, containers []ContainerAllocation) table {
+		t := table{
+			title:  title,
+			header: withCluster("CLUSTER", "NAMESPACE", "POD", "CONTAINER", "CPU REQUEST", "CPU USAGE", "MEMORY REQUEST", "MEMORY USAGE"),
+		}
+		for _, c := range containers {
+			t.rows = append(t.rows, withCluster(c.Cluster, c.Namespace, c.Pod, c.Container,
+				f.cores(&c.RequestCPUCores), f.cores(&c.UsageCPUCores), f.bytes(&c.RequestMemoryBytes), f.bytes(&c.UsageMemoryBytes),
+			))
+		}
+		return t
+	}
+
+	return []table{
+		nodes,
+		containerTable("Top over-provisioned containers", s.OverProvisioned),
+		containerTable("Top under-provisioned containers", s.UnderProvisioned),
+	}
+}
+
+func writeTables(w io.Writer, tables []table) error {
+	for i, t := range tables {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, t.title)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+		for _, row := range t.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		err := tw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, tables []table) error {
+	for i, t := range tables {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		csvWriter := csv.NewWriter(w)
+		err := csvWriter.Write(t.header)
+		if err != nil {
+			return err
+		}
+		err = csvWriter.WriteAll(t.rows)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeMarkdown(w io.Writer, tables []table) error {
+	escape := strings.NewReplacer("|", `\|`)
+	for i, t := range tables {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "### %s\n\n", t.title)
+		fmt.Fprintf(w, "| %s |\n", strings.Join(t.header, " | "))
+		fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(t.header)))
+		for _, row := range t.rows {
+			escaped := make([]string, len(row))
+			for j, value := range row {
+				escaped[j] = escape.Replace(value)
+			}
+			_, err := fmt.Fprintf(w, "| %s |\n", strings.Join(escaped, " | "))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// formatter formats values either human readable or raw
+type formatter struct {
+	isHuman bool
+}
+
+func (f formatter) cores(value *float64) string {
+	if value == nil {
+		return f.unknown()
+	}
+	if f.isHuman {
+		return strconv.FormatFloat(*value, 'f', 2, 64)
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+func (f formatter) bytes(value *float64) string {
+	if value == nil {
+		return f.unknown()
+	}
+	if !f.isHuman {
+		return strconv.FormatFloat(*value, 'f', 0, 64)
+	}
+	units := []string{"B", "Ki", "Mi", "Gi", "Ti", "Pi"}
+	v := *value
+	unit := 0
+	for v >= 1024 && unit < len(units)-1 {
+		v /= 1024
+		unit++
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + units[unit]
+}
+
+func (f formatter) percent(value *float64) string {
+	if value == nil {
+		return f.unknown()
+	}
+	if f.isHuman {
+		return strconv.FormatFloat(*value, 'f', 0, 64) + "%"
+	}
+	return strconv.FormatFloat(*value, 'f', 2, 64)
+}
+
+func (f formatter) unknown() string {
+	if f.isHuman {
+		return "-"
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+// Package report summarizes the resource allocation of clusters for the one-shot report subcommand
+package report
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Resources by which containers can be ranked
+const (
+	RankByCPU    = "cpu"
+	RankByMemory = "memory"
+)
+
+// Summary is the allocation report of one or more clusters
+type Summary struct {
+	Nodes            []NodeAllocation      `json:"nodes"`
+	OverProvisioned  []ContainerAllocation `json:"over_provisioned_containers"`
+	UnderProvisioned []ContainerAllocation `json:"under_provisioned_containers"`
+}
+
+// NodeAllocation is a node's allocatable resources and the share which is requested, limited and used. Percentages
+// are nil if they are unknown (e. g. without permissions to list nodes or node metrics).
+type NodeAllocation struct {
+	Cluster                string   `json:"cluster"`
+	Node                   string   `json:"node"`
+	AllocatableCPUCores    *float64 `json:"allocatable_cpu_cores"`
+	RequestedCPUPercent    *float64 `json:"requested_cpu_percent"`
+	LimitedCPUPercent      *float64 `json:"limited_cpu_percent"`
+	UsedCPUPercent         *float64 `json:"used_cpu_percent"`
+	AllocatableMemoryBytes *float64 `json:"allocatable_memory_bytes"`
+	RequestedMemoryPercent *float64 `json:"requested_memory_percent"`
+	LimitedMemoryPercent   *float64 `json:"limited_memory_percent"`
+	UsedMemoryPercent      *float64 `json:"used_memory_percent"`
+}
+
+// ContainerAllocation compares a running container's requests with its usage
+type ContainerAllocation struct {
+	Cluster            string  `json:"cluster"`
+	Namespace          string  `json:"namespace"`
+	Pod                string  `json:"pod"`
+	Container          string  `json:"container"`
+	RequestCPUCores    float64 `json:"request_cpu_cores"`
+	UsageCPUCores      float64 `json:"usage_cpu_cores"`
+	RequestMemoryBytes float64 `json:"request_memory_bytes"`
+	UsageMemoryBytes   float64 `json:"usage_memory_bytes"`
+}
+
+// unusedRequest returns the requested but unused amount of the given resource. It's negative for containers using
+// more than they request.
+func (c ContainerAllocation) unusedRequest(rankBy string) float64 {
+	if rankBy == RankByMemory {
+		return c.RequestMemoryBytes - c.UsageMemoryBytes
+	}
+	return c.RequestCPUCores - c.UsageCPUCores
+}
+
+// key identifies the container across clusters
+func (c ContainerAllocation) key() string {
+	return c.Cluster + "/" + c.Namespace + "/" + c.Pod + "/" + c.Container
+}
+
+// Build summarizes the given cluster reports. The over and under provisioned lists contain the top running
+// containers whose requests of the given resource exceed their usage the most, or fall short of it the most.
+func Build(reports []*collector.Report, top int, rankBy string) (*Summary, error) {
+	err := ValidateRankBy(rankBy)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{
+		Nodes:            []NodeAllocation{},
+		OverProvisioned:  []ContainerAllocation{},
+		UnderProvisioned: []ContainerAllocation{},
+	}
+	var containers []ContainerAllocation
+	for _, report := range reports {
+		for _, node := range report.Nodes {
+			summary.Nodes = append(summary.Nodes, NodeAllocation{
+				Cluster:                report.Cluster,
+				Node:                   node.Node,
+				AllocatableCPUCores:    node.AllocatableCPUCores,
+				RequestedCPUPercent:    percent(&node.RequestCPUCores, node.AllocatableCPUCores),
+				LimitedCPUPercent:      percent(&node.LimitCPUCores, node.AllocatableCPUCores),
+				UsedCPUPercent:         percent(node.UsageCPUCores, node.AllocatableCPUCores),
+				AllocatableMemoryBytes: node.AllocatableMemoryBytes,
+				RequestedMemoryPercent: percent(&node.RequestMemoryBytes, node.AllocatableMemoryBytes),
+				LimitedMemoryPercent:   percent(&node.LimitMemoryBytes, node.AllocatableMemoryBytes),
+				UsedMemoryPercent:      percent(node.UsageMemoryBytes, node.AllocatableMemoryBytes),
+			})
+		}
+
+		for _, c := range report.Containers {
+			// Only running containers have a meaningful usage
+			if c.Init || c.Phase != string(corev1.PodRunning) {
+				continue
+			}
+			containers = append(containers, ContainerAllocation{
+				Cluster:            report.Cluster,
+				Namespace:          c.Namespace,
+				Pod:                c.Pod,
+				Container:          c.Container,
+				RequestCPUCores:    c.RequestCPUCores,
+				UsageCPUCores:      c.UsageCPUCores,
+				RequestMemoryBytes: c.RequestMemoryBytes,
+				UsageMemoryBytes:   c.UsageMemoryBytes,
+			})
+		}
+	}
+
+	// Containers with the same unused request are ranked by name in both lists, so that the ranking is stable
+	sort.Slice(containers, func(i, j int) bool {
+		a, b := containers[i].unusedRequest(rankBy), containers[j].unusedRequest(rankBy)
+		if a != b {
+			return a > b
+		}
+		return containers[i].key() < containers[j].key()
+	})
+	for i := 0; i < len(containers) && len(summary.OverProvisioned) < top; i++ {
+		if containers[i].unusedRequest(rankBy) > 0 {
+			summary.OverProvisioned = append(summary.OverProvisioned, containers[i])
+		}
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		a, b := containers[i].unusedRequest(rankBy), containers[j].unusedRequest(rankBy)
+		if a != b {
+			return a < b
+		}
+		return containers[i].key() < containers[j].key()
+	})
+	for i := 0; i < len(containers) && len(summary.UnderProvisioned) < top; i++ {
+		if containers[i].unusedRequest(rankBy) < 0 {
+			summary.UnderProvisioned = append(summary.UnderProvisioned, containers[i])
+		}
+	}
+
+	return summary, nil
+}
+
+// ValidateRankBy returns an error if containers can't be ranked by the given resource
+func ValidateRankBy(rankBy string) error {
+	if rankBy != RankByCPU && rankBy != RankByMemory {
+		return fmt.Errorf("unknown resource '%s' to rank containers by, must be either '%s' or '%s'", rankBy, RankByCPU, RankByMemory)
+	}
+	return nil
+}
+
+// percent returns the share of value in total in percent, or nil if any of them is unknown
+func percent(value *float64, total *float64) *float64 {
+	if value == nil || total == nil || *total == 0 {
+		return nil
+	}
+	p := *value / *total * 100
+	return &p
+}
@@ -0,0 +1,144 @@
+package report
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/collector"
+	"github.com/google-cloud-tools/kube-eagle/internal/kubetest"
+	"github.com/google-cloud-tools/kube-eagle/kubernetes"
+	corev1 "k8s.io/api/core/v1"
+	v1beta1 "k8s.io/metrics/pkg/apis/metrics/v1beta1"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// fixtureReport returns the report of the fixture cluster, whose DNS pod uses more CPU than it requests. Without
+// node permissions, the nodes' allocatable resources and usage are unknown.
+func fixtureReport(cluster string, hasNodePermissions bool) *collector.Report {
+	objects := kubetest.Fixture()
+	objects.PodMetricses[2] = kubetest.PodMetrics("kube-system", "dns", nil, kubetest.ContainerMetrics("dns", "300m", "40Mi"))
+	snapshot := &kubernetes.Snapshot{
+		Cluster:      cluster,
+		FetchedAt:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Pods:         &corev1.PodList{Items: objects.Pods},
+		PodMetricses: &v1beta1.PodMetricsList{Items: objects.PodMetricses},
+	}
+	if hasNodePermissions {
+		snapshot.Nodes = &corev1.NodeList{Items: objects.Nodes}
+		snapshot.NodeMetricses = &v1beta1.NodeMetricsList{Items: objects.NodeMetricses}
+	}
+	return collector.BuildReport(snapshot, collector.ReportFilter{})
+}
+
+// containerNames returns the containers as namespace/pod/container
+func containerNames(containers []ContainerAllocation) []string {
+	names := []string{}
+	for _, c := range containers {
+		names = append(names, c.Namespace+"/"+c.Pod+"/"+c.Container)
+	}
+	return names
+}
+
+func TestBuildRanking(t *testing.T) {
+	tests := []struct {
+		rankBy                   string
+		top                      int
+		expectedOverProvisioned  []string
+		expectedUnderProvisioned []string
+	}{
+		{
+			rankBy:                   RankByCPU,
+			top:                      2,
+			expectedOverProvisioned:  []string{"default/web-1/app", "default/web-2/app"},
+			expectedUnderProvisioned: []string{"kube-system/dns/dns"},
+		},
+		{
+			rankBy:                   RankByMemory,
+			top:                      5,
+			expectedOverProvisioned:  []string{"default/web-1/app", "default/web-1/sidecar", "kube-system/dns/dns"},
+			expectedUnderProvisioned: []string{"default/web-2/app"},
+		},
+		{
+			rankBy:                   RankByCPU,
+			top:                      0,
+			expectedOverProvisioned:  []string{},
+			expectedUnderProvisioned: []string{},
+		},
+	}
+	for _, test := range tests {
+		summary, err := Build([]*collector.Report{fixtureReport("a", true)}, test.top, test.rankBy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Pending and succeeded pods aren't ranked, as they don't have a meaningful usage
+		if actual := containerNames(summary.OverProvisioned); !reflect.DeepEqual(actual, test.expectedOverProvisioned) {
+			t.Errorf("top %d over-provisioned by %s = %v, expected %v", test.top, test.rankBy, actual, test.expectedOverProvisioned)
+		}
+		if actual := containerNames(summary.UnderProvisioned); !reflect.DeepEqual(actual, test.expectedUnderProvisioned) {
+			t.Errorf("top %d under-provisioned by %s = %v, expected %v", test.top, test.rankBy, actual, test.expectedUnderProvisioned)
+		}
+	}
+
+	if _, err := Build(nil, 10, "disk"); err == nil {
+		t.Errorf("ranking by disk succeeded, expected an error")
+	}
+}
+
+func TestBuildNodes(t *testing.T) {
+	summary, err := Build([]*collector.Report{fixtureReport("a", true), fixtureReport("b", false)}, 10, RankByCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodesByName := make(map[string]NodeAllocation)
+	for _, node := range summary.Nodes {
+		nodesByName[node.Cluster+"/"+node.Node] = node
+	}
+
+	// node-b: web-2 and dns request 0.6 of 2 cores and use 500m
+	node := nodesByName["a/node-b"]
+	if node.RequestedCPUPercent == nil || *node.RequestedCPUPercent != 30 || node.UsedCPUPercent == nil || *node.UsedCPUPercent != 25 {
+		t.Errorf("node-b of cluster a = %+v, expected 30%% requested and 25%% used CPU", node)
+	}
+	node = nodesByName["b/node-b"]
+	if node.AllocatableCPUCores != nil || node.RequestedCPUPercent != nil || node.UsedMemoryPercent != nil {
+		t.Errorf("node-b of cluster b = %+v, expected unknown allocatable resources and percentages", node)
+	}
+}
+
+func TestWriteGolden(t *testing.T) {
+	summary, err := Build([]*collector.Report{fixtureReport("a", true), fixtureReport("b", false)}, 3, RankByCPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for output, extension := range map[string]string{OutputTable: "txt", OutputJSON: "json", OutputCSV: "csv", OutputMarkdown: "md"} {
+		t.Run(output, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := Write(&buffer, summary, output); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", "summary."+extension)
+			if *update {
+				if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buffer.Bytes(), expected) {
+				t.Errorf("%s output differs from %s (run the tests with -update after verifying the changes):\n%s", output, path, buffer.String())
+			}
+		})
+	}
+
+	if err := Write(&bytes.Buffer{}, summary, "yaml"); err == nil {
+		t.Errorf("writing yaml succeeded, expected an error")
+	}
+}
@@ -0,0 +1,190 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the web config file, compatible with the Prometheus exporter-toolkit format
+type Config struct {
+	TLSServerConfig  TLSServerConfig   `json:"tls_server_config"`
+	HTTPServerConfig HTTPServerConfig  `json:"http_server_config"`
+	BasicAuthUsers   map[string]string `json:"basic_auth_users"`
+}
+
+// TLSServerConfig configures TLS and client certificate authentication. TLS is disabled if no certificate is set.
+type TLSServerConfig struct {
+	CertFile                 string   `json:"cert_file"`
+	KeyFile                  string   `json:"key_file"`
+	ClientAuthType           string   `json:"client_auth_type"`
+	ClientCAFile             string   `json:"client_ca_file"`
+	MinVersion               string   `json:"min_version"`
+	MaxVersion               string   `json:"max_version"`
+	CipherSuites             []string `json:"cipher_suites"`
+	CurvePreferences         []string `json:"curve_preferences"`
+	PreferServerCipherSuites bool     `json:"prefer_server_cipher_suites"`
+}
+
+// HTTPServerConfig configures the HTTP responses
+type HTTPServerConfig struct {
+	Headers map[string]string `json:"headers"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+// loadConfig reads and validates the web config file. Relative file paths in the config are resolved relative to the
+// config file's directory.
+func loadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	err = yaml.UnmarshalStrict(content, config)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &config.TLSServerConfig
+	dir := filepath.Dir(path)
+	tlsConfig.CertFile = resolvePath(dir, tlsConfig.CertFile)
+	tlsConfig.KeyFile = resolvePath(dir, tlsConfig.KeyFile)
+	tlsConfig.ClientCAFile = resolvePath(dir, tlsConfig.ClientCAFile)
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return nil, fmt.Errorf("both cert_file and key_file must be set to enable TLS")
+	}
+	if !tlsConfig.enabled() && (tlsConfig.ClientCAFile != "" || tlsConfig.ClientAuthType != "") {
+		return nil, fmt.Errorf("client certificate authentication requires TLS (cert_file and key_file)")
+	}
+
+	return config, nil
+}
+
+func resolvePath(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func (c *TLSServerConfig) enabled() bool {
+	return c.CertFile != ""
+}
+
+// files returns all files referenced by the TLS config, so that they can be watched for changes
+func (c *TLSServerConfig) files() []string {
+	var files []string
+	for _, file := range []string{c.CertFile, c.KeyFile, c.ClientCAFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// build creates the TLS config, loading the certificate and client CAs from disk
+func (c *TLSServerConfig) build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: c.PreferServerCipherSuites,
+	}
+
+	if c.MinVersion != "" {
+		version, exists := tlsVersions[c.MinVersion]
+		if !exists {
+			return nil, fmt.Errorf("unknown min_version '%s'", c.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if c.MaxVersion != "" {
+		version, exists := tlsVersions[c.MaxVersion]
+		if !exists {
+			return nil, fmt.Errorf("unknown max_version '%s'", c.MaxVersion)
+		}
+		tlsConfig.MaxVersion = version
+	}
+
+	if len(c.CipherSuites) > 0 {
+		cipherSuiteByName := make(map[string]uint16)
+		for _, cipherSuite := range tls.CipherSuites() {
+			cipherSuiteByName[cipherSuite.Name] = cipherSuite.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, exists := cipherSuiteByName[name]
+			if !exists {
+				return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	for _, name := range c.CurvePreferences {
+		curve, exists := curves[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown curve '%s'", name)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	if c.ClientCAFile != "" {
+		content, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("client CA file '%s' doesn't contain any PEM encoded certificate", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		// A client CA without explicit client auth type requires verified client certificates
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if c.ClientAuthType != "" {
+		clientAuth, exists := clientAuthTypes[c.ClientAuthType]
+		if !exists {
+			names := make([]string, 0, len(clientAuthTypes))
+			for name := range clientAuthTypes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown client_auth_type '%s', must be one of %s", c.ClientAuthType, strings.Join(names, ", "))
+		}
+		if tlsConfig.ClientCAs == nil && (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) {
+			return nil, fmt.Errorf("client_auth_type '%s' requires a client_ca_file", c.ClientAuthType)
+		}
+		tlsConfig.ClientAuth = clientAuth
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,374 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/options"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxAuthCacheSize limits the number of cached successful basic auth checks, as bcrypt is deliberately expensive
+const maxAuthCacheSize = 100
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// Server serves kube eagle's HTTP endpoints, optionally with TLS and authentication as configured in the web config
+// file. The web config file, the certificates and the bearer token file are reloaded when they change, so that
+// rotated certificates are picked up without restart.
+type Server struct {
+	address         string
+	webConfigFile   string
+	bearerTokenFile string
+	reloadInterval  time.Duration
+	isTLS           bool
+
+	// requestsCtx is the base context of all requests, it's cancelled if the requests don't finish in time on shutdown
+	requestsCtx    context.Context
+	cancelRequests context.CancelFunc
+	serverMutex    sync.Mutex
+	server         *http.Server
+
+	mutex       sync.RWMutex
+	modTimes    map[string]time.Time
+	config      *Config
+	tlsConfig   *tls.Config
+	bearerToken string
+
+	authCacheMutex sync.Mutex
+	authCache      map[[sha256.Size]byte]bool
+}
+
+// NewServer creates a server and loads its web config, so that a misconfiguration is detected at startup
+func NewServer(opts *options.Options) (*Server, error) {
+	s := &Server{
+		address:         net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)),
+		webConfigFile:   opts.WebConfigFile,
+		bearerTokenFile: opts.WebBearerTokenFile,
+		reloadInterval:  opts.WebReloadInterval,
+		config:          &Config{},
+		authCache:       make(map[[sha256.Size]byte]bool),
+	}
+	s.requestsCtx, s.cancelRequests = context.WithCancel(context.Background())
+	err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+	s.isTLS = s.config.TLSServerConfig.enabled()
+
+	return s, nil
+}
+
+// ListenAndServe serves the given handler on the configured address. It serves HTTPS if a certificate is configured.
+// After Shutdown it returns http.ErrServerClosed.
+func (s *Server) ListenAndServe(handler http.Handler) error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener, handler)
+}
+
+// Serve is like ListenAndServe, but accepts connections on the given listener
+func (s *Server) Serve(listener net.Listener, handler http.Handler) error {
+	server := &http.Server{
+		Handler:  s.withHeaders(handler),
+		ErrorLog: stdlog.New(log.StandardLogger().WriterLevel(log.WarnLevel), "", 0),
+		BaseContext: func(net.Listener) context.Context {
+			return s.requestsCtx
+		},
+	}
+	s.serverMutex.Lock()
+	s.server = server
+	s.serverMutex.Unlock()
+	if !s.isTLS {
+		log.Info("Listening on ", listener.Addr())
+		return server.Serve(listener)
+	}
+
+	// The TLS config is looked up on each handshake, so that rotated certificates are used for new connections
+	tlsConfig := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, tlsConfig, _ := s.current()
+			if tlsConfig == nil {
+				return nil, fmt.Errorf("TLS has been disabled by a web config change, which requires a restart")
+			}
+			return tlsConfig, nil
+		},
+	}
+	log.Info("Listening on ", listener.Addr(), " (TLS)")
+	return server.Serve(tls.NewListener(listener, tlsConfig))
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests to finish. When the given context expires
+// first, the remaining requests are cancelled (including their Kubernetes API calls) and their connections closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.serverMutex.Lock()
+	server := s.server
+	s.serverMutex.Unlock()
+	if server == nil {
+		return nil
+	}
+
+	err := server.Shutdown(ctx)
+	s.cancelRequests()
+	if err != nil {
+		closeErr := server.Close()
+		if closeErr != nil {
+			log.Warnf("Failed to close remaining connections: %v", closeErr)
+		}
+	}
+	return err
+}
+
+// IsTLS returns whether the server serves HTTPS. Enabling or disabling TLS requires a restart.
+func (s *Server) IsTLS() bool {
+	return s.isTLS
+}
+
+// PeerTLSConfig returns the TLS config for requests to other replicas, e. g. proxied scrapes. Replicas share the web
+// config, so a peer is trusted if it presents the same certificate as this server. The peer's address isn't verified,
+// as it's usually a pod IP, which certificates rarely cover. This server's certificate is presented as client
+// certificate, so that peers requiring client certificates accept the requests if it's issued by their client CA.
+func (s *Server) PeerTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_, tlsConfig, _ := s.current()
+			if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+				// Without a certificate the handshake fails if the peer requires one
+				return &tls.Certificate{}, nil
+			}
+			return &tlsConfig.Certificates[0], nil
+		},
+		// The default verification of the chain and host name is replaced by VerifyPeerCertificate
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, tlsConfig, _ := s.current()
+			if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+				return fmt.Errorf("this replica has no certificate to compare the peer's certificate with")
+			}
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], tlsConfig.Certificates[0].Certificate[0]) {
+				return fmt.Errorf("the peer's certificate differs from this replica's certificate")
+			}
+			return nil
+		},
+	}
+}
+
+// Authenticated requires requests to the given handler to authenticate with basic auth or a bearer token, if any of
+// them is configured. Client certificates are verified during the TLS handshake already.
+func (s *Server) Authenticated(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, _, bearerToken := s.current()
+		if len(config.BasicAuthUsers) == 0 && bearerToken == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if user, password, ok := r.BasicAuth(); ok && len(config.BasicAuthUsers) > 0 {
+			if s.checkBasicAuth(config.BasicAuthUsers, user, password) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		if auth := r.Header.Get("Authorization"); bearerToken != "" && strings.HasPrefix(auth, "Bearer ") {
+			if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(bearerToken)) == 1 {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		log.Debugf("Rejected unauthenticated request from '%s' to '%s'", r.RemoteAddr, r.URL.Path)
+		if len(config.BasicAuthUsers) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kube-eagle"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// checkBasicAuth verifies the password against the user's bcrypt hash. Successful checks are cached, because bcrypt
+// would otherwise make each scrape expensive.
+func (s *Server) checkBasicAuth(users map[string]string, user string, password string) bool {
+	hash, exists := users[user]
+	cacheKey := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+	s.authCacheMutex.Lock()
+	isCached := s.authCache[cacheKey]
+	s.authCacheMutex.Unlock()
+	if isCached {
+		return true
+	}
+
+	if !exists {
+		// Compare against a dummy hash anyway, so that existing users can't be detected by the response time
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		hash = string(dummyHash)
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil || !exists {
+		return false
+	}
+
+	s.authCacheMutex.Lock()
+	if len(s.authCache) >= maxAuthCacheSize {
+		s.authCache = make(map[[sha256.Size]byte]bool)
+	}
+	s.authCache[cacheKey] = true
+	s.authCacheMutex.Unlock()
+	return true
+}
+
+// withHeaders adds the configured HTTP headers to all responses
+func (s *Server) withHeaders(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, _, _ := s.current()
+		for name, value := range config.HTTPServerConfig.Headers {
+			w.Header().Set(name, value)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Run reloads the web config, the certificates and the bearer token file if any of them has changed, checking them in
+// every reload interval until the context is cancelled. Failed reloads are logged and the previous config is kept.
+func (s *Server) Run(ctx context.Context) {
+	if s.reloadInterval == 0 {
+		return
+	}
+	ticker := time.NewTicker(s.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reloadIfChanged()
+		}
+	}
+}
+
+func (s *Server) reloadIfChanged() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.hasChanged() {
+		return
+	}
+
+	err := s.reloadLocked()
+	if err != nil {
+		// Remember the modification times anyway, so that a broken config isn't reloaded again until it changes
+		s.modTimes = s.statFiles()
+		log.Errorf("Failed to reload web config, keeping the previous one: %v", err)
+		return
+	}
+	log.Info("Web config has been reloaded")
+}
+
+// current returns the current web config, TLS config and bearer token
+func (s *Server) current() (*Config, *tls.Config, string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.config, s.tlsConfig, s.bearerToken
+}
+
+func (s *Server) reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reloadLocked()
+}
+
+func (s *Server) reloadLocked() error {
+	config := &Config{}
+	var err error
+	if s.webConfigFile != "" {
+		config, err = loadConfig(s.webConfigFile)
+		if err != nil {
+			return fmt.Errorf("failed to load web config file '%s': %v", s.webConfigFile, err)
+		}
+	}
+	for user, hash := range config.BasicAuthUsers {
+		_, err = bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return fmt.Errorf("invalid bcrypt hash of basic auth user '%s': %v", user, err)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLSServerConfig.enabled() {
+		tlsConfig, err = config.TLSServerConfig.build()
+		if err != nil {
+			return err
+		}
+	}
+
+	var bearerToken string
+	if s.bearerTokenFile != "" {
+		content, err := ioutil.ReadFile(s.bearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read bearer token file: %v", err)
+		}
+		bearerToken = strings.TrimSpace(string(content))
+		if bearerToken == "" {
+			return fmt.Errorf("bearer token file '%s' is empty", s.bearerTokenFile)
+		}
+	}
+
+	s.config, s.tlsConfig, s.bearerToken = config, tlsConfig, bearerToken
+	s.modTimes = s.statFiles()
+	return nil
+}
+
+// watchedFiles returns all files whose changes trigger a reload
+func (s *Server) watchedFiles() []string {
+	var files []string
+	if s.webConfigFile != "" {
+		files = append(files, s.webConfigFile)
+	}
+	if s.bearerTokenFile != "" {
+		files = append(files, s.bearerTokenFile)
+	}
+	return append(files, s.config.TLSServerConfig.files()...)
+}
+
+func (s *Server) statFiles() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, file := range s.watchedFiles() {
+		info, err := os.Stat(file)
+		if err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (s *Server) hasChanged() bool {
+	modTimes := s.statFiles()
+	if len(modTimes) != len(s.modTimes) {
+		return true
+	}
+	for file, modTime := range modTimes {
+		if !modTime.Equal(s.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
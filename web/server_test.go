@@ -0,0 +1,413 @@
+package web
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google-cloud-tools/kube-eagle/internal/certtest"
+	"github.com/google-cloud-tools/kube-eagle/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kube-eagle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// writeFile writes the file and moves its modification time forward, so that the change is detected even if the
+// previous version has been written within the file system's timestamp resolution
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Duration(len(content)) * time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// newTestServer creates a server whose options are loaded from the given flags
+func newTestServer(t *testing.T, flags ...string) *Server {
+	t.Helper()
+	opts, err := options.Load(append([]string{"--version", "test"}, flags...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+})
+
+// request sends a request with the given basic auth credentials or bearer token to the authenticated handler
+func request(s *Server, user string, password string, bearerToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	if bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+	recorder := httptest.NewRecorder()
+	s.Authenticated(okHandler).ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestBasicAuth(t *testing.T) {
+	webConfigFile := filepath.Join(tempDir(t), "web-config.yml")
+	writeFile(t, webConfigFile, "basic_auth_users:\n  alice: "+bcryptHash(t, "secret")+"\n")
+	s := newTestServer(t, "--web-config-file", webConfigFile)
+
+	tests := []struct {
+		user               string
+		password           string
+		expectedStatusCode int
+	}{
+		{user: "alice", password: "secret", expectedStatusCode: http.StatusOK},
+		{user: "alice", password: "wrong", expectedStatusCode: http.StatusUnauthorized},
+		{user: "bob", password: "secret", expectedStatusCode: http.StatusUnauthorized},
+		{expectedStatusCode: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		response := request(s, test.user, test.password, "")
+		if response.Code != test.expectedStatusCode {
+			t.Errorf("%s:%s: response status = %d, expected %d", test.user, test.password, response.Code, test.expectedStatusCode)
+		}
+		if test.expectedStatusCode == http.StatusUnauthorized && response.Header().Get("WWW-Authenticate") != `Basic realm="kube-eagle"` {
+			t.Errorf("%s:%s: WWW-Authenticate = %q, expected the basic auth challenge", test.user, test.password,
+				response.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// Invalid hashes are rejected at startup
+	writeFile(t, webConfigFile, "basic_auth_users:\n  alice: secret\n")
+	opts, _ := options.Load([]string{"--version", "test", "--web-config-file", webConfigFile})
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "invalid bcrypt hash of basic auth user 'alice'") {
+		t.Errorf("NewServer with plain text password = %v, expected an invalid hash error", err)
+	}
+}
+
+func TestBasicAuthCache(t *testing.T) {
+	webConfigFile := filepath.Join(tempDir(t), "web-config.yml")
+	writeFile(t, webConfigFile, "basic_auth_users:\n  alice: "+bcryptHash(t, "secret")+"\n")
+	s := newTestServer(t, "--web-config-file", webConfigFile)
+
+	// Only successful checks are cached
+	request(s, "alice", "wrong", "")
+	if len(s.authCache) != 0 {
+		t.Errorf("auth cache has %d entries after a failed check, expected none", len(s.authCache))
+	}
+	for i := 0; i < 2; i++ {
+		if response := request(s, "alice", "secret", ""); response.Code != http.StatusOK {
+			t.Fatalf("response status = %d, expected 200", response.Code)
+		}
+	}
+	if len(s.authCache) != 1 {
+		t.Errorf("auth cache has %d entries, expected 1", len(s.authCache))
+	}
+
+	// The cache is keyed by the hash, so that a changed password invalidates the cached check
+	writeFile(t, webConfigFile, "basic_auth_users:\n  alice: "+bcryptHash(t, "rotated")+"\n")
+	s.reloadIfChanged()
+	if response := request(s, "alice", "secret", ""); response.Code != http.StatusUnauthorized {
+		t.Errorf("response status with the previous password = %d, expected 401", response.Code)
+	}
+	if response := request(s, "alice", "rotated", ""); response.Code != http.StatusOK {
+		t.Errorf("response status with the rotated password = %d, expected 200", response.Code)
+	}
+
+	// The cache is bounded
+	users := make(map[string]string)
+	for i := 0; i < maxAuthCacheSize+10; i++ {
+		users[fmt.Sprintf("user-%d", i)] = bcryptHash(t, "secret")
+	}
+	for user := range users {
+		if !s.checkBasicAuth(users, user, "secret") {
+			t.Fatalf("check of %s failed", user)
+		}
+		if len(s.authCache) > maxAuthCacheSize {
+			t.Fatalf("auth cache has %d entries, expected at most %d", len(s.authCache), maxAuthCacheSize)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	bearerTokenFile := filepath.Join(tempDir(t), "token")
+	writeFile(t, bearerTokenFile, "token\n")
+	s := newTestServer(t, "--web-bearer-token-file", bearerTokenFile)
+
+	if response := request(s, "", "", "token"); response.Code != http.StatusOK {
+		t.Errorf("response status with token = %d, expected 200", response.Code)
+	}
+	if response := request(s, "", "", "wrong"); response.Code != http.StatusUnauthorized || response.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("response status with wrong token = %d, expected 401 without basic auth challenge", response.Code)
+	}
+
+	// Rotated tokens are used once the file has been checked, an empty file keeps the previous token
+	writeFile(t, bearerTokenFile, "rotated")
+	if response := request(s, "", "", "rotated"); response.Code != http.StatusUnauthorized {
+		t.Errorf("response status with rotated token before the check = %d, expected 401", response.Code)
+	}
+	s.reloadIfChanged()
+	if response := request(s, "", "", "rotated"); response.Code != http.StatusOK {
+		t.Errorf("response status with rotated token = %d, expected 200", response.Code)
+	}
+	writeFile(t, bearerTokenFile, "")
+	s.reloadIfChanged()
+	if response := request(s, "", "", "rotated"); response.Code != http.StatusOK {
+		t.Errorf("response status after a failed reload = %d, expected 200", response.Code)
+	}
+}
+
+// serve starts the server on a random port and returns its address
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	return serveHandler(t, s, s.Authenticated(okHandler))
+}
+
+// serveHandler serves the handler on a random port and returns the server's address. The server is shut down when
+// the test finishes.
+func serveHandler(t *testing.T, s *Server, handler http.Handler) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener, handler)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	// Wait until the server is set, as Shutdown would be a no-op otherwise
+	for i := 0; i < 100; i++ {
+		s.serverMutex.Lock()
+		server := s.server
+		s.serverMutex.Unlock()
+		if server != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return listener.Addr().String()
+}
+
+// get requests the server using TLS, trusting the given CA and presenting the given client certificate (if not nil).
+// It returns the serial number of the server's certificate.
+func get(address string, ca *certtest.Certificate, clientCert *certtest.Certificate) (string, error) {
+	tlsConfig := &tls.Config{RootCAs: ca.Pool()}
+	if clientCert != nil {
+		// The certificate is presented even if it's not issued by a CA the server accepts
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &clientCert.TLS, nil
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	defer client.CloseIdleConnections()
+	res, err := client.Get("https://" + address + "/metrics")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("response status %d", res.StatusCode)
+	}
+	return res.TLS.PeerCertificates[0].SerialNumber.String(), nil
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := tempDir(t)
+	ca := certtest.Write(t, dir, "ca", nil)
+	serverCert := certtest.Write(t, dir, "server", ca)
+	clientCert := certtest.Write(t, dir, "client", ca)
+	untrusted := certtest.Write(t, dir, "untrusted", nil)
+
+	webConfigFile := filepath.Join(dir, "web-config.yml")
+	// Relative paths are resolved relative to the web config file
+	writeFile(t, webConfigFile, "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_ca_file: ca.crt\n")
+	s := newTestServer(t, "--web-config-file", webConfigFile)
+	address := serve(t, s)
+
+	serialNumber, err := get(address, ca, clientCert)
+	if err != nil {
+		t.Fatalf("request with trusted client certificate failed: %v", err)
+	}
+	if serialNumber != serverCert.TLS.Leaf.SerialNumber.String() {
+		t.Errorf("server presented certificate %s, expected the configured one", serialNumber)
+	}
+	if _, err = get(address, ca, nil); err == nil {
+		t.Errorf("request without client certificate succeeded, expected it to be rejected")
+	}
+	if _, err = get(address, ca, untrusted); err == nil {
+		t.Errorf("request with untrusted client certificate succeeded, expected it to be rejected")
+	}
+
+	// Optional client certificates are verified if given
+	writeFile(t, webConfigFile, "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_ca_file: ca.crt\n"+
+		"  client_auth_type: VerifyClientCertIfGiven\n")
+	s.reloadIfChanged()
+	if _, err = get(address, ca, nil); err != nil {
+		t.Errorf("request without optional client certificate failed: %v", err)
+	}
+	if _, err = get(address, ca, untrusted); err == nil {
+		t.Errorf("request with untrusted optional client certificate succeeded, expected it to be rejected")
+	}
+}
+
+func TestCertificateRotation(t *testing.T) {
+	dir := tempDir(t)
+	ca := certtest.Write(t, dir, "ca", nil)
+	certtest.Write(t, dir, "server", ca)
+	webConfigFile := filepath.Join(dir, "web-config.yml")
+	writeFile(t, webConfigFile, "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n")
+	s := newTestServer(t, "--web-config-file", webConfigFile)
+	address := serve(t, s)
+
+	before, err := get(address, ca, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := certtest.Write(t, dir, "server", ca)
+	modTime := time.Now().Add(time.Hour)
+	for _, file := range []string{rotated.CertFile, rotated.KeyFile} {
+		if err = os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// New connections use the previous certificate until the files have been checked
+	if serialNumber, _ := get(address, ca, nil); serialNumber != before {
+		t.Errorf("certificate changed before the files have been checked")
+	}
+	s.reloadIfChanged()
+	after, err := get(address, ca, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before {
+		t.Errorf("server presents certificate %s after the rotation, expected the rotated one", after)
+	}
+}
+
+func TestRun(t *testing.T) {
+	bearerTokenFile := filepath.Join(tempDir(t), "token")
+	writeFile(t, bearerTokenFile, "token")
+	s := newTestServer(t, "--web-bearer-token-file", bearerTokenFile, "--web-reload-interval", "10ms")
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(stopped)
+	}()
+
+	writeFile(t, bearerTokenFile, "rotated")
+	deadline := time.Now().Add(5 * time.Second)
+	for request(s, "", "", "rotated").Code != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated token hasn't been loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-stopped
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name             string
+		requestDuration  time.Duration
+		expectCancelled  bool
+		expectedResponse string
+	}{
+		// In-flight requests are drained
+		{name: "drained", requestDuration: 50 * time.Millisecond, expectedResponse: "ok"},
+		// Requests which are still in flight once the timeout expires are cancelled
+		{name: "cancelled", requestDuration: time.Minute, expectCancelled: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			started := make(chan struct{})
+			cancelled := make(chan struct{})
+			address := serveHandler(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				select {
+				case <-time.After(test.requestDuration):
+					w.Write([]byte("ok"))
+				case <-r.Context().Done():
+					close(cancelled)
+				}
+			}))
+			response := make(chan string, 1)
+			go func() {
+				resp, err := http.Get("http://" + address)
+				if err != nil {
+					response <- ""
+					return
+				}
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				response <- string(body)
+			}()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			begin := time.Now()
+			err := s.Shutdown(ctx)
+			if (err != nil) != test.expectCancelled {
+				t.Errorf("shutdown returned %v, expected an error %v", err, test.expectCancelled)
+			}
+			if test.expectCancelled {
+				if duration := time.Since(begin); duration < 500*time.Millisecond {
+					t.Errorf("shutdown returned after %v, expected it to wait for the timeout", duration)
+				}
+				select {
+				case <-cancelled:
+				case <-time.After(5 * time.Second):
+					t.Errorf("the in-flight request's context hasn't been cancelled")
+				}
+			}
+			select {
+			case body := <-response:
+				if body != test.expectedResponse {
+					t.Errorf("response = %q, expected %q", body, test.expectedResponse)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("the request didn't finish")
+			}
+		})
+	}
+}